@@ -0,0 +1,261 @@
+package zeolite_test
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/42LoCo42/go-zeolite"
+)
+
+// countingConn counts the read calls on the underlying connection
+type countingConn struct {
+	net.Conn
+	reads *int64
+}
+
+func (c countingConn) Read(p []byte) (int, error) {
+	atomic.AddInt64(c.reads, 1)
+	return c.Conn.Read(p)
+}
+
+func benchmarkSmallFrames(b *testing.B, opts ...zeolite.Option) {
+	ids := identities(b, 2)
+	idA, idB := ids[0], ids[1]
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer listener.Close()
+
+	msg := make([]byte, 16)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		a, err := idA.NewStream(conn, trustAll, opts...)
+		if err != nil {
+			return
+		}
+		for i := 0; i < b.N; i++ {
+			if a.Send(msg) != nil {
+				return
+			}
+		}
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+
+	var reads int64
+	s, err := idB.NewStream(countingConn{conn, &reads}, trustAll, opts...)
+	if err != nil {
+		b.Fatal(err)
+	}
+	atomic.StoreInt64(&reads, 0)
+
+	b.SetBytes(int64(len(msg)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := s.Recv(); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(atomic.LoadInt64(&reads))/float64(b.N), "reads/frame")
+}
+
+func BenchmarkSmallFrames(b *testing.B) {
+	b.Run("default", func(b *testing.B) {
+		benchmarkSmallFrames(b)
+	})
+	// the smallest buffer bufio allows, smaller than a frame
+	b.Run("16", func(b *testing.B) {
+		benchmarkSmallFrames(b, zeolite.WithReadBuffer(16))
+	})
+	b.Run("64k", func(b *testing.B) {
+		benchmarkSmallFrames(b, zeolite.WithReadBuffer(64*1024))
+	})
+}
+
+// benchmarkTransfer copies a large amount of data in frames of size bytes,
+// like the CLI does with its --buffer-size
+func benchmarkTransfer(b *testing.B, size int) {
+	a, s := pair(b)
+
+	// 64 MiB per run, so every size moves the same amount of data
+	const total = 64 << 20
+	go func() {
+		src := io.LimitReader(zeroReader{}, int64(b.N)*total)
+		if _, err := io.CopyBuffer(a, src, make([]byte, size)); err != nil {
+			return
+		}
+		a.CloseWrite()
+	}()
+
+	b.SetBytes(total)
+	b.ResetTimer()
+	n, err := zeolite.BlockCopy(io.Discard, s)
+	if err != zeolite.ErrEOS {
+		b.Fatal(err)
+	}
+	if n != int64(b.N)*total {
+		b.Fatalf("received %d bytes, expected %d", n, int64(b.N)*total)
+	}
+}
+
+// zeroReader is an endless source of zeros
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func BenchmarkTransfer(b *testing.B) {
+	for _, size := range []int{4 << 10, 32 << 10, 128 << 10, 1 << 20} {
+		b.Run(fmt.Sprintf("%dk", size>>10), func(b *testing.B) {
+			benchmarkTransfer(b, size)
+		})
+	}
+}
+
+// benchmarkHandshakeBurst connects bursts of clients at once to a listener
+// with the given number of handshake workers
+func benchmarkHandshakeBurst(b *testing.B, workers int) {
+	const burst = 64
+
+	ids := identities(b, 2)
+	idA, idB := ids[0], ids[1]
+
+	listener, err := idA.Listen("tcp", "127.0.0.1:0", trustAll)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer listener.Close()
+	listener.HandshakeWorkers = workers
+	go listener.Serve(func(stream *zeolite.Stream) {})
+
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		errs := make(chan error, burst)
+		for j := 0; j < burst; j++ {
+			go func() {
+				conn, err := net.Dial("tcp", listener.Addr().String())
+				if err != nil {
+					errs <- err
+					return
+				}
+				defer conn.Close()
+				_, err = idB.NewStream(conn, trustAll)
+				errs <- err
+			}()
+		}
+		for j := 0; j < burst; j++ {
+			if err := <-errs; err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	b.ReportMetric(float64(b.N*burst)/time.Since(start).Seconds(), "handshakes/s")
+}
+
+func BenchmarkHandshakeBurst(b *testing.B) {
+	b.Run("unlimited", func(b *testing.B) {
+		benchmarkHandshakeBurst(b, 0)
+	})
+	b.Run("workers", func(b *testing.B) {
+		benchmarkHandshakeBurst(b, runtime.NumCPU())
+	})
+}
+
+// benchmarkRelay forwards messages from one stream to another
+// with relay, like a proxy between two peers
+func benchmarkRelay(b *testing.B, relay func(dst, src *zeolite.Stream) error) {
+	src, relayIn := pair(b)
+	relayOut, dst := pair(b)
+
+	msg := make([]byte, 32<<10)
+	go func() {
+		for i := 0; i < b.N; i++ {
+			if src.Send(msg) != nil {
+				return
+			}
+		}
+		src.CloseWrite()
+	}()
+	go relay(relayOut, relayIn)
+
+	b.SetBytes(int64(len(msg)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := dst.Recv(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRelay(b *testing.B) {
+	b.Run("recv-send", func(b *testing.B) {
+		benchmarkRelay(b, func(dst, src *zeolite.Stream) error {
+			for {
+				msg, err := src.Recv()
+				if err != nil {
+					return err
+				}
+				if err := dst.Send(msg); err != nil {
+					return err
+				}
+			}
+		})
+	})
+	b.Run("relay", func(b *testing.B) {
+		benchmarkRelay(b, func(dst, src *zeolite.Stream) error {
+			_, err := zeolite.Relay(dst, src)
+			return err
+		})
+	})
+}
+
+// BenchmarkSendRecv measures the allocations of Send & Recv (on both
+// sides together) per message of various sizes. It runs over TCP
+// loopback, since net.Pipe can't carry the handshake, in which
+// both sides write before they read.
+func BenchmarkSendRecv(b *testing.B) {
+	for _, size := range []int{64, 1 << 10, 64 << 10, 1 << 20} {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			a, s := pair(b)
+
+			msg := make([]byte, size)
+			go func() {
+				for i := 0; i < b.N; i++ {
+					if a.Send(msg) != nil {
+						return
+					}
+				}
+			}()
+
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := s.Recv(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
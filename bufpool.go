@@ -0,0 +1,27 @@
+package zeolite
+
+import "sync"
+
+// maxPooled is the capacity of the biggest buffer kept in bufPool
+const maxPooled = 1 << 20
+
+// bufPool holds buffers for encrypted frames, so that sending & receiving
+// don't allocate new ones for every frame
+var bufPool = sync.Pool{New: func() any { return new([]byte) }}
+
+// getBuf returns a buffer of length n from bufPool
+func getBuf(n int) *[]byte {
+	buf := bufPool.Get().(*[]byte)
+	if cap(*buf) < n {
+		*buf = make([]byte, n)
+	}
+	*buf = (*buf)[:n]
+	return buf
+}
+
+// putBuf returns buf to bufPool, unless it is too big to keep around
+func putBuf(buf *[]byte) {
+	if cap(*buf) <= maxPooled {
+		bufPool.Put(buf)
+	}
+}
@@ -0,0 +1,210 @@
+package zeolite
+
+import (
+	// #include <sodium.h>
+	"C"
+
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrCert            = errors.New("invalid certificate")
+	ErrCertExpired     = errors.New("certificate expired")
+	ErrCertNotYetValid = errors.New("certificate not yet valid")
+)
+
+// CertValidityError is returned for a certificate that is used outside
+// of its validity window. It wraps ErrCertExpired or ErrCertNotYetValid
+// and shows the window along with the local time, since the usual cause
+// of such failures on a correctly configured peer is a wrong clock.
+type CertValidityError struct {
+	Err       error
+	NotBefore time.Time // zero if unlimited
+	NotAfter  time.Time // zero if unlimited
+	Now       time.Time // the local time of the check
+}
+
+func (e *CertValidityError) Error() string {
+	window := func(t time.Time, unlimited string) string {
+		if t.IsZero() {
+			return unlimited
+		}
+		return t.Format(time.RFC3339)
+	}
+	return fmt.Sprintf("%v: valid from %s until %s, local time %s (check the clocks)",
+		e.Err, window(e.NotBefore, "any time"), window(e.NotAfter, "any time"),
+		e.Now.Format(time.RFC3339))
+}
+
+func (e *CertValidityError) Unwrap() error {
+	return e.Err
+}
+
+// certContext separates certificate signatures from all other signatures
+const certContext = "zeolite cert\x00"
+
+// Cert states that the issuer (a CA) trusts the subject
+// between NotBefore and NotAfter (Unix time, 0 means unlimited).
+type Cert struct {
+	Issuer    SignPK
+	Subject   SignPK
+	NotBefore int64
+	NotAfter  int64
+	Signature [C.crypto_sign_BYTES]byte
+}
+
+const CertBytes = 2*len(SignPK{}) + 2*8 + C.crypto_sign_BYTES
+
+// IssueCert creates a certificate for peerPK signed by identity.
+// It is valid forever.
+func (identity Identity) IssueCert(peerPK SignPK) []byte {
+	return identity.IssueCertValid(peerPK, time.Time{}, time.Time{})
+}
+
+// IssueCertValid creates a certificate for peerPK signed by identity
+// that is only valid between notBefore and notAfter.
+// A zero time removes the respective limit.
+func (identity Identity) IssueCertValid(
+	peerPK SignPK,
+	notBefore, notAfter time.Time,
+) []byte {
+	cert := Cert{Issuer: identity.Public, Subject: peerPK}
+	if !notBefore.IsZero() {
+		cert.NotBefore = notBefore.Unix()
+	}
+	if !notAfter.IsZero() {
+		cert.NotAfter = notAfter.Unix()
+	}
+	msg := cert.signed()
+
+	C.crypto_sign_detached(
+		ptr(cert.Signature[:]),
+		nil,
+		ptr(msg),
+		size(msg),
+		ptr(identity.Secret[:]),
+	)
+	return cert.Bytes()
+}
+
+// signed returns the message covered by the signature
+func (cert Cert) signed() []byte {
+	ret := append([]byte(certContext), cert.Subject[:]...)
+	ret = binary.LittleEndian.AppendUint64(ret, uint64(cert.NotBefore))
+	return binary.LittleEndian.AppendUint64(ret, uint64(cert.NotAfter))
+}
+
+func (cert Cert) Bytes() []byte {
+	ret := make([]byte, 0, CertBytes)
+	ret = append(ret, cert.Issuer[:]...)
+	ret = append(ret, cert.Subject[:]...)
+	ret = binary.LittleEndian.AppendUint64(ret, uint64(cert.NotBefore))
+	ret = binary.LittleEndian.AppendUint64(ret, uint64(cert.NotAfter))
+	return append(ret, cert.Signature[:]...)
+}
+
+func ParseCert(data []byte) (ret Cert, err error) {
+	if len(data) != CertBytes {
+		return ret, ErrCert
+	}
+
+	data = data[copy(ret.Issuer[:], data):]
+	data = data[copy(ret.Subject[:], data):]
+	ret.NotBefore = int64(binary.LittleEndian.Uint64(data))
+	ret.NotAfter = int64(binary.LittleEndian.Uint64(data[8:]))
+	copy(ret.Signature[:], data[16:])
+	return ret, nil
+}
+
+// Valid checks the validity window of cert at time now.
+// It fails with a *CertValidityError.
+func (cert Cert) Valid(now time.Time) error {
+	return cert.validSkew(now, 0)
+}
+
+// validSkew is like Valid, but extends the window by skew on both ends
+func (cert Cert) validSkew(now time.Time, skew time.Duration) error {
+	var err error
+	switch {
+	case cert.NotBefore != 0 && now.Add(skew).Unix() < cert.NotBefore:
+		err = ErrCertNotYetValid
+	case cert.NotAfter != 0 && now.Add(-skew).Unix() > cert.NotAfter:
+		err = ErrCertExpired
+	default:
+		return nil
+	}
+
+	ret := &CertValidityError{Err: err, Now: now}
+	if cert.NotBefore != 0 {
+		ret.NotBefore = time.Unix(cert.NotBefore, 0)
+	}
+	if cert.NotAfter != 0 {
+		ret.NotAfter = time.Unix(cert.NotAfter, 0)
+	}
+	return ret
+}
+
+// CertPool verifies certificates against a set of trusted CAs.
+type CertPool struct {
+	CAs []SignPK
+
+	// Skew is the tolerated difference between the clocks of the CA and
+	// the local one: certificates are accepted up to Skew before their
+	// start and after their end. Keep it small (e.g. a few minutes).
+	Skew time.Duration
+}
+
+func NewCertPool(cas ...SignPK) *CertPool {
+	return &CertPool{CAs: cas}
+}
+
+// Verify checks that data is a certificate for peer
+// that was issued by one of the CAs of the pool and is currently valid.
+func (pool *CertPool) Verify(peer SignPK, data []byte) error {
+	cert, err := ParseCert(data)
+	if err != nil {
+		return err
+	}
+	if !cert.Subject.Equal(peer) {
+		return ErrCert
+	}
+
+	for _, ca := range pool.CAs {
+		if !ca.Equal(cert.Issuer) {
+			continue
+		}
+
+		msg := cert.signed()
+		if C.crypto_sign_verify_detached(
+			ptr(cert.Signature[:]),
+			ptr(msg),
+			size(msg),
+			ptr(ca[:]),
+		) != 0 {
+			return ErrCert
+		}
+		return cert.validSkew(time.Now(), pool.Skew)
+	}
+	return ErrCert
+}
+
+// WithCert presents cert (see IssueCert) to the peer during the handshake.
+// It is only sent if the peer supports certificates.
+func WithCert(cert []byte) Option {
+	return func(cfg *config) {
+		cfg.caps |= CapCert
+		cfg.cert = cert
+	}
+}
+
+// WithCertPool trusts peers that present a certificate valid in pool.
+// Peers without a valid certificate are still checked by the TrustCB.
+func WithCertPool(pool *CertPool) Option {
+	return func(cfg *config) {
+		cfg.caps |= CapCert
+		cfg.pool = pool
+	}
+}
@@ -0,0 +1,77 @@
+package zeolite
+
+import "errors"
+
+// Channels multiplex independent conversations over one stream: every
+// message belongs to a channel, identified by a number. Channel 0 carries
+// the data of Send & Recv and ends with the stream (see CloseWrite).
+// The others (1-255) end independently of each other with CloseChannel.
+// They require both sides to offer them (see WithChannels) and a peer
+// that reads with RecvChannel. There is no flow control per channel: data
+// that isn't consumed stalls all channels, like on a single stream.
+
+// ErrChannel is returned by Recv for data of channels other than 0,
+// which is discarded. Streams carrying channels must use RecvChannel.
+var ErrChannel = errors.New("received data of a channel (see RecvChannel)")
+
+// WithChannels offers channels, which implies typed frames. They are only
+// used if the peer offers them too; otherwise SendChannel & CloseChannel
+// return ErrProto for channels other than 0, so applications that depend
+// on them must check Caps for CapChannels.
+func WithChannels() Option {
+	return func(cfg *config) {
+		cfg.caps |= CapFrameTypes | CapChannels
+	}
+}
+
+// hasChannels reports whether channels were agreed on
+func (stream *Stream) hasChannels() bool {
+	return stream.Caps&(CapFrameTypes|CapChannels) == CapFrameTypes|CapChannels
+}
+
+// SendChannel sends msg on channel ch, as a message of its own.
+// Channel 0 is the same as Send. On other channels, empty messages are
+// not sent, since an empty frame ends the channel.
+func (stream *Stream) SendChannel(ch uint8, msg []byte) error {
+	if ch == 0 {
+		return stream.Send(msg)
+	}
+	if !stream.hasChannels() {
+		return ErrProto
+	}
+	if len(msg) == 0 {
+		return nil
+	}
+
+	frame := getBuf(1 + len(msg))
+	defer putBuf(frame)
+	(*frame)[0] = ch
+	copy((*frame)[1:], msg)
+
+	if err := stream.sendFrame(FrameChannel, *frame, TagMessage); err != nil {
+		return err
+	}
+	stream.cfg.metrics.sent(len(msg))
+	return nil
+}
+
+// CloseChannel tells the peer that no more data will be sent on channel
+// ch. For channel 0, this is CloseWrite, after which nothing can be sent
+// on any channel.
+func (stream *Stream) CloseChannel(ch uint8) error {
+	if ch == 0 {
+		return stream.CloseWrite()
+	}
+	if !stream.hasChannels() {
+		return ErrProto
+	}
+	return stream.sendFrame(FrameChannel, []byte{ch}, TagMessage)
+}
+
+// RecvChannel is like Recv, but also returns the messages of other
+// channels, along with the number of their channel. The end of a channel
+// is returned as ErrEOS with its number, so the end of the stream
+// is ErrEOS on channel 0.
+func (stream *Stream) RecvChannel() (ch uint8, msg []byte, err error) {
+	return stream.recvChannel(nil)
+}
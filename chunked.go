@@ -0,0 +1,84 @@
+package zeolite
+
+import (
+	"io"
+)
+
+// chunkSize is the payload size of the frames sent by SendReader
+const chunkSize = 64 * 1024
+
+// SendReader sends size bytes read from r as one message, split into
+// frames of up to 64 KiB. The last one is tagged PUSH, which marks the end
+// of the message for RecvWriter. Only one chunk is in memory at a time,
+// so the message can be much bigger than the available memory.
+// If size is negative, r is read until EOF.
+//
+// Other calls of Send must not happen concurrently, since their frames
+// would become part of the message. If r fails or ends early, the peer
+// has received an incomplete message and the stream should be closed.
+// Peers that use Recv instead of RecvWriter receive every frame
+// as a message of its own.
+func (stream *Stream) SendReader(r io.Reader, size int64) error {
+	if size >= 0 {
+		r = io.LimitReader(r, size)
+	}
+
+	// read ahead by one chunk to know which one is the last
+	cur, next := make([]byte, chunkSize), make([]byte, chunkSize)
+	total := int64(0)
+	n, err := io.ReadFull(r, cur)
+	for {
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		// even a full chunk may be the last one
+		m, nextErr := 0, io.EOF
+		if err == nil {
+			m, nextErr = io.ReadFull(r, next)
+		}
+
+		total += int64(n)
+		if m == 0 && nextErr == io.EOF {
+			if size >= 0 && total != size {
+				return io.ErrUnexpectedEOF
+			}
+			if err := stream.sendFrame(FrameData, cur[:n], TagPush); err != nil {
+				return err
+			}
+			stream.cfg.metrics.sent(n)
+			return nil
+		}
+		if err := stream.sendFrame(FrameData, cur[:n], TagMessage); err != nil {
+			return err
+		}
+		stream.cfg.metrics.sent(n)
+		cur, next, n, err = next, cur, m, nextErr
+	}
+}
+
+// RecvWriter receives one message sent by SendReader and writes it to w
+// as it arrives, so only one frame is in memory at a time. The recv limit
+// (see WithRecvLimit) applies to each frame, not to the whole message.
+// If the stream ends before the message is complete,
+// it returns io.ErrUnexpectedEOF.
+func (stream *Stream) RecvWriter(w io.Writer) error {
+	buf := getBuf(chunkSize)
+	defer putBuf(buf)
+
+	for {
+		chunk, err := stream.recv(*buf)
+		if err == ErrEOS {
+			return io.ErrUnexpectedEOF
+		} else if err != nil {
+			return err
+		}
+
+		if _, err := w.Write(chunk); err != nil {
+			return err
+		}
+		if stream.pushed {
+			return nil
+		}
+	}
+}
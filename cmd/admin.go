@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// acceptPaused makes servers close new connections right away
+var acceptPaused atomic.Bool
+
+// pausableListener closes accepted connections while acceptPaused is set
+type pausableListener struct {
+	net.Listener
+}
+
+func (l pausableListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil || !acceptPaused.Load() {
+			return conn, err
+		}
+		conn.Close()
+	}
+}
+
+// serveAdmin accepts admin connections on a Unix socket at path,
+// which only our user may access
+func serveAdmin(path string) error {
+	// remove a socket left behind by an earlier run
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+
+	listener, err := listenPrivate(path)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				info("Admin socket:", err)
+				return
+			}
+			go func() {
+				defer conn.Close()
+				admin(conn, conn)
+			}()
+		}
+	}()
+	return nil
+}
+
+// admin executes the commands read from r, one per line,
+// and writes their output to w
+func admin(r io.Reader, w io.Writer) {
+	scn := bufio.NewScanner(r)
+	for scn.Scan() {
+		fields := strings.Fields(scn.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch cmd, args := fields[0], fields[1:]; {
+		case cmd == "list" && len(args) == 0:
+			writeSummary(w)
+		case cmd == "close" && len(args) == 1:
+			fmt.Fprintf(w, "closed %d connections\n", closePeer(args[0]))
+		case cmd == "reload" && len(args) == 0:
+			if err := reloadTrust(); err != nil {
+				fmt.Fprintln(w, "error:", err)
+			} else {
+				fmt.Fprintln(w, "reloaded")
+			}
+		case cmd == "pause" && len(args) == 0:
+			acceptPaused.Store(true)
+			fmt.Fprintln(w, "paused")
+		case cmd == "resume" && len(args) == 0:
+			acceptPaused.Store(false)
+			fmt.Fprintln(w, "resumed")
+		case cmd == "help":
+			fmt.Fprintln(w, "commands: list, close <fingerprint>, reload, pause, resume")
+		default:
+			fmt.Fprintln(w, "error: invalid command, try help")
+		}
+	}
+}
+
+// closePeer closes all connections of the peer with the given fingerprint
+// and returns how many there were
+func closePeer(fingerprint string) (n int) {
+	for _, stream := range activeStreams() {
+		if stream.OtherPK.Fingerprint() != fingerprint {
+			continue
+		}
+		if conn, ok := stream.Conn.(io.Closer); ok {
+			conn.Close()
+			n++
+		}
+	}
+	return n
+}
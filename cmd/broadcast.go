@@ -0,0 +1,139 @@
+package main
+
+import (
+	"io"
+	"sync"
+
+	"github.com/42LoCo42/go-zeolite"
+)
+
+// subscriberQueue is the number of messages a subscriber may fall behind
+const subscriberQueue = 64
+
+// subscriber receives the messages of a broadcaster
+type subscriber struct {
+	queue   chan []byte
+	conn    io.Closer
+	dropped bool
+}
+
+// broadcaster sends everything read from its source to all subscribers
+type broadcaster struct {
+	mtx      sync.Mutex // guards subs, finished & the queues
+	subs     map[*subscriber]struct{}
+	finished bool
+}
+
+// serve handles a stream of the broadcast mode:
+// it sends the messages of sub until the source ends
+func (b *broadcaster) serve(stream *zeolite.Stream) {
+	sub := &subscriber{queue: make(chan []byte, subscriberQueue)}
+	if closer, ok := stream.Conn.(io.Closer); ok {
+		sub.conn = closer
+	}
+
+	b.mtx.Lock()
+	if b.finished {
+		b.mtx.Unlock()
+		stream.CloseWrite()
+		return
+	}
+	if b.subs == nil {
+		b.subs = map[*subscriber]struct{}{}
+	}
+	b.subs[sub] = struct{}{}
+	b.mtx.Unlock()
+
+	// subscribers don't send anything, discard it anyway
+	go func() {
+		for {
+			if _, err := stream.Recv(); err != nil {
+				return
+			}
+		}
+	}()
+
+	id := stream.OtherPK.Fingerprint()
+	for msg := range sub.queue {
+		if err := stream.Send(msg); err != nil {
+			b.mtx.Lock()
+			dropped := sub.dropped
+			if !dropped {
+				b.drop(sub)
+			}
+			b.mtx.Unlock()
+
+			if dropped {
+				info("Subscriber", id, "was too slow, dropped")
+			} else {
+				info("Subscriber", id, "failed:", err)
+			}
+			return
+		}
+	}
+	if sub.dropped {
+		info("Subscriber", id, "was too slow, dropped")
+		return
+	}
+	stream.CloseWrite()
+}
+
+// publish queues msg for all subscribers. Those whose queue is full
+// are dropped at once, so they can't stall the others.
+func (b *broadcaster) publish(msg []byte) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	for sub := range b.subs {
+		select {
+		case sub.queue <- msg:
+		default:
+			b.drop(sub)
+		}
+	}
+}
+
+// drop ends the subscription of sub immediately
+func (b *broadcaster) drop(sub *subscriber) {
+	delete(b.subs, sub)
+	sub.dropped = true
+	close(sub.queue)
+	if sub.conn != nil {
+		// unblock a pending Send
+		sub.conn.Close()
+	}
+}
+
+// finish ends all subscriptions after their queued messages
+func (b *broadcaster) finish() {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if b.finished {
+		return
+	}
+	b.finished = true
+	for sub := range b.subs {
+		close(sub.queue)
+	}
+	b.subs = nil
+}
+
+// run publishes everything read from src, then ends all subscriptions
+func (b *broadcaster) run(src io.Reader) error {
+	defer b.finish()
+
+	for {
+		// every message is shared by all queues, so it needs its own buffer
+		buf := make([]byte, *bufferSize)
+		n, err := src.Read(buf)
+		if n > 0 {
+			b.publish(buf[:n])
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
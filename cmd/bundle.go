@@ -0,0 +1,184 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/42LoCo42/go-zeolite"
+)
+
+// names of the entries in a bundle
+const (
+	bundleIdentity    = "identity"     // raw, like -I files
+	bundleIdentityEnc = "identity.enc" // see zeolite.Identity.Encrypt
+	bundleTrust       = "trust"        // like -T files
+)
+
+// bundleExport writes identity and the trust entries to a gzipped tar
+// archive at path. With a passphrase, the identity is encrypted.
+func bundleExport(
+	path string,
+	identity zeolite.Identity,
+	entries []trustEntry,
+	passphrase []byte,
+) error {
+	name := bundleIdentity
+	data := append(identity.Public[:], identity.Secret[:]...)
+	if passphrase != nil {
+		var err error
+		name = bundleIdentityEnc
+		if data, err = identity.Encrypt(passphrase); err != nil {
+			return err
+		}
+	}
+
+	trust := bytes.Buffer{}
+	for _, entry := range entries {
+		// trust files only contain full IDs
+		if entry.prefix != "" {
+			continue
+		}
+		if entry.expires.IsZero() {
+			fmt.Fprintln(&trust, entry.id)
+		} else {
+			fmt.Fprintln(&trust, entry.id, entry.expires.Format(time.RFC3339))
+		}
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	gz := gzip.NewWriter(file)
+	archive := tar.NewWriter(gz)
+	for _, entry := range []struct {
+		name string
+		data []byte
+	}{{name, data}, {bundleTrust, trust.Bytes()}} {
+		if err := archive.WriteHeader(&tar.Header{
+			Name:    entry.name,
+			Mode:    0600,
+			Size:    int64(len(entry.data)),
+			ModTime: time.Now(),
+		}); err != nil {
+			return err
+		}
+		if _, err := archive.Write(entry.data); err != nil {
+			return err
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// readBundle reads the bundle at path. The identity must be valid,
+// while problems with the trust entries are only warned about.
+// An encrypted identity needs passphrase.
+func readBundle(path string, passphrase []byte) (
+	identity zeolite.Identity,
+	trust []byte,
+	err error,
+) {
+	file, err := os.Open(path)
+	if err != nil {
+		return identity, nil, err
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return identity, nil, fmt.Errorf("bundle: %w", err)
+	}
+	found := false
+	archive := tar.NewReader(gz)
+	for {
+		header, err := archive.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return identity, nil, err
+		}
+
+		data, err := io.ReadAll(archive)
+		if err != nil {
+			return identity, nil, err
+		}
+
+		switch header.Name {
+		case bundleIdentity:
+			identity, err = zeolite.LoadIdentity(data)
+		case bundleIdentityEnc:
+			if passphrase == nil {
+				return identity, nil, errors.New(
+					"bundle: identity is encrypted, use --passphrase-var")
+			}
+			identity, err = zeolite.DecryptIdentity(data, passphrase)
+		case bundleTrust:
+			trust = data
+			_, err = parseTrust(bytes.NewReader(data), path)
+		default:
+			err = fmt.Errorf("unknown entry %q", header.Name)
+		}
+		if err != nil {
+			return identity, nil, fmt.Errorf("bundle: %w", err)
+		}
+		found = found || header.Name != bundleTrust
+	}
+
+	if !found {
+		return identity, nil, errors.New("bundle: no identity")
+	}
+	return identity, trust, nil
+}
+
+// bundleImport restores the bundle at path to identFile and trustFile
+// (which may be empty to skip the trust entries).
+// Existing files are only overwritten if force is set, and only once
+// the new data is complete, so a failed import keeps the old identity.
+func bundleImport(
+	path, identFile, trustFile string,
+	passphrase []byte,
+	force bool,
+) error {
+	identity, trust, err := readBundle(path, passphrase)
+	if err != nil {
+		return err
+	}
+
+	if !force {
+		for _, target := range []string{identFile, trustFile} {
+			if target == "" {
+				continue
+			}
+			if _, err := os.Stat(target); err == nil {
+				return fmt.Errorf("%s exists, use --force to overwrite", target)
+			}
+		}
+	}
+
+	data := append(identity.Public[:], identity.Secret[:]...)
+	if err := writeAtomic(identFile, data); err != nil {
+		return err
+	}
+	info("Imported identity", identity.Public.Fingerprint())
+
+	if trustFile != "" {
+		if err := writeAtomic(trustFile, trust); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/42LoCo42/go-zeolite"
+)
+
+// channel attaches file descriptors to a logical channel (see --channel)
+type channel struct {
+	id  uint8
+	in  *os.File // sent on the channel
+	out *os.File // receives the data of the channel
+
+	mtx  sync.Mutex
+	open int // directions using a shared descriptor
+}
+
+// channels of the session, indexed by their number
+var channels = map[uint8]*channel{}
+
+// parseChannel parses <id>:<fd>[:<out fd>]
+func parseChannel(val string) (*channel, error) {
+	parts := strings.Split(val, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return nil, fmt.Errorf("invalid channel: %s", val)
+	}
+
+	id, err := strconv.ParseUint(parts[0], 10, 8)
+	if err != nil || id == 0 {
+		return nil, fmt.Errorf("invalid channel number: %s", parts[0])
+	}
+
+	fds := []*os.File{}
+	for _, part := range parts[1:] {
+		fd, err := strconv.ParseUint(part, 10, 31)
+		if err != nil || fd <= 2 {
+			return nil, fmt.Errorf("invalid file descriptor: %s", part)
+		}
+		file := os.NewFile(uintptr(fd), "fd "+part)
+		if _, err := file.Stat(); err != nil {
+			return nil, fmt.Errorf("channel %d: %w", id, err)
+		}
+		fds = append(fds, file)
+	}
+
+	// one descriptor for both directions is closed when both are done
+	return &channel{id: uint8(id), in: fds[0], out: fds[len(fds)-1], open: 2}, nil
+}
+
+// finish closes the descriptor of a direction that is done.
+// A shared one is only closed once both are done.
+func (c *channel) finish(file *os.File) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.in != c.out {
+		file.Close()
+		return
+	}
+	if c.open--; c.open == 0 {
+		file.Close()
+	}
+}
+
+// sendChannels sends the input of all channels, each ended by
+// CloseChannel. It returns when all are done or one failed.
+func sendChannels(stream *zeolite.Stream) error {
+	wg := sync.WaitGroup{}
+	errs := make(chan error, len(channels))
+	for _, c := range channels {
+		c := c
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer c.finish(c.in)
+
+			buf := make([]byte, *bufferSize)
+			for {
+				n, err := c.in.Read(buf)
+				if n > 0 {
+					if err := stream.SendChannel(c.id, buf[:n]); err != nil {
+						errs <- err
+						return
+					}
+				}
+				if err == io.EOF {
+					if err := stream.CloseChannel(c.id); err != nil {
+						errs <- err
+					}
+					return
+				} else if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	select {
+	case err := <-errs:
+		return err
+	default:
+		return nil
+	}
+}
+
+// recvChannels writes the data of channel 0 to dst and that of the others
+// to their descriptors, discarding unknown ones. It returns ErrEOS at the
+// end of the stream, which also ends channels the peer didn't end before.
+func recvChannels(stream *zeolite.Stream, dst io.Writer) error {
+	done := map[uint8]bool{}
+	defer func() {
+		for _, c := range channels {
+			if !done[c.id] {
+				c.finish(c.out)
+			}
+		}
+	}()
+
+	retries := 0
+	for {
+		ch, msg, err := stream.RecvChannel()
+		if err != nil && zeolite.Retryable(err) && retries < zeolite.MaxRetries {
+			retries++
+			continue
+		}
+		retries = 0
+
+		if ch == 0 {
+			if err != nil {
+				return err
+			}
+			if _, err := dst.Write(msg); err != nil {
+				return err
+			}
+			continue
+		}
+
+		c := channels[ch]
+		if c == nil || done[ch] {
+			// only ever complain once per channel
+			if !done[ch] {
+				info("Discarding data of unknown channel", ch)
+				done[ch] = true
+			}
+			continue
+		}
+
+		if errors.Is(err, zeolite.ErrEOS) {
+			c.finish(c.out)
+			done[ch] = true
+			continue
+		} else if err != nil {
+			return err
+		}
+		if _, err := c.out.Write(msg); err != nil {
+			return fmt.Errorf("channel %d: %w", ch, err)
+		}
+	}
+}
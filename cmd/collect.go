@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+
+	"github.com/42LoCo42/go-zeolite"
+)
+
+// maxLine is the length after which an unfinished line of a tagged source
+// is written anyway
+const maxLine = 64 * 1024
+
+// collector writes the data received from all its streams to out
+type collector struct {
+	mtx  sync.Mutex
+	out  io.Writer
+	tag  bool
+	stop context.CancelFunc
+}
+
+// write writes p to out in one piece. If out fails, the collector stops.
+func (c *collector) write(p []byte) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	_, err := c.out.Write(p)
+	if err != nil {
+		c.stop()
+	}
+	return err
+}
+
+// serve handles a stream of the collect mode. Messages are written
+// whole; with tag, every line is prefixed by the fingerprint of the peer.
+func (c *collector) serve(stream *zeolite.Stream) {
+	// publishers don't receive anything
+	stream.CloseWrite()
+
+	id := stream.OtherPK.Fingerprint()
+	prefix := []byte(id + " ")
+	partial := []byte{}
+
+	// tagLines prefixes all complete lines of partial
+	// and leaves the rest in it
+	tagLines := func() []byte {
+		end := bytes.LastIndexByte(partial, '\n') + 1
+		buf := []byte{}
+		for _, line := range bytes.SplitAfter(partial[:end], []byte("\n")) {
+			if len(line) > 0 {
+				buf = append(append(buf, prefix...), line...)
+			}
+		}
+		partial = append(partial[:0], partial[end:]...)
+		return buf
+	}
+
+	for {
+		msg, err := stream.Recv()
+		if err != nil {
+			if len(partial) > 0 {
+				partial = append(partial, '\n')
+				c.write(tagLines())
+			}
+			if err != zeolite.ErrEOS {
+				info("Publisher", id, "failed:", err)
+			}
+			return
+		}
+
+		if !c.tag {
+			if c.write(msg) != nil {
+				return
+			}
+			continue
+		}
+
+		partial = append(partial, msg...)
+		if len(partial) > maxLine && bytes.IndexByte(partial, '\n') < 0 {
+			partial = append(partial, '\n')
+		}
+		if buf := tagLines(); len(buf) > 0 && c.write(buf) != nil {
+			return
+		}
+	}
+}
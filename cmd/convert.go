@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/42LoCo42/go-zeolite"
+)
+
+// convert reads an identity in format from from stdin
+// and writes it in format to to stdout.
+// All formats contain the full identity, so no conversion loses data.
+func convert(from, to string) error {
+	input, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return err
+	}
+
+	var identity zeolite.Identity
+	switch from {
+	case "raw":
+		if len(input) != len(identity.Public)+len(identity.Secret) {
+			return zeolite.ErrIdentity
+		}
+		copy(identity.Public[:], input)
+		copy(identity.Secret[:], input[len(identity.Public):])
+	case "base64":
+		identity, err = zeolite.ParseIdentityBase64(string(input))
+	case "hex":
+		identity, err = zeolite.ParseIdentityHex(string(input))
+	case "seed":
+		raw, err := zeolite.Base64Dec(strings.TrimSpace(string(input)))
+		seed := zeolite.Seed{}
+		if err != nil || len(raw) != len(seed) {
+			return zeolite.ErrIdentity
+		}
+		copy(seed[:], raw)
+		if identity, err = zeolite.NewIdentityFromSeed(seed); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown input format: %q", from)
+	}
+	if err != nil {
+		return err
+	}
+
+	// don't pass on garbage
+	if err := identity.Validate(); err != nil {
+		return err
+	}
+
+	switch to {
+	case "raw":
+		os.Stdout.Write(identity.Public[:])
+		os.Stdout.Write(identity.Secret[:])
+	case "base64":
+		fmt.Println(identity.Base64())
+	case "hex":
+		fmt.Println(hex.EncodeToString(identity.Public[:]) +
+			hex.EncodeToString(identity.Secret[:]))
+	case "seed":
+		seed := identity.Seed()
+		fmt.Println(zeolite.Base64Enc(seed[:]))
+	default:
+		return fmt.Errorf("unknown output format: %q", to)
+	}
+	return nil
+}
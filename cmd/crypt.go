@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/42LoCo42/go-zeolite"
+)
+
+// cryptFilter encrypts or decrypts stdin to stdout. The key is derived from
+// passphrase if set, otherwise it is shared by identity and the only ID.
+func cryptFilter(
+	encrypt bool,
+	identity zeolite.Identity,
+	ids []string,
+	passphrase []byte,
+) error {
+	var key zeolite.SymK
+	if passphrase == nil {
+		if len(ids) != 1 {
+			return errors.New("encrypt/decrypt need --passphrase-var or one -t")
+		}
+		peer, err := parseID(ids[0])
+		if err != nil {
+			return err
+		}
+		if key, err = identity.SharedKey(peer); err != nil {
+			return err
+		}
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	if encrypt {
+		var w io.WriteCloser
+		var err error
+		if passphrase != nil {
+			w, err = zeolite.NewPassphraseEncryptWriter(out, passphrase)
+		} else {
+			w, err = zeolite.NewEncryptWriter(out, key)
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(w, os.Stdin); err != nil {
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+		return out.Flush()
+	}
+
+	var r io.Reader
+	var err error
+	if passphrase != nil {
+		r, err = zeolite.NewPassphraseDecryptReader(os.Stdin, passphrase)
+	} else {
+		r, err = zeolite.NewDecryptReader(os.Stdin, key)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		out.Flush()
+		return err
+	}
+	return out.Flush()
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/42LoCo42/go-zeolite"
+)
+
+// dnsCacheTTL is how long the TXT records are used before they are
+// looked up again, so that reauthorizing many peers doesn't flood DNS
+const dnsCacheTTL = 30 * time.Second
+
+// txtResolver looks up TXT records, like net.Resolver
+type txtResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+var (
+	// host whose TXT records list trusted IDs, empty if disabled
+	verifyDNS string
+
+	// resolver & timeout (0 for none) of the lookups
+	verifyResolver txtResolver = net.DefaultResolver
+	verifyTimeout  time.Duration
+
+	// the last successful lookup
+	dnsCache struct {
+		mtx     sync.Mutex
+		records []string
+		fetched time.Time
+	}
+)
+
+// dnsTrusted reports whether otherPK is published in a TXT record
+// at _zeolite.<verifyDNS>. Records that aren't IDs are ignored,
+// so several IDs (e.g. during a key rollover) and other data may coexist.
+func dnsTrusted(otherPK zeolite.SignPK) bool {
+	name := "_zeolite." + verifyDNS
+	records, err := lookupTrustRecords(name)
+	if err != nil {
+		info("DNS verification failed:", err)
+		return false
+	}
+
+	for _, record := range records {
+		if pk, err := parseID(record); err == nil && pk.Equal(otherPK) {
+			info("Verified by the TXT record of", name)
+			return true
+		}
+	}
+	info("Not found in the TXT records of", name)
+	return false
+}
+
+// lookupTrustRecords returns the TXT records of name,
+// from the cache if they were fetched within dnsCacheTTL
+func lookupTrustRecords(name string) ([]string, error) {
+	dnsCache.mtx.Lock()
+	defer dnsCache.mtx.Unlock()
+	if time.Since(dnsCache.fetched) < dnsCacheTTL {
+		return dnsCache.records, nil
+	}
+
+	ctx := context.Background()
+	if verifyTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, verifyTimeout)
+		defer cancel()
+	}
+
+	records, err := verifyResolver.LookupTXT(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	dnsCache.records, dnsCache.fetched = records, time.Now()
+	return records, nil
+}
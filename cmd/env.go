@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/pborman/getopt/v2"
+)
+
+// envOptions maps environment variables to the options whose default
+// they replace. Options given on the command line take precedence.
+var envOptions = []struct {
+	env    string
+	option any // rune or string, see getopt.Lookup
+}{
+	{"ZEOLITE_IDENT_FILE", 'I'},
+	{"ZEOLITE_TRUST", 't'},
+	{"ZEOLITE_TRUST_FILE", 'T'},
+	{"ZEOLITE_TRUST_REFRESH", "trust-refresh"},
+	{"ZEOLITE_TRUST_COMMAND", "trust-command"},
+	{"ZEOLITE_TRUST_TIMEOUT", "trust-timeout"},
+	{"ZEOLITE_VERIFY_DNS", "verify-dns"},
+	{"ZEOLITE_REVOKED", "revoked"},
+	{"ZEOLITE_CERT", "cert"},
+	{"ZEOLITE_CA", "ca"},
+	{"ZEOLITE_CHALLENGE", "challenge"},
+	{"ZEOLITE_COMPRESS", "compress"},
+	{"ZEOLITE_PADDING", "padding"},
+	{"ZEOLITE_RECV_LIMIT", "recv-limit"},
+	{"ZEOLITE_SOCKET_MODE", "socket-mode"},
+	{"ZEOLITE_TCP_KEEPALIVE", "tcp-keepalive"},
+	{"ZEOLITE_LINGER", "linger"},
+	{"ZEOLITE_DSCP", "dscp"},
+	{"ZEOLITE_RESOLVER", "resolver"},
+	{"ZEOLITE_QUIET", "quiet"},
+	{"ZEOLITE_RATE_LIMIT", "rate-limit"},
+	{"ZEOLITE_RATE_BURST", "rate-burst"},
+	{"ZEOLITE_MAX_HANDSHAKES", "max-handshakes"},
+	{"ZEOLITE_MAX_HANDSHAKES_PER_IP", "max-handshakes-per-ip"},
+	{"ZEOLITE_HANDSHAKE_WORKERS", "handshake-workers"},
+	{"ZEOLITE_REAUTHORIZE", "reauthorize"},
+	{"ZEOLITE_DRAIN_TIMEOUT", "drain-timeout"},
+	{"ZEOLITE_EXEC", "exec"},
+	{"ZEOLITE_SHELL", "shell"},
+	{"ZEOLITE_SERVICES", "services"},
+}
+
+// applyEnv sets options that were not given on the command line
+// from their environment variables, if present
+func applyEnv() error {
+	for _, entry := range envOptions {
+		value, ok := os.LookupEnv(entry.env)
+		if !ok || getopt.IsSet(entry.option) {
+			continue
+		}
+
+		// an identity on the command line overrides the file from env
+		if entry.option == 'I' &&
+			(getopt.IsSet('i') || getopt.IsSet("ident-string") || getopt.IsSet("keyring")) {
+			continue
+		}
+
+		opt := getopt.Lookup(entry.option)
+		if err := opt.Value().Set(value, opt); err != nil {
+			return fmt.Errorf("%s: %w", entry.env, err)
+		}
+	}
+	return nil
+}
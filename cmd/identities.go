@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/42LoCo42/go-zeolite"
+)
+
+// readIdentityMap parses an identity map file. Each line contains the ID
+// of a peer followed by the file of the identity presented to it (in raw
+// form, like -I). Empty lines and lines starting with # are ignored.
+func readIdentityMap(path string) (zeolite.IdentityMap, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	ret := zeolite.IdentityMap{}
+	scn := bufio.NewScanner(file)
+	for scn.Scan() {
+		fields := strings.Fields(scn.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s: expected an ID and a file: %s", path, scn.Text())
+		}
+
+		peer, err := parseID(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		data, err := os.ReadFile(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		identity, err := zeolite.LoadIdentity(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", fields[1], err)
+		}
+		ret[peer] = identity
+	}
+	return ret, scn.Err()
+}
+
+// selectIdentity selects identities from m, announcing the selected ones
+func selectIdentity(m zeolite.IdentityMap) zeolite.IdentitySelector {
+	return func(peer zeolite.SignPK) (zeolite.Identity, bool) {
+		identity, ok := m.Select(peer)
+		if ok {
+			info("Self: ", zeolite.Base64Enc(identity.Public[:]), "(for this peer)")
+		}
+		return identity, ok
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/42LoCo42/go-zeolite"
+)
+
+// keyring stores secrets of the current user,
+// e.g. in the secret service of the desktop
+type keyring interface {
+	// Get returns the secret stored for service & account
+	// or errNoSecret if there is none.
+	Get(service, account string) (string, error)
+	// Set stores secret for service & account, replacing the old one.
+	Set(service, account, secret string) error
+}
+
+var (
+	errNoSecret = errors.New("no such secret in keyring")
+	errKeyring  = errors.New("keyring support is not built in (build with -tags keyring)")
+)
+
+// systemKeyring is the keyring of the system,
+// nil unless built with the keyring tag
+var systemKeyring keyring
+
+// parseKeyringName splits a --keyring argument into service & account
+func parseKeyringName(name string) (service, account string, err error) {
+	service, account, ok := strings.Cut(name, "/")
+	if !ok || service == "" || account == "" {
+		return "", "", errors.New("keyring entries must be given as service/account")
+	}
+	return service, account, nil
+}
+
+// loadKeyring reads the identity stored in a keyring entry.
+// If create is set, a missing entry is filled with a new identity.
+func loadKeyring(name string, create bool) (zeolite.Identity, error) {
+	if systemKeyring == nil {
+		return zeolite.Identity{}, errKeyring
+	}
+	service, account, err := parseKeyringName(name)
+	if err != nil {
+		return zeolite.Identity{}, err
+	}
+
+	secret, err := systemKeyring.Get(service, account)
+	if err == errNoSecret && create {
+		identity, err := zeolite.NewIdentity()
+		if err != nil {
+			return identity, err
+		}
+		return identity, systemKeyring.Set(service, account, identity.Base64())
+	} else if err != nil {
+		return zeolite.Identity{}, err
+	}
+	return zeolite.ParseIdentityBase64(secret)
+}
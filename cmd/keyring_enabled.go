@@ -0,0 +1,7 @@
+//go:build keyring
+
+package main
+
+func init() {
+	systemKeyring = toolKeyring{}
+}
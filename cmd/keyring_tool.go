@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// toolKeyring uses secret-tool (part of libsecret) to access the
+// Secret Service of the desktop, e.g. GNOME Keyring or KWallet.
+// It is only used if built with the keyring tag (see keyring_enabled.go).
+type toolKeyring struct{}
+
+func (toolKeyring) Get(service, account string) (string, error) {
+	cmd := exec.Command("secret-tool", "lookup", "service", service, "account", account)
+	stderr := bytes.Buffer{}
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+
+	// A missing secret is reported by exit code 1 without any output.
+	// Other failures (e.g. no Secret Service running) explain themselves.
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 &&
+		len(out) == 0 && stderr.Len() == 0 {
+		return "", errNoSecret
+	} else if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("secret-tool: %w: %s", err, msg)
+		}
+		return "", fmt.Errorf("secret-tool: %w", err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func (toolKeyring) Set(service, account, secret string) error {
+	// the secret is passed on stdin to keep it out of the process list
+	cmd := exec.Command(
+		"secret-tool", "store", "--label=zeolite identity "+service+"/"+account,
+		"service", service, "account", account,
+	)
+	cmd.Stdin = strings.NewReader(secret)
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
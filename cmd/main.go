@@ -2,14 +2,19 @@ package main
 
 import (
 	"bufio"
-	"encoding/base64"
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net"
 	"os"
-	"os/exec"
+	"os/signal"
+	"runtime"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/42LoCo42/go-zeolite"
 	"github.com/pborman/getopt/v2"
@@ -18,64 +23,554 @@ import (
 const (
 	identVarHelp   = "Environment variable storing base64-encoded identity"
 	identFileHelp  = "File storing identity"
+	identStrHelp   = "Base64 (pub-sec) or hex encoded identity"
+	keyringHelp    = "Load the identity from this keyring entry"
+	identMapHelp   = "Present other identities to some clients (see below)"
 	noCheckHelp    = "Disable trust checking"
 	trustIDsHelp   = "Trust this base64-encoded ID"
-	trustFilesHelp = "Trust all base64-encoded IDs in this file"
+	trustFilesHelp = "Trust all base64-encoded IDs in this file or HTTP(S) URL"
+	refreshHelp    = "Fetch trust lists given by URL again at this interval"
+	socketModeHelp = "Permissions (octal) of created Unix sockets"
+	compressHelp   = "Offer compression at this level (1-9, -1 = default)"
+	interactHelp   = "Ask on the terminal about unknown peers, remember them here"
+	trustCmdHelp   = "Trust unknown peers if this shell command succeeds"
+	trustCmdTOHelp = "Reject the peer if --trust-command takes longer than this"
+	verifyDNSHelp  = "Trust peers whose ID is in a TXT record of _zeolite.<host>"
+	trustTOHelp    = "Reject the peer if checking its trust takes longer than this"
+	revokedHelp    = "Reject all base64-encoded IDs in this file"
+	notBeforeHelp  = "Issued certificates are valid from this time (RFC 3339)"
+	notAfterHelp   = "Issued certificates are valid until this time (RFC 3339)"
+	certHelp       = "Present the base64-encoded certificate in this file"
+	caHelp         = "Trust peers with a certificate issued by this ID"
+	certSkewHelp   = "Accept certificates this much outside of their validity"
+	challengeHelp  = "Require the peer to sign a fresh challenge"
+	recvLimitHelp  = "Reject received messages bigger than this many bytes"
+	paddingHelp    = "Pad all messages to a multiple of this many bytes"
+	frameHdrHelp   = "Offer a magic and version in front of every frame"
+	keepAliveHelp  = "Send TCP keepalive probes at this interval"
+	lingerHelp     = "Set SO_LINGER on TCP connections (see below)"
+	dscpHelp       = "Mark packets with this DSCP value (0-63, e.g. 46)"
+	reusePortHelp  = "Let several servers listen on the same port (see below)"
+	bindHelp       = "Connect from this local address (host or host:port)"
+	outHelp        = "Write received data to this file instead of stdout"
+	noAtomicHelp   = "Write --out directly instead of on completion"
+	teeHelp        = "Copy the plaintext to <file>.sent and <file>.recv"
+	channelHelp    = "Attach file descriptors to a channel (see below)"
+	retriesHelp    = "Retry failed connections this many times"
+	quietHelp      = "Don't print informational messages (like Self/Other)"
+	timingHelp     = "Print how long each phase of the handshake took"
+	lineBufHelp    = "Send every line of stdin as soon as it is complete"
+	bufSizeHelp    = "Send stdin in frames of at most this many bytes"
+	fallbackHelp   = "Try IPv4 after this long if IPv6 doesn't connect"
+	dnsTimeoutHelp = "Give up resolving the server address after this long"
+	resolverHelp   = "Resolve addresses with this DNS server (host[:port])"
+	backendIDHelp  = "Trust this backend ID in relay mode"
+	rateLimitHelp  = "Accept at most this many connections per second and IP"
+	rateBurstHelp  = "Allow bursts of this many connections per IP"
+	maxHSHelp      = "Handshake with at most this many clients at once"
+	maxHSIPHelp    = "Handshake with at most this many clients per IP at once"
+	hsWorkersHelp  = "Handshake with at most this many clients in parallel, queue others"
+	hsTimeoutHelp  = "Disconnect clients that don't complete the handshake in time"
+	reauthHelp     = "Check the trust of connected peers again at this interval"
+	drainHelp      = "Wait this long for multi handlers after SIGINT/SIGTERM"
+	execHelp       = "Spawn this shell-quoted command in multi (see below)"
+	shellHelp      = "Run the --exec command with sh -c"
+	servicesHelp   = "Select the multi command by service name from this file"
+	serviceHelp    = "Request this service from a multi server"
+	childTOHelp    = "Kill multi commands that run longer than this"
+	childErrHelp   = "Where the stderr of multi commands goes (see below)"
+	stderrHelp     = "Send (multi) or accept (client) the stderr of multi commands"
+	tagSourceHelp  = "Prefix collected lines with the fingerprint of their sender"
+	proxyHelp      = "Expect a PROXY protocol header on accepted connections"
+	summaryHelp    = "Append the summary printed on SIGUSR1 to this file"
+	adminHelp      = "Accept admin commands on this Unix socket (see below)"
+	fromHelp       = "Identity format read by convert"
+	toHelp         = "Identity format written by convert"
+	passVarHelp    = "Use the passphrase in this variable for bundles, encrypt & decrypt"
+	forceHelp      = "Let bundle import overwrite existing files"
 	showHelpHelp   = "Show this help"
 )
 
-const usage = `Usage: %s [options] <mode>
-Options:
-	-i <name>              %s
-	-I <file>              %s
-	-k                     %s
-	-t <client ID>         %s
-	-T <client ID file>    %s
-	-h                     %s
+// options are shown by printUsage in this order
+var options = []struct{ syntax, help string }{
+	{"-i <name>", identVarHelp},
+	{"-I <file>", identFileHelp},
+	{"--ident-string <id>", identStrHelp},
+	{"--keyring <service/account>", keyringHelp},
+	{"--identity-map <file>", identMapHelp},
+	{"-k", noCheckHelp},
+	{"-t <client ID>", trustIDsHelp},
+	{"-T <client ID file>", trustFilesHelp},
+	{"--trust-refresh <dur>", refreshHelp},
+	{"--socket-mode <mode>", socketModeHelp},
+	{"--compress <level>", compressHelp},
+	{"--interactive-trust <file>", interactHelp},
+	{"--trust-command <cmd>", trustCmdHelp},
+	{"--trust-command-timeout <dur>", trustCmdTOHelp},
+	{"--verify-dns <host>", verifyDNSHelp},
+	{"--trust-timeout <dur>", trustTOHelp},
+	{"--revoked <file>", revokedHelp},
+	{"--not-before <time>", notBeforeHelp},
+	{"--not-after <time>", notAfterHelp},
+	{"--cert <file>", certHelp},
+	{"--ca <CA ID>", caHelp},
+	{"--cert-skew <dur>", certSkewHelp},
+	{"--challenge", challengeHelp},
+	{"--recv-limit <bytes>", recvLimitHelp},
+	{"--padding <bytes>", paddingHelp},
+	{"--frame-header", frameHdrHelp},
+	{"--tcp-keepalive <dur>", keepAliveHelp},
+	{"--linger <seconds>", lingerHelp},
+	{"--dscp <value>", dscpHelp},
+	{"--reuseport", reusePortHelp},
+	{"--bind <address>", bindHelp},
+	{"--out <file>", outHelp},
+	{"--no-atomic", noAtomicHelp},
+	{"--tee <file>", teeHelp},
+	{"--channel <n:fd[:fd]>", channelHelp},
+	{"--retries <n>", retriesHelp},
+	{"-q, --quiet", quietHelp},
+	{"--timing", timingHelp},
+	{"--line-buffered", lineBufHelp},
+	{"--buffer-size <bytes>", bufSizeHelp},
+	{"--fallback-delay <dur>", fallbackHelp},
+	{"--dns-timeout <dur>", dnsTimeoutHelp},
+	{"--resolver <addr>", resolverHelp},
+	{"--backend-id <id>", backendIDHelp},
+	{"--rate-limit <n>", rateLimitHelp},
+	{"--rate-burst <n>", rateBurstHelp},
+	{"--max-handshakes <n>", maxHSHelp},
+	{"--max-handshakes-per-ip <n>", maxHSIPHelp},
+	{"--handshake-workers <n>", hsWorkersHelp},
+	{"--handshake-timeout <dur>", hsTimeoutHelp},
+	{"--reauthorize <dur>", reauthHelp},
+	{"--drain-timeout <dur>", drainHelp},
+	{"--exec <command>", execHelp},
+	{"--shell", shellHelp},
+	{"--services <file>", servicesHelp},
+	{"--service <name>", serviceHelp},
+	{"--child-timeout <dur>", childTOHelp},
+	{"--child-stderr <mode>", childErrHelp},
+	{"--stderr-to-client", stderrHelp},
+	{"--tag-source", tagSourceHelp},
+	{"--accept-proxy-protocol", proxyHelp},
+	{"--summary-file <file>", summaryHelp},
+	{"--admin-socket <path>", adminHelp},
+	{"--from <format>", fromHelp},
+	{"--to <format>", toHelp},
+	{"--passphrase-var <var>", passVarHelp},
+	{"--force", forceHelp},
+	{"-h", showHelpHelp},
+}
 
-Modes:
+const usage = `Modes:
 	gen: Generate new identity. It will be printed to stdout in raw form
 		and to stderr in base64-encoded form.
+		If -I is given and the file does not exist, the identity is
+		also written to it with permissions 0600.
+
+	pubkey: Print the ID (base64-encoded public key) of the identity given
+		by -i, -I, --ident-string or --keyring to stdout, as a single line that can
+		be appended to trust files. Its fingerprint goes to stderr.
+
+	fingerprint: Print the fingerprint and the ID of the identity given by
+		-i, -I, --ident-string or --keyring to stdout, without connecting
+		anywhere, e.g. to audit which key a file contains or to compare
+		it with the fingerprint a peer printed on connection.
+		It is short enough to be read aloud, e.g. on the phone; compare
+		all of it, since short prefixes are easy to forge (see -t).
+
+	convert: Convert an identity from stdin between formats (--from, --to)
+		and print it to stdout. Supported formats: raw (like -I files),
+		base64 (pub-sec, like -i), hex and seed (base64-encoded 32 bytes
+		from which the identity is derived). All formats contain the full
+		identity. Invalid identities are rejected.
+
+	bundle export <file>: Write the identity and all local trust entries
+		(-t, -T files except URLs, --interactive-trust) to a new
+		gzipped tar archive for moving them to another machine. With
+		--passphrase-var, the identity is encrypted with the passphrase
+		in the given variable (Argon2id and XSalsa20-Poly1305).
+
+	bundle import <file>: Restore a bundle to the -I file and, if given,
+		the -T file. The bundle is validated first and existing files
+		are only overwritten with --force.
+
+	encrypt: Encrypt stdin to stdout, e.g. for files at rest. The key is
+		derived from the passphrase in the variable named by
+		--passphrase-var (with Argon2id), or shared by our identity
+		and the only -t ID, which can decrypt it by giving our ID to -t.
+		Data is split into authenticated chunks of 64 KiB.
+
+	decrypt: Decrypt the output of encrypt from stdin to stdout. Decrypted
+		data is written as soon as its chunk is verified, so if the input
+		was modified or truncated, the output is incomplete and
+		decrypt fails.
+
+	issue <ID>: Issue a certificate for ID, signed by our identity.
+		It is printed to stdout in base64-encoded form. Peers that
+		trust us as a CA (--ca) trust everyone presenting it (--cert).
+		With --not-before and --not-after, it is only valid in between,
+		as checked against the clock of the verifying peer. If its clock
+		is off, valid certificates are rejected as not yet valid or
+		expired; the error shows the window and the local time to spot
+		this. --cert-skew tolerates a small difference (e.g. 2m).
 
 	client <address>: Connects to the specified address.
 		stdin is sent and received data is printed to stdout.
+		With --bind, the connection originates from the given
+		local address, e.g. to select a source IP on multi-homed hosts
+		(only for client and relay).
+		With --line-buffered, every line is sent as a separate message,
+		which suits interactive, line-oriented sessions. Otherwise,
+		stdin is sent in frames of up to --buffer-size bytes (default
+		32 KiB, also used by single and broadcast). Bigger frames have
+		less overhead in bulk transfers, smaller ones need less memory
+		and are delivered sooner.
+		Hostnames with both IPv6 and IPv4 addresses are dialed with
+		"Happy Eyeballs": if IPv6 didn't connect within --fallback-delay
+		(default 300ms), IPv4 is tried in parallel. A negative delay
+		disables this, so the addresses are tried one after another.
+		--dns-timeout limits how long resolving the hostname may take
+		(per attempt); by default, only the system resolver's own
+		timeouts apply. --resolver sends all DNS queries to the given
+		server (port 53 unless specified) instead of the ones configured
+		in the system. Both use Go's built-in resolver.
+		With --retries, connections that fail because of network errors
+		are retried after 1s, 2s, 4s and so on. Rejections are final.
 
 	single <address>: Starts a server that accepts a single connection.
 		stdin is sent and received data is printed to stdout.
 
-	multi <address> <cmd> [args]: Starts a multi handler server.
+	multi <address> [--] <cmd> [args]: Starts a multi handler server.
 		It will spawn cmd with args for each connection,
 		pass received data to stdin and send data read from stdout.
+		Options are only parsed before the mode, so args are passed
+		verbatim; -- may be used to separate them clearly.
+
+	multi <address> --exec <command>: Like above, but the command and its
+		arguments are given as one string, which is easier to write in
+		config files and systemd units. It is split into words like
+		a shell would: whitespace separates words, '...' quotes
+		everything literally, "..." too except that a backslash escapes
+		", \, $ and backquotes, and elsewhere a backslash escapes any
+		character. Nothing is expanded: no variables, globs, pipes or
+		redirections. With --shell, the string is run by sh -c instead,
+		so all of that is available. Then the server runs whatever the
+		shell makes of the string, so never build it from untrusted input.
+
+	multi <address> --services <file>: Starts a service multiplexer.
+		The first message of each client is the name of a service;
+		its command is spawned like above. Unknown services are rejected
+		by closing the connection. Clients pass the name with --service.
+		Each line of the file contains a service name, the command
+		and its arguments, separated by whitespace (# starts a comment).
+
+	broadcast <address>: Starts a server that sends stdin to all connected
+		clients. Clients receive the data from the moment they connect;
+		they can't send anything (use client with </dev/null).
+		Clients that fall behind too far are disconnected at once, so
+		that they can't stall the others. When stdin ends, the clients
+		receive the rest (at most for --drain-timeout) and the server exits.
+
+	collect <address>: Starts a server that prints the data of all
+		connected clients to stdout. Every message is written as a whole,
+		so messages of different clients don't mix. With --tag-source,
+		every line is prefixed by the fingerprint of its sender and
+		a space; unfinished lines are completed when a client leaves.
+		Clients don't receive anything.
+
+	relay <address> <backend address>: Starts a server that connects
+		every client to the backend server and forwards the data in both
+		directions, e.g. for hub-and-spoke setups. Clients must be
+		trusted like in the other server modes, the backend must have
+		one of the IDs given by --backend-id. Both connections use the
+		identity of the relay and are encrypted independently, so the
+		backend only sees the relay, not the client. The relay decrypts
+		all data and encrypts it again: it sees the plaintext and must
+		be trusted like the endpoints themselves, unlike the end-to-end
+		encryption of a direct connection. Each direction ends on its
+		own; if one of the connections fails, both are closed. Only
+		plain data is forwarded: clients using --channel fail, since
+		the relay doesn't offer channels. With --bind, the connections
+		to the backend originate from the given local address.
+
+	Every multi command runs in the goroutine of its connection, so slow
+	or hanging commands don't delay accepting others. --child-timeout
+	limits how long a command may run in total (including its startup):
+	afterwards, it is killed and the connection is closed without telling
+	the client that the data is complete.
+
+	The stderr of multi commands is printed by the server. --child-stderr
+	changes this: inherit (the default) prints it, discard drops it and
+	file:<path> appends it to the given file, which keeps busy servers
+	from flooding their own stderr. With --stderr-to-client, it is sent
+	to the client instead, in frames of a separate type that the client
+	prints to its own stderr. The client must pass --stderr-to-client as
+	well to accept these frames; for other clients, --child-stderr applies.
+
+	Many options can also be set with environment variables, which is handy
+	in containers or systemd units: ZEOLITE_IDENT_FILE (-I), ZEOLITE_TRUST
+	(-t), ZEOLITE_TRUST_FILE (-T) and ZEOLITE_<OPTION> for --trust-refresh,
+	--trust-command, --trust-timeout, --verify-dns, --revoked, --cert, --ca,
+	--challenge, --compress, --padding, --recv-limit, --socket-mode,
+	--tcp-keepalive, --linger, --dscp, --resolver, --quiet, --rate-limit,
+	--rate-burst, --max-handshakes, --max-handshakes-per-ip,
+	--handshake-workers, --reauthorize, --drain-timeout, --exec, --shell
+	and --services (e.g. ZEOLITE_RATE_LIMIT for --rate-limit).
+	Options on the command line take precedence over the environment,
+	which takes precedence over the defaults. Lists are separated by commas,
+	flags take true or false. Unlike these variables, -i names a variable
+	that contains the identity itself.
 
 	Available address formats:
 		tcp://host:port
 		tcp4://host:port
 		tcp6://host:port
 		unix://path
+		unix-abstract://name (Linux only, no file is created)
+
+	tcp:// uses IPv6 and IPv4 as available. Servers given no host or an
+	unspecified address (like [::]) usually accept both with one socket,
+	so IPv4 clients may show up as IPv4-mapped IPv6 addresses
+	(::ffff:192.0.2.1). tcp4:// and tcp6:// restrict clients and servers
+	to a single address family; IP addresses of the other family
+	are rejected.
+
+	Trust files contain one ID per line, optionally followed by
+	an expiry time (RFC 3339, e.g. 2024-01-31T18:00:00Z) after which
+	the ID is no longer trusted. Lines starting with # are ignored,
+	invalid lines are skipped with a warning.
+
+	For quick tests, -t also accepts a prefix (at least 4 hex digits) of
+	a fingerprint as printed on connection, e.g. -t 177a:1983. It trusts
+	every peer whose fingerprint starts with it, so it only takes a few
+	tries to forge a matching key: a warning is printed, and production
+	setups should always pin full IDs.
+
+	-T also accepts HTTP(S) URLs of trust lists in the same format, served
+	as text/plain. They are fetched at startup (failing if that doesn't
+	work) and again every --trust-refresh interval (default 5m, 0 disables).
+	If a refresh fails, the last good list stays in use.
+
+	With --interactive-trust, unknown peers are not rejected right away.
+	Instead, you are asked on the terminal (not stdin) whether to trust
+	them, like SSH does for unknown hosts. Accepted IDs are appended
+	to the given file and trusted from then on. Without a terminal,
+	unknown peers are rejected.
+
+	--trust-command delegates the decision about unknown peers to a shell
+	command, e.g. to look them up in a database. It is run by sh for every
+	such peer, with two arguments appended: the base64-encoded ID and the
+	address of the peer (for clients, the server address as given).
+	Exit code 0 means trusted. Any other outcome, including a command that
+	runs longer than --trust-command-timeout (default 5s), means not
+	trusted. The output of the command goes to stderr.
+
+	--verify-dns trusts peers whose ID is published in a TXT record of
+	_zeolite.<host>, like SSHFP records do for SSH host keys, e.g.
+	_zeolite.example.com. IN TXT "KBcf6aGpl+NH3dzZBBKoNn2dMWgQtouBsDGrQzAvF28="
+	It is looked up for unknown peers, with --resolver and --dns-timeout
+	if given. The answer is reused for 30s, so a removed ID may still be
+	trusted that long. Several records may list several IDs. Plain
+	DNS answers can be forged by anyone on the path to the resolver, and
+	zeolite doesn't validate DNSSEC signatures itself: only rely on this
+	with a validating resolver you trust, reached over a trusted network
+	(e.g. on localhost), and for zones signed with DNSSEC.
+
+	Checking the trust of a peer as a whole (including the prompt of
+	--interactive-trust) is limited by --trust-timeout (default 1m,
+	0 disables). Peers that can't be checked in time are rejected.
+
+	IDs in the --revoked file are rejected even if they are trusted
+	by -t/-T or hold a valid certificate. The file is read again
+	whenever it changes, so keys can be revoked without a restart.
+	Trust is normally only checked when a peer connects. With --reauthorize,
+	single and multi servers check it again at the given interval and
+	disconnect peers that were revoked or are no longer trusted otherwise
+	(e.g. whose entry expired or whose certificate is no longer valid).
+	Peers approved by --trust-command or --interactive-trust stay approved
+	for their connection: the command isn't run, nor the user asked, again.
+
+	--keyring reads the identity (in base64-encoded form) from the keyring
+	of the desktop, so that it isn't stored in a plain file. gen stores a
+	new identity there if the entry doesn't exist yet. This requires
+	a build with -tags keyring and the secret-tool program (libsecret).
+
+	With --identity-map, servers present different identities to different
+	clients, e.g. a work and a personal one. Each line of the file contains
+	the ID of a client and the file of the identity presented to it (in raw
+	form, like -I), separated by whitespace (# starts a comment). Clients
+	that aren't listed get the identity given by -i, -I, --ident-string
+	or --keyring. A server can only learn the ID of a client this way,
+	not its address or the data it wants to send: to select by address,
+	start one server per address. A --cert only certifies the default
+	identity, so clients must trust the others by other means. Clients
+	can't use a map, they know which server they connect to.
+
+	Identities passed with --ident-string are visible to all users of the
+	system in the process list (ps), and -i variables are visible to
+	processes of the same user (/proc/<pid>/environ). Prefer -I outside
+	of quick tests.
+
+	Compression is only used if both sides offer it. Do not use it when
+	the data mixes secrets with attacker-controlled input: the size of the
+	compressed frames can leak the secrets (like the CRIME attack on TLS).
+
+	--tcp-keepalive makes the operating system probe idle TCP connections,
+	which detects dead peers and keeps NAT mappings alive. These probes
+	are part of TCP and never reach zeolite itself, so unlike messages,
+	they don't prove that the peer process is still working.
+	It has no effect on Unix sockets.
+
+	--linger sets SO_LINGER on TCP connections, which controls what
+	closing them does with data the kernel hasn't sent yet. With 0,
+	it is discarded and the connection is reset right away (RST),
+	leaving no socket in TIME_WAIT, but possibly cutting off the end of
+	the data even after the FINAL message. With n > 0, closing waits up
+	to n seconds for the data to be delivered. By default, the operating
+	system delivers it in the background. It has no effect on Unix sockets.
+
+	--dscp marks all packets with a Differentiated Services class, so that
+	networks can prioritize them (e.g. 46 for interactive sessions,
+	8 for bulk transfers). It is ignored where unsupported.
+
+	--reuseport sets SO_REUSEPORT on TCP listeners, so that several
+	server processes can listen on the same address and port. The kernel
+	then spreads incoming connections across them, e.g. to use more CPUs
+	for handshakes. All of them must be started with --reuseport
+	(and on Linux, by the same user). It is supported on Linux and the
+	BSDs (including macOS) and fails elsewhere.
+
+	Handshakes cost CPU time for signatures and key exchanges. To protect
+	multi, collect and broadcast servers from floods of connections,
+	--max-handshakes limits how many run at once (in total and with
+	--max-handshakes-per-ip per client address); further connections are
+	closed right away. Independently, --handshake-workers (default: four
+	per CPU, 0 disables) limits how many handshakes run in parallel;
+	further connections are still accepted, but wait for a free worker.
+	A worker is busy for the whole handshake, including network round
+	trips and the trust decision, hence more workers than CPUs; with slow
+	peers or --trust-command, allow even more. Clients that don't complete their handshake within
+	--handshake-timeout (default 10s, 0 disables), including the time
+	spent waiting, are disconnected, so that they can't hold on to
+	these slots. Checking their trust is limited by --trust-timeout
+	instead, so prompts and trust commands aren't cut short.
+
+	--timing prints the duration of every phase of each handshake to
+	stderr (even with --quiet), e.g. to tell whether slow connections
+	are caused by the network or by the CPU: resolve and connect (only
+	for client), banner, identity (public keys and certificates), trust
+	(including --interactive-trust prompts and --trust-command), key
+	exchange, verify (of the signature of the peer), symmetric key and
+	header. Phases that wait for the peer include the network round trip.
+
+	With --accept-proxy-protocol, single and multi servers require every
+	connection to start with a PROXY protocol header (version 1 or 2), as
+	sent by load balancers like HAProxy. The real client address from the
+	header is printed and used for --rate-limit. Connections without
+	a valid header are rejected, so only use this behind such a proxy.
+
+	With --out, client and single write the received data to a file.
+	It is first collected in a temporary file in the same directory
+	(with permissions 0600), which replaces the given file only after the
+	peer finished sending properly. Otherwise, the temporary file is
+	removed, the given file is left untouched and the exit status is
+	non-zero. --no-atomic writes to the file directly instead.
+
+	--tee is meant for debugging only: it writes all data sent and received
+	by client and single to files, unencrypted, for anyone who can read them.
+
+	--channel carries the data of further file descriptors next to stdin
+	and stdout, as a logical channel of the same connection. <n> is the
+	channel number (1-255), the first fd is sent on it and the data
+	received on it is written to the second one, or to the first one
+	if there is no second one (e.g. a socket, or a file opened with 3<>).
+	Pipes need two descriptors. The peer needs a --channel with the same
+	number, e.g. in bash:
+		client: zeolite --channel 1:3:4 ... client tcp://host:port 3<logs 4>replies
+		server: zeolite --channel 1:3:4 ... single tcp://:port 3<replies 4>logs
+	Each channel ends on its own when its descriptor reaches EOF, and the
+	session only ends once stdin and all channels are done. Data of
+	unknown channels is discarded. All channels share the connection:
+	if one of them isn't read, it stalls the others too.
+	Only for client and single; the session fails if the peer doesn't
+	offer channels too.
+
+	On SIGUSR1, all modes that connect print a summary of the active
+	connections to stderr (or append it to --summary-file): one line per
+	peer with its fingerprint, address, the time since the handshake and
+	the bytes sent and received (on the wire). Not available on Windows.
+
+	--admin-socket accepts commands on a Unix socket that only the user
+	running zeolite may access (e.g. with socat - UNIX-CONNECT:<path>).
+	Commands are read one per line, each is answered by one or more lines:
+		list: the summary also printed on SIGUSR1
+		close <fingerprint>: closes all connections of that peer,
+			answers "closed <n> connections"
+		reload: reads all -T files (and the --interactive-trust file)
+			and fetches all remote trust lists again, answers "reloaded".
+			Lists that can't be read stay in use as they were.
+		pause: servers close new connections right away (e.g. before a
+			restart, while the active ones finish), answers "paused"
+		resume: servers accept connections again, answers "resumed"
+	Invalid commands and failures are answered with "error: <reason>".
+
+	Servers support systemd socket activation: if systemd passed a
+	listening socket (as announced by the LISTEN_PID and LISTEN_FDS
+	environment variables), it is used instead of the address, which must
+	still be given and is used when started without activation. The socket
+	unit needs Accept=no (the default) and a single Listen* directive.
+	Commands spawned by multi don't inherit the socket or the variables.
+
+	Unix sockets are created with the permissions given by --socket-mode.
+	The mode is applied right after binding, so for a brief moment
+	the socket carries the default permissions (as limited by the umask).
 `
 
+// optionWidth is the column at which the option descriptions start
+const optionWidth = 23
+
 func printUsage() {
 	parts := strings.Split(os.Args[0], "/")
-	fmt.Fprintf(
-		os.Stderr, usage, parts[len(parts)-1],
-		identVarHelp, identFileHelp, noCheckHelp,
-		trustIDsHelp, trustFilesHelp, showHelpHelp,
-	)
+	fmt.Fprintf(os.Stderr, "Usage: %s [options] <mode>\nOptions:\n",
+		parts[len(parts)-1])
+	for _, opt := range options {
+		if len(opt.syntax) < optionWidth {
+			fmt.Fprintf(os.Stderr, "\t%-*s%s\n", optionWidth, opt.syntax, opt.help)
+		} else {
+			fmt.Fprintf(os.Stderr, "\t%s\n\t%*s%s\n", opt.syntax, optionWidth, "", opt.help)
+		}
+	}
+	fmt.Fprint(os.Stderr, "\n", usage)
 }
 
-var trustList []string
-
-func trust(otherPK zeolite.SignPK) (bool, error) {
-	b64 := zeolite.Base64Enc(otherPK[:])
-	fmt.Fprintln(os.Stderr, "Other:", b64)
+var (
+	streamOpts     []zeolite.Option
+	serverOpts     []zeolite.Option // streamOpts of accepted connections
+	serviceName    *string
+	stderrToClient *bool
+	childTimeout   *time.Duration
+	tcpKeepAlive   *time.Duration
+	linger         *int
+	dscp           *int
+	outFile        *string
+	noAtomic       *bool
+	teeFile        *string
+	quiet          *bool
+	lineBuffered   *bool
+	bufferSize     *int
+	reauthorize    *time.Duration
+)
 
-	for _, id := range trustList {
-		if id == b64 {
-			return true, nil
-		}
+// parseID decodes a base64-encoded public key
+func parseID(b64 string) (ret zeolite.SignPK, err error) {
+	raw, err := zeolite.Base64Dec(strings.TrimSpace(b64))
+	if err != nil || len(raw) != len(ret) {
+		return ret, fmt.Errorf("invalid ID: %s", b64)
 	}
-
-	return len(trustList) == 0, nil
+	copy(ret[:], raw)
+	return ret, nil
 }
 
 // address: protocol://value
@@ -84,22 +579,118 @@ func parseAddr(addr string) (proto string, val string, err error) {
 	parts := strings.Split(addr, "://")
 	if len(parts) != 2 {
 		return proto, val, errors.New("invalid address form")
-	} else {
-		return parts[0], parts[1], nil
+	}
+
+	switch parts[0] {
+	case "unix-abstract":
+		// a leading NUL selects the abstract namespace
+		if runtime.GOOS != "linux" {
+			return proto, val, errors.New("abstract Unix sockets require Linux")
+		}
+		return "unix", "\x00" + parts[1], nil
+	default:
+		return parts[0], parts[1], checkFamily(parts[0], parts[1])
 	}
 }
 
+// checkFamily rejects IP literals that don't match a protocol restricted
+// to IPv4 or IPv6, which would otherwise fail with a confusing error.
+// Hostnames are resolved to addresses of the right family later.
+func checkFamily(proto, addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	if ip == nil {
+		return nil
+	}
+
+	switch {
+	case proto == "tcp4" && ip.To4() == nil:
+		return fmt.Errorf("tcp4 needs an IPv4 address, got %s", host)
+	case proto == "tcp6" && ip.To4() != nil:
+		return fmt.Errorf("tcp6 needs an IPv6 address, got %s", host)
+	}
+	return nil
+}
+
 func main() {
 	identVar := getopt.String('i', "", identVarHelp, "var")
 	identFile := getopt.String('I', "", identFileHelp, "file")
-	noCheck := getopt.Bool('k', noCheckHelp)
+	identStr := getopt.StringLong("ident-string", 0, "", identStrHelp, "id")
+	keyringName := getopt.StringLong("keyring", 0, "", keyringHelp, "service/account")
+	identityMap := getopt.StringLong("identity-map", 0, "", identMapHelp, "file")
+	noCheck = getopt.Bool('k', noCheckHelp)
 	trustIDs := getopt.List('t', trustIDsHelp, "id")
 	trustFiles := getopt.List('T', trustFilesHelp, "file")
+	trustRefresh := getopt.DurationLong("trust-refresh", 0, 5*time.Minute, refreshHelp, "duration")
+	socketMode := getopt.StringLong("socket-mode", 0, "", socketModeHelp, "mode")
+	compress := getopt.IntLong("compress", 0, -1, compressHelp, "level")
+	interactive := getopt.StringLong("interactive-trust", 0, "", interactHelp, "file")
+	trustCmd := getopt.StringLong("trust-command", 0, "", trustCmdHelp, "command")
+	trustCmdTimeout := getopt.DurationLong("trust-command-timeout", 0, 5*time.Second, trustCmdTOHelp, "duration")
+	verifyHost := getopt.StringLong("verify-dns", 0, "", verifyDNSHelp, "host")
+	trustTimeout := getopt.DurationLong("trust-timeout", 0, time.Minute, trustTOHelp, "duration")
+	revokedFile := getopt.StringLong("revoked", 0, "", revokedHelp, "file")
+	notBefore := getopt.StringLong("not-before", 0, "", notBeforeHelp, "time")
+	notAfter := getopt.StringLong("not-after", 0, "", notAfterHelp, "time")
+	certFile := getopt.StringLong("cert", 0, "", certHelp, "file")
+	caIDs := getopt.ListLong("ca", 0, caHelp, "id")
+	certSkew := getopt.DurationLong("cert-skew", 0, 0, certSkewHelp, "duration")
+	challenge := getopt.BoolLong("challenge", 0, challengeHelp)
+	recvLimit := getopt.IntLong("recv-limit", 0, 0, recvLimitHelp, "bytes")
+	padding := getopt.IntLong("padding", 0, 0, paddingHelp, "bytes")
+	frameHeader := getopt.BoolLong("frame-header", 0, frameHdrHelp)
+	tcpKeepAlive = getopt.DurationLong("tcp-keepalive", 0, 0, keepAliveHelp, "duration")
+	linger = getopt.IntLong("linger", 0, -1, lingerHelp, "seconds")
+	dscp = getopt.IntLong("dscp", 0, 0, dscpHelp, "value")
+	reuseport := getopt.BoolLong("reuseport", 0, reusePortHelp)
+	bind := getopt.StringLong("bind", 0, "", bindHelp, "address")
+	outFile = getopt.StringLong("out", 0, "", outHelp, "file")
+	noAtomic = getopt.BoolLong("no-atomic", 0, noAtomicHelp)
+	teeFile = getopt.StringLong("tee", 0, "", teeHelp, "file")
+	channelSpecs := getopt.ListLong("channel", 0, channelHelp, "n:fd[:fd]")
+	retries := getopt.IntLong("retries", 0, 0, retriesHelp, "n")
+	quiet = getopt.BoolLong("quiet", 'q', quietHelp)
+	timing := getopt.BoolLong("timing", 0, timingHelp)
+	lineBuffered = getopt.BoolLong("line-buffered", 0, lineBufHelp)
+	bufferSize = getopt.IntLong("buffer-size", 0, 32*1024, bufSizeHelp, "bytes")
+	fallbackDelay := getopt.DurationLong("fallback-delay", 0, 300*time.Millisecond, fallbackHelp, "duration")
+	dnsTimeout := getopt.DurationLong("dns-timeout", 0, 0, dnsTimeoutHelp, "duration")
+	resolverAddr := getopt.StringLong("resolver", 0, "", resolverHelp, "address")
+	backendIDList := getopt.ListLong("backend-id", 0, backendIDHelp, "id")
+	rateLimit := getopt.StringLong("rate-limit", 0, "", rateLimitHelp, "n")
+	rateBurst := getopt.IntLong("rate-burst", 0, 1, rateBurstHelp, "n")
+	maxHandshakes := getopt.IntLong("max-handshakes", 0, 0, maxHSHelp, "n")
+	maxHandshakesIP := getopt.IntLong("max-handshakes-per-ip", 0, 0, maxHSIPHelp, "n")
+	handshakeWorkers := getopt.IntLong("handshake-workers", 0, 4*runtime.NumCPU(), hsWorkersHelp, "n")
+	handshakeTimeout := getopt.DurationLong("handshake-timeout", 0, 10*time.Second, hsTimeoutHelp, "duration")
+	reauthorize = getopt.DurationLong("reauthorize", 0, 0, reauthHelp, "duration")
+	drainTimeout := getopt.DurationLong("drain-timeout", 0, 10*time.Second, drainHelp, "duration")
+	execCmd := getopt.StringLong("exec", 0, "", execHelp, "command")
+	shell := getopt.BoolLong("shell", 0, shellHelp)
+	servicesFile := getopt.StringLong("services", 0, "", servicesHelp, "file")
+	serviceName = getopt.StringLong("service", 0, "", serviceHelp, "name")
+	childTimeout = getopt.DurationLong("child-timeout", 0, 0, childTOHelp, "duration")
+	childStderrMode := getopt.StringLong("child-stderr", 0, "inherit", childErrHelp, "mode")
+	stderrToClient = getopt.BoolLong("stderr-to-client", 0, stderrHelp)
+	tagSource := getopt.BoolLong("tag-source", 0, tagSourceHelp)
+	acceptProxy := getopt.BoolLong("accept-proxy-protocol", 0, proxyHelp)
+	summaryPath := getopt.StringLong("summary-file", 0, "", summaryHelp, "file")
+	adminSocket := getopt.StringLong("admin-socket", 0, "", adminHelp, "path")
+	convertFrom := getopt.StringLong("from", 0, "", fromHelp, "format")
+	convertTo := getopt.StringLong("to", 0, "", toHelp, "format")
+	passphraseVar := getopt.StringLong("passphrase-var", 0, "", passVarHelp, "var")
+	force := getopt.BoolLong("force", 0, forceHelp)
 	showHelp := getopt.Bool('h', showHelpHelp)
 
 	getopt.SetUsage(printUsage)
 	getopt.Parse()
 	args := getopt.Args()
+	if err := applyEnv(); err != nil {
+		panic(err)
+	}
 
 	if *showHelp {
 		getopt.Usage()
@@ -113,39 +704,109 @@ func main() {
 	}
 	mode := args[0]
 
+	// only these modes connect to others
+	if *bind != "" && mode != "client" && mode != "relay" {
+		panic("--bind is only supported by client and relay")
+	}
+
+	if len(*channelSpecs) > 0 {
+		if mode != "client" && mode != "single" {
+			panic("--channel is only supported by client and single")
+		}
+		for _, spec := range *channelSpecs {
+			c, err := parseChannel(spec)
+			if err != nil {
+				panic(err)
+			}
+			if channels[c.id] != nil {
+				panic(fmt.Sprint("Duplicate channel: ", c.id))
+			}
+			channels[c.id] = c
+		}
+	}
+
 	if err := zeolite.Init(); err != nil {
 		panic(err)
 	}
 
+	// convert works on stdin instead of a loaded identity
+	if mode == "convert" {
+		if err := convert(*convertFrom, *convertTo); err != nil {
+			panic(err)
+		}
+		os.Exit(0)
+	}
+
+	// bundles are encrypted with a passphrase from the environment,
+	// so it doesn't show up in the process list
+	var passphrase []byte
+	if *passphraseVar != "" {
+		passphrase = []byte(os.Getenv(*passphraseVar))
+		if len(passphrase) == 0 {
+			panic("Empty passphrase in variable")
+		}
+	}
+
+	// bundle import restores the identity instead of loading it
+	if mode == "bundle" && len(args) > 1 && args[1] == "import" {
+		if len(args) < 3 || *identFile == "" || len(*trustFiles) > 1 {
+			panic("bundle import needs a file, -I and at most one -T")
+		}
+		trustFile := ""
+		if len(*trustFiles) == 1 {
+			trustFile = (*trustFiles)[0]
+		}
+		if err := bundleImport(
+			args[2], *identFile, trustFile, passphrase, *force,
+		); err != nil {
+			panic(err)
+		}
+		os.Exit(0)
+	}
+
 	// init identity
 	var identity zeolite.Identity
 	if *identVar != "" {
 		// read identity from base64 in env variable
-		val := os.Getenv(*identVar)
-		parts := strings.Split(val, "-")
-		if len(parts) != 2 {
+		var err error
+		identity, err = zeolite.ParseIdentityBase64(os.Getenv(*identVar))
+		if err != nil {
 			panic("Invalid data in variable")
 		}
-		r1 := base64.NewDecoder(base64.StdEncoding, strings.NewReader(parts[0]))
-		r2 := base64.NewDecoder(base64.StdEncoding, strings.NewReader(parts[1]))
-		public, err := io.ReadAll(r1)
-		if err != nil {
-			panic("Failed decoding public key")
+	} else if *identStr != "" {
+		// read identity from argument
+		var err error
+		if strings.Contains(*identStr, "-") {
+			identity, err = zeolite.ParseIdentityBase64(*identStr)
+		} else {
+			identity, err = zeolite.ParseIdentityHex(*identStr)
 		}
-		secret, err := io.ReadAll(r2)
 		if err != nil {
-			panic("Failed decoding secret key")
+			panic("Invalid identity string")
+		}
+	} else if *keyringName != "" {
+		// read identity from keyring, gen stores a new one there
+		var err error
+		if identity, err = loadKeyring(*keyringName, mode == "gen"); err != nil {
+			panic(err)
 		}
-		copy(identity.Public[:], public)
-		copy(identity.Secret[:], secret)
 	} else if *identFile != "" {
 		// read identity from file
 		all, err := os.ReadFile(*identFile)
-		if err != nil {
+		if errors.Is(err, os.ErrNotExist) && mode == "gen" {
+			// gen creates the file with a new identity
+			identity, err = zeolite.NewIdentity()
+			if err != nil {
+				panic(err)
+			}
+			if err := writeIdentity(*identFile, identity); err != nil {
+				panic(err)
+			}
+		} else if err != nil {
 			panic(err)
+		} else if identity, err = zeolite.LoadIdentity(all); err != nil {
+			panic(fmt.Sprint(*identFile, ": ", err))
 		}
-		copy(identity.Public[:], all)
-		copy(identity.Secret[:], all[len(identity.Public):])
 	} else {
 		// if no identity was loaded, create a new one
 		var err error
@@ -155,37 +816,244 @@ func main() {
 		}
 	}
 
+	// a mismatch would only show up as a verification error at the peer
+	if err := identity.Validate(); err != nil {
+		panic(err)
+	}
+
 	// identities always have the public part come first
 	if mode == "gen" {
 		os.Stdout.Write(identity.Public[:])
 		os.Stdout.Write(identity.Secret[:])
-		fmt.Fprintf(os.Stderr, "%s-%s",
-			zeolite.Base64Enc(identity.Public[:]),
-			zeolite.Base64Enc(identity.Secret[:]))
+		fmt.Fprint(os.Stderr, identity.Base64())
+		os.Exit(0)
+	}
+
+	// print only the ID, ready for trust files
+	if mode == "pubkey" {
+		if *identVar == "" && *identFile == "" && *identStr == "" && *keyringName == "" {
+			panic("pubkey needs an identity (-i, -I, --ident-string or --keyring)")
+		}
+		fmt.Println(zeolite.Base64Enc(identity.Public[:]))
+		info("Fingerprint:", identity.Public.Fingerprint())
 		os.Exit(0)
 	}
 
-	// trust all IDs
-	trustList = *trustIDs
+	// show what identity a file or variable contains
+	if mode == "fingerprint" {
+		if *identVar == "" && *identFile == "" && *identStr == "" && *keyringName == "" {
+			panic("fingerprint needs an identity (-i, -I, --ident-string or --keyring)")
+		}
+		fmt.Println("Fingerprint:", identity.Public.Fingerprint())
+		fmt.Println("ID:", zeolite.Base64Enc(identity.Public[:]))
+		os.Exit(0)
+	}
+
+	// issue a certificate for another ID
+	if mode == "issue" {
+		if len(args) < 2 {
+			panic("Not enough arguments")
+		}
 
-	// trust all IDs in files
+		peerPK, err := parseID(args[1])
+		if err != nil {
+			panic(err)
+		}
+
+		// parse optional validity window
+		var from, until time.Time
+		if *notBefore != "" {
+			if from, err = time.Parse(time.RFC3339, *notBefore); err != nil {
+				panic(err)
+			}
+		}
+		if *notAfter != "" {
+			if until, err = time.Parse(time.RFC3339, *notAfter); err != nil {
+				panic(err)
+			}
+		}
+
+		cert := identity.IssueCertValid(peerPK, from, until)
+		fmt.Println(zeolite.Base64Enc(cert))
+		os.Exit(0)
+	}
+
+	// encrypt or decrypt data at rest, without a peer
+	if mode == "encrypt" || mode == "decrypt" {
+		if passphrase == nil &&
+			*identVar == "" && *identFile == "" && *identStr == "" && *keyringName == "" {
+			panic("encrypt/decrypt with -t need an identity")
+		}
+		if err := cryptFilter(mode == "encrypt", identity, *trustIDs, passphrase); err != nil {
+			panic(err)
+		}
+		os.Exit(0)
+	}
+
+	// trust all IDs given directly, in files or remote lists
+	// and accepted interactively before
+	localTrust = trustSources{ids: *trustIDs, known: *interactive}
 	for _, path := range *trustFiles {
-		file, err := os.Open(path)
+		if !isURL(path) {
+			localTrust.files = append(localTrust.files, path)
+			continue
+		}
+
+		list, err := newRemoteList(path, *trustRefresh)
 		if err != nil {
 			panic(err)
 		}
-		scn := bufio.NewScanner(file)
-		for scn.Scan() {
-			trustList = append(trustList, scn.Text())
+		remoteLists = append(remoteLists, list)
+	}
+	var err error
+	if trustList, err = localTrust.load(); err != nil {
+		panic(err)
+	}
+	localTrust.warnPrefixes()
+	knownPeers = *interactive
+
+	// bundle export packs the loaded identity and local trust entries
+	if mode == "bundle" {
+		if len(args) < 3 || args[1] != "export" {
+			panic("bundle needs export or import and a file")
+		}
+		if *identVar == "" && *identFile == "" && *identStr == "" && *keyringName == "" {
+			panic("bundle export needs an identity (-i, -I, --ident-string or --keyring)")
+		}
+		if err := bundleExport(args[2], identity, trustList, passphrase); err != nil {
+			panic(err)
+		}
+		os.Exit(0)
+	}
+
+	// ask a command about unknown peers
+	trustCommand = *trustCmd
+	trustCommandTimeout = *trustCmdTimeout
+
+	// give up on checks like the handshake does
+	trustCheckTimeout = *trustTimeout
+
+	// look up trusted IDs in DNS
+	verifyDNS = *verifyHost
+	verifyTimeout = *dnsTimeout
+	if *resolverAddr != "" {
+		verifyResolver = resolver(*resolverAddr)
+	}
+
+	// trust all IDs certified by CAs
+	var cas []zeolite.SignPK
+	for _, id := range *caIDs {
+		ca, err := parseID(id)
+		if err != nil {
+			panic(err)
 		}
+		cas = append(cas, ca)
 	}
 
 	// disable check or specify trust IDs
-	if !*noCheck && len(trustList) == 0 {
+	if !*noCheck && len(trustList) == 0 && len(remoteLists) == 0 &&
+		len(cas) == 0 && knownPeers == "" && trustCommand == "" && verifyDNS == "" {
 		panic("No trust specified")
 	}
 
-	fmt.Fprintln(os.Stderr, "Self: ", zeolite.Base64Enc(identity.Public[:]))
+	// collect stream options
+	// typed frames carry the stderr of multi commands and channels.
+	// They are only offered if needed, so that connections without
+	// any capabilities keep the plain zeolite1 banner.
+	if *stderrToClient || len(channels) > 0 {
+		streamOpts = append(streamOpts,
+			zeolite.WithFrameTypes(), zeolite.WithStderr(os.Stderr))
+	}
+	if len(channels) > 0 {
+		streamOpts = append(streamOpts, zeolite.WithChannels())
+	}
+	if getopt.IsSet("compress") {
+		streamOpts = append(streamOpts, zeolite.WithCompression(*compress))
+	}
+	if *timing {
+		streamOpts = append(streamOpts, zeolite.WithTimings(
+			func(phase string, d time.Duration) {
+				fmt.Fprintf(os.Stderr, "Timing: %-13s %v\n", phase, d)
+			}))
+	}
+	if *revokedFile != "" {
+		list, err := zeolite.LoadRevocationList(*revokedFile)
+		if err != nil {
+			panic(err)
+		}
+		streamOpts = append(streamOpts, zeolite.WithRevocationList(list))
+	}
+	if len(cas) > 0 {
+		pool := zeolite.NewCertPool(cas...)
+		pool.Skew = *certSkew
+		streamOpts = append(streamOpts, zeolite.WithCertPool(pool))
+	}
+	if *certFile != "" {
+		b64, err := os.ReadFile(*certFile)
+		if err != nil {
+			panic(err)
+		}
+		cert, err := zeolite.Base64Dec(strings.TrimSpace(string(b64)))
+		if err != nil {
+			panic("Invalid certificate file")
+		}
+		streamOpts = append(streamOpts, zeolite.WithCert(cert))
+	}
+	if *challenge {
+		streamOpts = append(streamOpts, zeolite.WithChallenge())
+	}
+	if *recvLimit > 0 {
+		streamOpts = append(streamOpts, zeolite.WithRecvLimit(*recvLimit))
+	}
+	if *padding > 0 {
+		streamOpts = append(streamOpts, zeolite.WithPadding(*padding))
+	}
+	if *frameHeader {
+		streamOpts = append(streamOpts, zeolite.WithFrameHeader())
+	}
+	if *trustTimeout > 0 {
+		streamOpts = append(streamOpts, zeolite.WithTrustTimeout(*trustTimeout))
+	}
+
+	// only servers wait for the key of the peer to select an identity
+	serverOpts = streamOpts
+	if *identityMap != "" {
+		if mode == "client" {
+			panic("--identity-map is only supported by servers")
+		}
+		m, err := readIdentityMap(*identityMap)
+		if err != nil {
+			panic(err)
+		}
+		serverOpts = append(serverOpts[:len(serverOpts):len(serverOpts)],
+			zeolite.WithIdentitySelector(selectIdentity(m)))
+	}
+	if *bufferSize <= 0 {
+		panic(fmt.Sprint("Invalid buffer size: ", *bufferSize))
+	}
+
+	if *servicesFile != "" {
+		var err error
+		if services, err = readServices(*servicesFile); err != nil {
+			panic(err)
+		}
+	}
+	if *childStderrMode != "inherit" {
+		var err error
+		if childStderr, err = parseChildStderr(*childStderrMode); err != nil {
+			panic(err)
+		}
+	}
+
+	for _, b64 := range *backendIDList {
+		id, err := parseID(b64)
+		if err != nil {
+			panic(err)
+		}
+		backendIDs = append(backendIDs, id)
+	}
+
+	info("Self: ", zeolite.Base64Enc(identity.Public[:]))
 
 	// do we have at least mode & address?
 	if len(args) < 2 {
@@ -198,116 +1066,568 @@ func main() {
 		panic(err)
 	}
 
-	switch mode {
-	case "client":
-		conn, err := net.Dial(proto, val)
+	// listen on address, applying the socket mode if required,
+	// unless systemd passed us the socket already
+	listen := func() net.Listener {
+		if conn, err := systemdListener(); err != nil {
+			panic(err)
+		} else if conn != nil {
+			info("Listening on the socket from systemd:", conn.Addr())
+			return conn
+		}
+
+		lc := net.ListenConfig{}
+		if *reuseport {
+			if !strings.HasPrefix(proto, "tcp") {
+				panic("--reuseport needs a TCP address")
+			}
+			lc.Control = reusePort
+		}
+		conn, err := lc.Listen(context.Background(), proto, val)
 		if err != nil {
 			panic(err)
 		}
 
-		simple(identity, conn)
+		if proto == "unix" && *socketMode != "" && !strings.HasPrefix(val, "\x00") {
+			perm, err := strconv.ParseUint(*socketMode, 8, 32)
+			if err != nil {
+				panic(fmt.Sprint("Invalid socket mode: ", *socketMode))
+			}
+			if err := os.Chmod(val, os.FileMode(perm)); err != nil {
+				panic(err)
+			}
+		}
 
-	case "single":
-		conn, err := net.Listen(proto, val)
+		return conn
+	}
+
+	// newListener creates a listener for the server modes
+	newListener := func() *zeolite.Listener {
+		inner := pausableListener{listen()}
+		listener := identity.NewListener(inner, trustAt(""), serverOpts...)
+		listener.ErrorLog = log.New(os.Stderr, "", 0)
+		listener.DrainTimeout = *drainTimeout
+		listener.Reauthorize = *reauthorize
+		listener.DSCP = *dscp
+		listener.ProxyProtocol = *acceptProxy
+		listener.TrustFor = func(conn net.Conn) zeolite.TrustCB {
+			// reauthorization calls this again, quietly
+			peer := &peerTrust{addr: conn.RemoteAddr().String()}
+			announced := false
+			return func(otherPK zeolite.SignPK) (bool, error) {
+				if announced {
+					return peer.trusted(otherPK)
+				}
+				announced = true
+				if *acceptProxy {
+					info("From:", conn.RemoteAddr())
+				}
+				return peer.trust(otherPK)
+			}
+		}
+		if *rateLimit != "" {
+			rate, err := strconv.ParseFloat(*rateLimit, 64)
+			if err != nil || rate <= 0 {
+				panic(fmt.Sprint("Invalid rate limit: ", *rateLimit))
+			}
+			listener.RateLimit = zeolite.NewRateLimiter(rate, *rateBurst)
+		}
+		if *maxHandshakes > 0 || *maxHandshakesIP > 0 {
+			listener.Handshakes = zeolite.NewHandshakeLimiter(*maxHandshakes, *maxHandshakesIP)
+		}
+		listener.HandshakeWorkers = *handshakeWorkers
+		listener.HandshakeTimeout = *handshakeTimeout
+		addSummary(listener)
+		return listener
+	}
+
+	summaryFile = *summaryPath
+	handleSummary()
+	if *adminSocket != "" {
+		if err := serveAdmin(*adminSocket); err != nil {
+			panic(err)
+		}
+	}
+
+	// newDialer creates a dialer for addresses of proto
+	newDialer := func(proto string, cb zeolite.TrustCB) *zeolite.Dialer {
+		dialer := identity.NewDialer(cb, streamOpts...)
+		dialer.Retries = *retries
+		dialer.Backoff = time.Second
+		dialer.KeepAlive = *tcpKeepAlive
+		dialer.FallbackDelay = *fallbackDelay
+		dialer.ResolveTimeout = *dnsTimeout
+		if *resolverAddr != "" {
+			dialer.Resolver = resolver(*resolverAddr)
+		}
+		if *bind != "" {
+			var err error
+			if dialer.LocalAddr, err = localAddr(proto, *bind); err != nil {
+				panic(fmt.Sprint("Invalid bind address: ", err))
+			}
+		}
+		return dialer
+	}
+
+	switch mode {
+	case "client":
+		stream, err := newDialer(proto, trustAt(val)).Dial(proto, val)
 		if err != nil {
 			panic(err)
 		}
+		if conn, ok := stream.Conn.(net.Conn); ok {
+			setDSCP(conn)
+			setLinger(conn)
+		}
+
+		addSummaryStream(stream)
+		defer removeSummaryStream(stream)
+		session(stream)
+
+	case "single":
+		conn := listen()
 
 		client, err := conn.Accept()
 		if err != nil {
 			panic(err)
 		}
+		if *acceptProxy {
+			if client, err = zeolite.ReadProxyHeader(client); err != nil {
+				panic(err)
+			}
+			info("From:", client.RemoteAddr())
+		}
 
 		simple(identity, client)
 
 	case "multi":
-		if len(args) < 3 {
-			panic("Not enough arguments")
+		// everything after -- belongs to the command
+		command := args[2:]
+		if len(command) > 0 && command[0] == "--" {
+			command = command[1:]
 		}
 
-		conn, err := net.Listen(proto, val)
-		if err != nil {
-			panic(err)
+		// the command may also come as a single string
+		if *execCmd != "" {
+			if len(command) > 0 || services != nil {
+				panic("Specify either a command, --exec or --services")
+			}
+			if *shell {
+				command = []string{"sh", "-c", *execCmd}
+			} else if command, err = splitWords(*execCmd); err != nil {
+				panic(fmt.Sprint("--exec: ", err))
+			}
+		} else if *shell {
+			panic("--shell needs --exec")
 		}
 
-		// main loop: accept new clients, spawn child processes and handlers
-		for {
-			// accept client
-			client, err := conn.Accept()
+		if len(command) == 0 && services == nil {
+			panic("Not enough arguments")
+		}
+		if len(command) > 0 && services != nil {
+			panic("Specify either a command or --services")
+		}
+
+		// serve clients by spawning their handlers until we are stopped
+		ctx, cancel := signal.NotifyContext(
+			context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer cancel()
 
-			reject := func() {
-				fmt.Fprintln(os.Stderr, err)
-				client.Close()
+		listener := newListener()
+		listener.ServeContext(ctx, func(stream *zeolite.Stream) {
+			if conn, ok := stream.Conn.(net.Conn); ok {
+				keepAlive(conn)
+				setLinger(conn)
 			}
+			serveChild(stream, command)
+		})
 
-			if err != nil {
-				reject()
-				continue
+	case "collect":
+		ctx, cancel := signal.NotifyContext(
+			context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer cancel()
+
+		// a closed stdout should stop the collector, not kill it
+		signal.Ignore(syscall.SIGPIPE)
+
+		c := &collector{out: os.Stdout, tag: *tagSource, stop: cancel}
+		newListener().ServeContext(ctx, func(stream *zeolite.Stream) {
+			if conn, ok := stream.Conn.(net.Conn); ok {
+				keepAlive(conn)
+				setLinger(conn)
 			}
+			c.serve(stream)
+		})
 
-			// open zeolite stream
-			stream, err := identity.NewStream(client, trust)
-			if err != nil {
-				reject()
-				continue
+	case "broadcast":
+		ctx, cancel := signal.NotifyContext(
+			context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer cancel()
+
+		// publish stdin until it ends or we are stopped
+		b := &broadcaster{}
+		go func() {
+			if err := b.run(os.Stdin); err != nil {
+				info("Reading stdin failed:", err)
 			}
+			cancel()
+		}()
+		go func() {
+			<-ctx.Done()
+			b.finish()
+		}()
 
-			// create child process
-			child := exec.Command(args[2], args[3:]...)
+		// wait for the subscribers to receive the rest
+		newListener().ServeContext(ctx, func(stream *zeolite.Stream) {
+			if conn, ok := stream.Conn.(net.Conn); ok {
+				keepAlive(conn)
+				setLinger(conn)
+			}
+			b.serve(stream)
+		})
 
-			// get pipes
-			in, err := child.StdinPipe()
+	case "relay":
+		if len(args) < 3 {
+			panic("Not enough arguments")
+		}
+		backendProto, backendAddr, err := parseAddr(args[2])
+		if err != nil {
+			panic(err)
+		}
+		if len(backendIDs) == 0 {
+			panic("relay needs --backend-id")
+		}
+		dialer := newDialer(backendProto, trustBackend)
+		dial := func() (*zeolite.Stream, error) {
+			stream, err := dialer.Dial(backendProto, backendAddr)
 			if err != nil {
-				reject()
-				continue
+				return nil, err
 			}
-			out, err := child.StdoutPipe()
-			if err != nil {
-				reject()
-				continue
+			if err := checkBackend(stream); err != nil {
+				return nil, err
 			}
-			oer, err := child.StderrPipe()
-			if err != nil {
-				reject()
-				continue
+			if conn, ok := stream.Conn.(net.Conn); ok {
+				setDSCP(conn)
+				setLinger(conn)
 			}
+			return stream, nil
+		}
+
+		ctx, cancel := signal.NotifyContext(
+			context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer cancel()
 
-			// start child
-			if err := child.Start(); err != nil {
-				reject()
-				continue
+		newListener().ServeContext(ctx, func(stream *zeolite.Stream) {
+			if conn, ok := stream.Conn.(net.Conn); ok {
+				keepAlive(conn)
+				setLinger(conn)
 			}
+			serveRelay(stream, dial)
+		})
 
-			// start await, data transfer & stderr display
-			go func() {
-				child.Wait()
-				client.Close()
-			}()
-			go bidi(stream, out, in)
-			go io.Copy(os.Stderr, oer)
-		}
 	default:
 		panic(fmt.Sprint("Unknown mode: ", mode))
 	}
 }
 
+// writeIdentity stores identity in raw form (public part first)
+// in a new file that only the owner can access
+func writeIdentity(path string, identity zeolite.Identity) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := file.Write(identity.Public[:]); err != nil {
+		return err
+	}
+	if _, err := file.Write(identity.Secret[:]); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// info prints an informational message to stderr unless --quiet is given.
+// stdout is reserved for data.
+func info(args ...any) {
+	if !*quiet {
+		fmt.Fprintln(os.Stderr, args...)
+	}
+}
+
+// localAddr resolves the address to bind outgoing connections to.
+// For IP networks, the port is optional.
+func localAddr(proto, addr string) (net.Addr, error) {
+	if strings.HasPrefix(proto, "unix") {
+		return net.ResolveUnixAddr(proto, addr)
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "0")
+	}
+	if err := checkFamily(proto, addr); err != nil {
+		return nil, err
+	}
+	return net.ResolveTCPAddr(proto, addr)
+}
+
+// resolver returns a resolver that queries the DNS server at addr.
+// The port defaults to 53.
+func resolver(addr string) *net.Resolver {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "53")
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+// keepAlive enables TCP keepalives on conn if requested
+func keepAlive(conn net.Conn) {
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok || *tcpKeepAlive <= 0 {
+		return
+	}
+	if err := tcp.SetKeepAlive(true); err != nil {
+		panic(err)
+	}
+	if err := tcp.SetKeepAlivePeriod(*tcpKeepAlive); err != nil {
+		panic(err)
+	}
+}
+
+// setLinger sets SO_LINGER on conn if requested
+func setLinger(conn net.Conn) {
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok || *linger < 0 {
+		return
+	}
+	if err := tcp.SetLinger(*linger); err != nil {
+		panic(err)
+	}
+}
+
+// setDSCP marks the packets of conn if requested
+func setDSCP(conn net.Conn) {
+	if *dscp != 0 {
+		if err := zeolite.SetDSCP(conn, *dscp); err != nil {
+			panic(err)
+		}
+	}
+}
+
 func simple(identity zeolite.Identity, conn net.Conn) {
-	stream, err := identity.NewStream(conn, trust)
+	keepAlive(conn)
+	setLinger(conn)
+	setDSCP(conn)
+
+	peer := &peerTrust{addr: conn.RemoteAddr().String()}
+	stream, err := identity.NewStream(conn, peer.trust, serverOpts...)
 	if err != nil {
 		panic(err)
 	}
 
-	bidi(stream, os.Stdin, os.Stdout)
+	if *reauthorize > 0 {
+		go func() {
+			for range time.Tick(*reauthorize) {
+				if err := stream.Reauthorize(peer.trusted); err != nil {
+					info("Reauthorization failed:", err)
+					conn.Close()
+					return
+				}
+			}
+		}()
+	}
+
+	addSummaryStream(stream)
+	defer removeSummaryStream(stream)
+	session(stream)
+}
+
+// session connects stdin & stdout to stream
+func session(stream *zeolite.Stream) {
+	// both sides must offer channels, the peer rejects them otherwise
+	if len(channels) > 0 && stream.Caps&zeolite.CapChannels == 0 {
+		panic("The peer does not support channels (see --channel)")
+	}
+
+	// select a service of a multi server
+	if *serviceName != "" {
+		if err := stream.Send([]byte(*serviceName)); err != nil {
+			panic(err)
+		}
+	}
+
+	// a closed stdout should end the session, not kill the process
+	// before the peer is told
+	signal.Ignore(syscall.SIGPIPE)
+
+	var src io.ReadCloser = os.Stdin
+	var dst io.WriteCloser = os.Stdout
+	var out *atomicFile
+	if *outFile != "" {
+		var err error
+		if *noAtomic {
+			dst, err = os.Create(*outFile)
+		} else {
+			out, err = createAtomic(*outFile)
+			dst = out
+		}
+		if err != nil {
+			panic(err)
+		}
+	}
+	if *teeFile != "" {
+		src, dst = tee(src, dst, *teeFile)
+	}
+
+	err := bidi(stream, src, dst)
+	if out != nil {
+		if err := out.commit(err == nil); err != nil {
+			panic(err)
+		}
+	}
+	if err != nil && *outFile != "" {
+		panic(fmt.Sprint("Transfer incomplete: ", err))
+	}
+}
+
+// teeReader copies everything read from it to a file
+type teeReader struct {
+	io.Reader
+	src  io.Closer
+	file *os.File
+}
+
+// Close closes the source and the file
+func (t teeReader) Close() error {
+	return closeBoth(t.src, t.file)
+}
+
+// teeWriter copies everything written to it to a file
+type teeWriter struct {
+	io.Writer
+	dst  io.Closer
+	file *os.File
+}
+
+// Close closes the destination and the file
+func (t teeWriter) Close() error {
+	return closeBoth(t.dst, t.file)
+}
+
+// closeBoth closes a and b and returns the first error
+func closeBoth(a, b io.Closer) error {
+	err := a.Close()
+	if errB := b.Close(); err == nil {
+		err = errB
+	}
+	return err
+}
+
+// tee copies the data read from src to <path>.sent
+// and the data written to dst to <path>.recv
+func tee(src io.ReadCloser, dst io.WriteCloser, path string) (io.ReadCloser, io.WriteCloser) {
+	fmt.Fprintln(os.Stderr, "WARNING: writing plaintext to", path+".{sent,recv}")
+
+	open := func(path string) *os.File {
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			panic(err)
+		}
+		return file
+	}
+	sent := open(path + ".sent")
+	recv := open(path + ".recv")
+
+	return teeReader{io.TeeReader(src, sent), src, sent},
+		teeWriter{io.MultiWriter(dst, recv), dst, recv}
 }
 
-func bidi(stream *zeolite.Stream, src io.ReadCloser, dst io.WriteCloser) {
-	// src -> stream
+// send copies src to stream. With --line-buffered, every line
+// becomes a frame, otherwise every block read from src.
+func send(stream *zeolite.Stream, src io.Reader) error {
+	if !*lineBuffered {
+		// hide WriterTo, which would bring its own buffer
+		_, err := io.CopyBuffer(stream, struct{ io.Reader }{src}, make([]byte, *bufferSize))
+		return err
+	}
+
+	rd := bufio.NewReader(src)
+	for {
+		line, err := rd.ReadBytes('\n')
+		if len(line) > 0 {
+			if err := stream.Send(line); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// bidi copies src to stream and stream to dst. If one direction fails
+// or the peer goes away, the other one is canceled by closing the
+// connection and src, so that bidi returns even if src blocks.
+// It returns the error of receiving, nil if the peer finished properly.
+func bidi(stream *zeolite.Stream, src io.ReadCloser, dst io.WriteCloser) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		if conn, ok := stream.Conn.(io.Closer); ok {
+			conn.Close()
+		}
+		src.Close()
+		for _, c := range channels {
+			c.in.Close()
+		}
+	}()
+
+	// channels -> stream, each ended on its own
+	chanSent := make(chan error, 1)
+	go func() { chanSent <- sendChannels(stream) }()
+
+	// src -> stream, then tell the peer that src and all channels are done
+	sent := make(chan struct{})
 	go func() {
-		io.Copy(stream, src)
+		err := send(stream, src)
+		if chanErr := <-chanSent; err == nil {
+			err = chanErr
+		}
+		if err == nil {
+			stream.CloseWrite()
+		} else {
+			cancel()
+		}
 		src.Close()
+		close(sent)
 	}()
 
 	// stream -> dst
-	zeolite.BlockCopy(dst, stream)
-	dst.Close()
+	// if the peer is only done sending, we may still send the rest of src
+	err := recvChannels(stream, dst)
+	closeErr := dst.Close()
+	if err != zeolite.ErrEOS {
+		return err
+	}
+
+	// the peer is done sending, but keeps receiving until it closes
+	// the connection
+	go func() {
+		stream.WaitPeerClose()
+		cancel()
+	}()
+	select {
+	case <-sent:
+	case <-ctx.Done():
+	}
+	return closeErr
 }
@@ -0,0 +1,998 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/42LoCo42/go-zeolite"
+)
+
+// binary is the CLI built for the tests
+var binary string
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "zeolite-cli")
+	if err != nil {
+		panic(err)
+	}
+	binary = filepath.Join(dir, "zeolite")
+
+	build := exec.Command("go", "build", "-o", binary, ".")
+	build.Stderr = os.Stderr
+	if err := build.Run(); err != nil {
+		panic(err)
+	}
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// waitFor waits until path exists
+func waitFor(t *testing.T, path string) {
+	t.Helper()
+
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(path); err == nil {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("%s was not created", path)
+}
+
+// stdout must only carry the received data, so that it can be piped
+func TestStdoutIsClean(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "sock")
+	addr := "unix://" + sock
+
+	data := make([]byte, 4096)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+
+	server := exec.Command(binary, "-k", "single", addr)
+	server.Stdin = bytes.NewReader(data)
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Process.Kill()
+	waitFor(t, sock)
+
+	client := exec.Command(binary, "-k", "client", addr)
+	stderr := bytes.Buffer{}
+	client.Stderr = &stderr
+	out, err := client.Output()
+	if err != nil {
+		t.Fatalf("%v: %s", err, stderr.Bytes())
+	}
+	if !bytes.Equal(out, data) {
+		t.Fatalf("expected %d bytes of data on stdout, got %d bytes", len(data), len(out))
+	}
+}
+
+// identity creates an identity file and returns its path and ID
+func identity(t *testing.T, name string) (path, id string) {
+	t.Helper()
+
+	path = filepath.Join(t.TempDir(), name)
+	if err := exec.Command(binary, "-I", path, "gen").Run(); err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command(binary, "-I", path, "-q", "pubkey").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path, strings.TrimSpace(string(out))
+}
+
+// freeAddr returns a TCP address with an ephemeral port that was free
+func freeAddr(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return "tcp://" + l.Addr().String()
+}
+
+// result of a CLI run
+type result struct {
+	out, stderr []byte
+	err         error
+}
+
+// run starts the CLI with stdin and collects its output
+func run(stdin []byte, args ...string) <-chan result {
+	return runFiles(stdin, nil, args...)
+}
+
+// runFiles is like run, but passes files as descriptors 3, 4, ...
+func runFiles(stdin []byte, files []*os.File, args ...string) <-chan result {
+	ret := make(chan result, 1)
+	go func() {
+		cmd := exec.Command(binary, args...)
+		stderr := bytes.Buffer{}
+		cmd.Stdin = bytes.NewReader(stdin)
+		cmd.ExtraFiles = files
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		ret <- result{out, stderr.Bytes(), err}
+	}()
+	return ret
+}
+
+// exchange runs a single server and a client against each other
+func exchange(
+	t *testing.T,
+	serverArgs, clientArgs []string,
+	serverData, clientData []byte,
+) (server, client result) {
+	t.Helper()
+
+	addr := freeAddr(t)
+	serverDone := run(serverData, append(serverArgs, "single", addr)...)
+	// the server may not listen yet
+	clientDone := run(clientData, append(clientArgs, "--retries", "2", "client", addr)...)
+
+	timeout := time.After(20 * time.Second)
+	for i := 0; i < 2; i++ {
+		select {
+		case server = <-serverDone:
+		case client = <-clientDone:
+		case <-timeout:
+			t.Fatal("exchange did not finish")
+		}
+	}
+	return server, client
+}
+
+func TestExchange(t *testing.T) {
+	serverID, serverPK := identity(t, "server")
+	clientID, clientPK := identity(t, "client")
+
+	serverData := []byte("hello from the server\n")
+	clientData := make([]byte, 100000)
+	if _, err := rand.Read(clientData); err != nil {
+		t.Fatal(err)
+	}
+
+	server, client := exchange(t,
+		[]string{"-I", serverID, "-t", clientPK},
+		[]string{"-I", clientID, "-t", serverPK},
+		serverData, clientData,
+	)
+	if server.err != nil {
+		t.Fatalf("server: %v: %s", server.err, server.stderr)
+	}
+	if client.err != nil {
+		t.Fatalf("client: %v: %s", client.err, client.stderr)
+	}
+	if !bytes.Equal(server.out, clientData) {
+		t.Errorf("server received %d bytes, expected %d", len(server.out), len(clientData))
+	}
+	if !bytes.Equal(client.out, serverData) {
+		t.Errorf("client received %q, expected %q", client.out, serverData)
+	}
+}
+
+func TestExchangeUntrusted(t *testing.T) {
+	serverID, serverPK := identity(t, "server")
+	clientID, _ := identity(t, "client")
+	_, otherPK := identity(t, "other")
+
+	server, client := exchange(t,
+		[]string{"-I", serverID, "-t", otherPK},
+		[]string{"-I", clientID, "-t", serverPK},
+		[]byte("secret"), []byte("secret"),
+	)
+	if server.err == nil {
+		t.Error("server accepted an untrusted client")
+	}
+	if client.err == nil {
+		t.Error("client succeeded with a server that doesn't trust it")
+	}
+	if len(server.out) > 0 || len(client.out) > 0 {
+		t.Errorf("data was exchanged: %q, %q", server.out, client.out)
+	}
+}
+
+func TestExchangeIdentityMap(t *testing.T) {
+	serverID, _ := identity(t, "server")
+	workID, workPK := identity(t, "work")
+	clientID, clientPK := identity(t, "client")
+
+	// the client only trusts the work identity of the server
+	identityMap := filepath.Join(t.TempDir(), "map")
+	if err := os.WriteFile(identityMap,
+		[]byte("# clients of work\n"+clientPK+" "+workID+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	server, client := exchange(t,
+		[]string{"-I", serverID, "-t", clientPK, "--identity-map", identityMap},
+		[]string{"-I", clientID, "-t", workPK},
+		[]byte("work"), []byte("hello"),
+	)
+	if server.err != nil {
+		t.Fatalf("server: %v: %s", server.err, server.stderr)
+	}
+	if client.err != nil {
+		t.Fatalf("client: %v: %s", client.err, client.stderr)
+	}
+	if string(client.out) != "work" || string(server.out) != "hello" {
+		t.Errorf("wrong data exchanged: %q, %q", server.out, client.out)
+	}
+}
+
+// --bind only applies to modes that connect
+func TestBindServer(t *testing.T) {
+	select {
+	case res := <-run(nil, "-k", "--bind", "127.0.0.1", "single", freeAddr(t)):
+		if res.err == nil || !bytes.Contains(res.stderr, []byte("--bind is only supported")) {
+			t.Fatalf("expected --bind to be rejected, got %v: %s", res.err, res.stderr)
+		}
+	case <-time.After(20 * time.Second):
+		t.Fatal("server did not exit")
+	}
+}
+
+// channelFiles returns a file to send on a channel, containing data,
+// and one to receive its data
+func channelFiles(t *testing.T, data string) (in, out *os.File) {
+	t.Helper()
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "in"), []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	in, err := os.Open(filepath.Join(dir, "in"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { in.Close() })
+	if out, err = os.Create(filepath.Join(dir, "out")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { out.Close() })
+	return in, out
+}
+
+func TestChannel(t *testing.T) {
+	serverID, serverPK := identity(t, "server")
+	clientID, clientPK := identity(t, "client")
+	serverIn, serverOut := channelFiles(t, "logs of the server")
+	clientIn, clientOut := channelFiles(t, "logs of the client")
+
+	addr := freeAddr(t)
+	serverDone := runFiles([]byte("stdin of the server"), []*os.File{serverIn, serverOut},
+		"-I", serverID, "-t", clientPK, "--channel", "1:3:4", "single", addr)
+	clientDone := runFiles([]byte("stdin of the client"), []*os.File{clientIn, clientOut},
+		"-I", clientID, "-t", serverPK, "--channel", "1:3:4", "--retries", "2", "client", addr)
+
+	for _, done := range []<-chan result{serverDone, clientDone} {
+		select {
+		case res := <-done:
+			if res.err != nil {
+				t.Fatalf("%v: %s", res.err, res.stderr)
+			}
+		case <-time.After(20 * time.Second):
+			t.Fatal("exchange did not finish")
+		}
+	}
+
+	for file, want := range map[*os.File]string{
+		serverOut: "logs of the client",
+		clientOut: "logs of the server",
+	} {
+		got, err := os.ReadFile(file.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("expected %q, got %q", want, got)
+		}
+	}
+}
+
+// a peer without --channel doesn't offer channels
+func TestChannelNotOffered(t *testing.T) {
+	serverID, serverPK := identity(t, "server")
+	clientID, clientPK := identity(t, "client")
+	clientIn, _ := channelFiles(t, "logs of the client")
+
+	addr := freeAddr(t)
+	serverDone := run(nil, "-I", serverID, "-t", clientPK, "single", addr)
+	clientDone := runFiles(nil, []*os.File{clientIn},
+		"-I", clientID, "-t", serverPK, "--channel", "1:3", "--retries", "2", "client", addr)
+
+	select {
+	case client := <-clientDone:
+		if client.err == nil || !bytes.Contains(client.stderr, []byte("does not support channels")) {
+			t.Fatalf("expected an error about channels, got %v: %s", client.err, client.stderr)
+		}
+	case <-time.After(20 * time.Second):
+		t.Fatal("client did not finish")
+	}
+	select {
+	case <-serverDone:
+	case <-time.After(20 * time.Second):
+		t.Fatal("server did not finish")
+	}
+}
+
+// only a lookup that fails silently means that there is no secret
+func TestToolKeyring(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	for _, test := range []struct {
+		name, script string
+		secret       string
+		missing      bool
+		failure      string // part of the error
+	}{
+		{"found", "echo secret", "secret", false, ""},
+		{"missing", "exit 1", "", true, ""},
+		{"failed", "echo 'Cannot autolaunch D-Bus' >&2; exit 1", "", false, "D-Bus"},
+		{"killed", "kill -9 $$", "", false, "killed"},
+	} {
+		script := "#!/bin/sh\n" + test.script + "\n"
+		if err := os.WriteFile(filepath.Join(dir, "secret-tool"), []byte(script), 0700); err != nil {
+			t.Fatal(err)
+		}
+
+		secret, err := toolKeyring{}.Get("service", "account")
+		ok := false
+		switch {
+		case test.missing:
+			ok = err == errNoSecret
+		case test.failure != "":
+			ok = err != nil && err != errNoSecret && strings.Contains(err.Error(), test.failure)
+		default:
+			ok = err == nil && secret == test.secret
+		}
+		if !ok {
+			t.Errorf("%s: unexpected result %q (%v)", test.name, secret, err)
+		}
+	}
+}
+
+func TestBundle(t *testing.T) {
+	identFile, id := identity(t, "identity")
+	_, peerID := identity(t, "peer")
+	dir := t.TempDir()
+	bundle := filepath.Join(dir, "bundle.tar.gz")
+
+	// a random identity must not be exported by accident
+	if err := exec.Command(binary, "-t", peerID, "bundle", "export",
+		filepath.Join(dir, "random.tar.gz")).Run(); err == nil {
+		t.Fatal("bundle export without an identity succeeded")
+	}
+
+	export := exec.Command(binary, "-I", identFile, "-t", peerID,
+		"--passphrase-var", "PASS", "bundle", "export", bundle)
+	export.Env = append(os.Environ(), "PASS=secret")
+	if out, err := export.CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+
+	restored, trust := filepath.Join(dir, "restored"), filepath.Join(dir, "trust")
+	restore := exec.Command(binary, "-I", restored, "-T", trust,
+		"--passphrase-var", "PASS", "bundle", "import", bundle)
+	restore.Env = append(os.Environ(), "PASS=secret")
+	if out, err := restore.CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+
+	out, err := exec.Command(binary, "-I", restored, "-q", "pubkey").Output()
+	if err != nil || strings.TrimSpace(string(out)) != id {
+		t.Fatalf("expected identity %s, got %q (%v)", id, out, err)
+	}
+	if data, err := os.ReadFile(trust); err != nil || strings.TrimSpace(string(data)) != peerID {
+		t.Fatalf("expected trust in %s, got %q (%v)", peerID, data, err)
+	}
+
+	// existing files are kept without --force and replaced with it
+	if err := os.WriteFile(trust, []byte("old"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	restore = exec.Command(binary, "-I", restored, "-T", trust,
+		"--passphrase-var", "PASS", "bundle", "import", bundle)
+	restore.Env = append(os.Environ(), "PASS=secret")
+	if err := restore.Run(); err == nil {
+		t.Fatal("bundle import overwrote existing files without --force")
+	}
+	restore = exec.Command(binary, "-I", restored, "-T", trust,
+		"--passphrase-var", "PASS", "--force", "bundle", "import", bundle)
+	restore.Env = append(os.Environ(), "PASS=secret")
+	if out, err := restore.CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	if data, err := os.ReadFile(trust); err != nil || strings.TrimSpace(string(data)) != peerID {
+		t.Fatalf("expected trust in %s, got %q (%v)", peerID, data, err)
+	}
+	out, err = exec.Command(binary, "-I", restored, "-q", "pubkey").Output()
+	if err != nil || strings.TrimSpace(string(out)) != id {
+		t.Fatalf("expected identity %s, got %q (%v)", id, out, err)
+	}
+	if tmp, _ := filepath.Glob(filepath.Join(dir, ".*.tmp")); len(tmp) > 0 {
+		t.Errorf("temporary files left behind: %v", tmp)
+	}
+}
+
+// relay runs a single backend server behind a relay and connects
+// a client to it. The relay trusts the client and gets relayArgs,
+// the backend trusts the relay and gets backendArgs.
+func relay(t *testing.T, relayArgs, backendArgs []string) (backend, client result) {
+	t.Helper()
+
+	relayID, relayPK := identity(t, "relay")
+	clientID, clientPK := identity(t, "client")
+	backendAddr, relayAddr := freeAddr(t), freeAddr(t)
+
+	server := exec.Command(binary, append(backendArgs,
+		"-t", relayPK, "single", backendAddr)...)
+	stdout, stderr := bytes.Buffer{}, bytes.Buffer{}
+	server.Stdin = strings.NewReader("from backend")
+	server.Stdout, server.Stderr = &stdout, &stderr
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the backend may not listen yet either
+	relay := exec.Command(binary, append(relayArgs, "-I", relayID,
+		"-t", clientPK, "--retries", "2", "relay", relayAddr, backendAddr)...)
+	if err := relay.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer relay.Wait()
+	defer relay.Process.Kill()
+
+	// the relay and backend may not listen yet
+	clientDone := run([]byte("from client"),
+		"-I", clientID, "-t", relayPK, "--retries", "2", "client", relayAddr)
+	select {
+	case client = <-clientDone:
+	case <-time.After(20 * time.Second):
+		t.Fatal("client did not finish")
+	}
+
+	// a rejected backend may still wait for its connection
+	timer := time.AfterFunc(5*time.Second, func() { server.Process.Kill() })
+	defer timer.Stop()
+	err := server.Wait()
+	return result{stdout.Bytes(), stderr.Bytes(), err}, client
+}
+
+func TestRelay(t *testing.T) {
+	backendID, backendPK := identity(t, "backend")
+
+	backend, client := relay(t,
+		[]string{"--backend-id", backendPK},
+		[]string{"-I", backendID},
+	)
+	if client.err != nil {
+		t.Fatalf("client: %v: %s", client.err, client.stderr)
+	}
+	if backend.err != nil {
+		t.Fatalf("backend: %v: %s", backend.err, backend.stderr)
+	}
+	if string(backend.out) != "from client" || string(client.out) != "from backend" {
+		t.Errorf("wrong data relayed: %q, %q", backend.out, client.out)
+	}
+}
+
+// a backend with a certificate of a trusted CA must still be pinned
+func TestRelayCertNotPinned(t *testing.T) {
+	caID, caPK := identity(t, "ca")
+	backendID, backendPK := identity(t, "backend")
+	_, otherPK := identity(t, "other")
+
+	cert, err := exec.Command(binary, "-I", caID, "-q", "issue", backendPK).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(t.TempDir(), "cert")
+	if err := os.WriteFile(certFile, cert, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	backend, client := relay(t,
+		[]string{"--backend-id", otherPK, "--ca", caPK},
+		[]string{"-I", backendID, "--cert", certFile},
+	)
+	if len(client.out) > 0 || len(backend.out) > 0 {
+		t.Errorf("data was relayed to an unpinned backend: %q, %q",
+			backend.out, client.out)
+	}
+}
+
+// pair returns two streams connected over TCP loopback
+func pair(t *testing.T) (a, b *zeolite.Stream) {
+	t.Helper()
+
+	ids := make([]zeolite.Identity, 2)
+	for i := range ids {
+		var err error
+		if ids[i], err = zeolite.NewIdentity(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	trustAll := func(zeolite.SignPK) (bool, error) { return true, nil }
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	connA, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { connA.Close() })
+	connB, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { connB.Close() })
+
+	errs := make(chan error, 1)
+	go func() {
+		var err error
+		b, err = ids[1].NewStream(connB, trustAll)
+		errs <- err
+	}()
+	if a, err = ids[0].NewStream(connA, trustAll); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	return a, b
+}
+
+// connections that ended are not summarized anymore
+func TestSummaryStreams(t *testing.T) {
+	defer func(old []*zeolite.Stream) { summaryStreams = old }(summaryStreams)
+	summaryStreams = nil
+
+	a, b := pair(t)
+	addSummaryStream(a)
+	addSummaryStream(b)
+	removeSummaryStream(a)
+	if streams := activeStreams(); len(streams) != 1 || streams[0] != b {
+		t.Fatalf("expected only the second stream, got %v", streams)
+	}
+	removeSummaryStream(b)
+	if streams := activeStreams(); len(streams) != 0 {
+		t.Fatalf("expected no streams, got %v", streams)
+	}
+}
+
+// subscribers waits until b has n subscribers
+func subscribers(t *testing.T, b *broadcaster, n int) {
+	t.Helper()
+
+	for i := 0; i < 100; i++ {
+		b.mtx.Lock()
+		count := len(b.subs)
+		b.mtx.Unlock()
+		if count == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("expected %d subscribers", n)
+}
+
+func TestBroadcast(t *testing.T) {
+	defer func(old *int) { bufferSize = old }(bufferSize)
+	bufferSize = new(int)
+	*bufferSize = 32 * 1024
+
+	b := &broadcaster{}
+	peers := []*zeolite.Stream{}
+	for i := 0; i < 2; i++ {
+		stream, peer := pair(t)
+		go b.serve(stream)
+		peers = append(peers, peer)
+	}
+	subscribers(t, b, len(peers))
+
+	if err := b.run(strings.NewReader("news")); err != nil {
+		t.Fatal(err)
+	}
+	for _, peer := range peers {
+		if msg, err := peer.Recv(); err != nil || string(msg) != "news" {
+			t.Fatalf("expected news, got %q (%v)", msg, err)
+		}
+		if _, err := peer.Recv(); err != zeolite.ErrEOS {
+			t.Fatalf("expected ErrEOS, got %v", err)
+		}
+	}
+}
+
+// closeRecorder remembers whether it was closed
+type closeRecorder struct {
+	closed atomic.Bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed.Store(true)
+	return nil
+}
+
+// a subscriber with a full queue is dropped at once,
+// without stalling the others
+func TestBroadcastSlowSubscriber(t *testing.T) {
+	conn := &closeRecorder{}
+	slow := &subscriber{queue: make(chan []byte, 1), conn: conn}
+	slow.queue <- []byte("unread")
+	b := &broadcaster{subs: map[*subscriber]struct{}{slow: {}}}
+
+	stream, peer := pair(t)
+	go b.serve(stream)
+	subscribers(t, b, 2)
+
+	done := make(chan struct{})
+	go func() {
+		b.publish([]byte("news"))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("publish waited for the slow subscriber")
+	}
+	if !slow.dropped || !conn.closed.Load() {
+		t.Fatal("slow subscriber was not dropped")
+	}
+	subscribers(t, b, 1)
+
+	if msg, err := peer.Recv(); err != nil || string(msg) != "news" {
+		t.Fatalf("expected news, got %q (%v)", msg, err)
+	}
+}
+
+// nopCloser adds a Close method to a writer
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// the files of --tee are closed with the session
+func TestTee(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tee")
+	src, dst := tee(io.NopCloser(strings.NewReader("sent")), nopCloser{io.Discard}, path)
+
+	if _, err := io.ReadAll(src); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dst.Write([]byte("received")); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := dst.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for suffix, want := range map[string]string{".sent": "sent", ".recv": "received"} {
+		got, err := os.ReadFile(path + suffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("%s: expected %q, got %q", suffix, want, got)
+		}
+	}
+	for _, file := range []*os.File{src.(teeReader).file, dst.(teeWriter).file} {
+		if _, err := file.Write(nil); !errors.Is(err, os.ErrClosed) {
+			t.Errorf("%s was not closed: %v", file.Name(), err)
+		}
+	}
+}
+
+// bidi must return when the peer is gone, even if src has no input
+func TestBidiPeerGone(t *testing.T) {
+	defer func(lb *bool, bs *int) { lineBuffered, bufferSize = lb, bs }(
+		lineBuffered, bufferSize)
+	lineBuffered = new(bool)
+	bufferSize = new(int)
+	*bufferSize = 32 * 1024
+
+	stream, other := pair(t)
+
+	// src never delivers anything
+	pipe, idle := io.Pipe()
+	defer idle.Close()
+	src := &readStarted{ReadCloser: pipe, started: make(chan struct{})}
+	dst := bytes.Buffer{}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- bidi(stream, src, nopCloser{&dst})
+	}()
+
+	if err := other.Send([]byte("bye")); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("bidi did not return")
+	}
+	if dst.String() != "bye" {
+		t.Fatalf("expected bye, got %q", dst.String())
+	}
+
+	// the sender uses the globals until it reads
+	<-src.started
+}
+
+// readStarted closes started once Read is called
+type readStarted struct {
+	io.ReadCloser
+	started chan struct{}
+	once    sync.Once
+}
+
+func (r *readStarted) Read(p []byte) (int, error) {
+	r.once.Do(func() { close(r.started) })
+	return r.ReadCloser.Read(p)
+}
+
+func TestParseAddrFamily(t *testing.T) {
+	for addr, valid := range map[string]bool{
+		"tcp://127.0.0.1:1":  true,
+		"tcp://[::1]:1":      true,
+		"tcp4://127.0.0.1:1": true,
+		"tcp4://[::1]:1":     false,
+		"tcp4://:1":          true,
+		"tcp6://[::1]:1":     true,
+		"tcp6://127.0.0.1:1": false,
+		"tcp6://localhost:1": true,
+	} {
+		if _, _, err := parseAddr(addr); (err == nil) != valid {
+			t.Errorf("%s: unexpected result %v", addr, err)
+		}
+	}
+}
+
+// invalid lines of trust files are skipped, not the whole file
+func TestParseTrust(t *testing.T) {
+	_, id := identity(t, "peer")
+	entries, err := parseTrust(strings.NewReader(
+		"# peers\nnot-an-id\n"+id+" 2000-01-01T00:00:00Z\n"+id+" soon\n"+id+"\n"), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].expires.Year() != 2000 || !entries[1].expires.IsZero() {
+		t.Fatalf("unexpected entries: %+v", entries)
+	}
+}
+
+// fakeResolver serves TXT records and counts the lookups
+type fakeResolver struct {
+	records []string
+	err     error
+	lookups int
+}
+
+func (r *fakeResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	r.lookups++
+	if name != "_zeolite.example.com" {
+		return nil, errors.New("unexpected name " + name)
+	}
+	return r.records, r.err
+}
+
+func TestDNSTrusted(t *testing.T) {
+	defer func(host string, res txtResolver, old *bool) {
+		verifyDNS, verifyResolver, quiet = host, res, old
+		dnsCache.fetched = time.Time{}
+	}(verifyDNS, verifyResolver, quiet)
+	silent := true
+	quiet = &silent
+	verifyDNS = "example.com"
+
+	published, err := zeolite.NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := zeolite.NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// lookups fail until the records are cached
+	fake := &fakeResolver{err: errors.New("no answer")}
+	verifyResolver = fake
+	if dnsTrusted(published.Public) {
+		t.Fatal("trusted without records")
+	}
+
+	fake.records = []string{"v=spf1 -all", zeolite.Base64Enc(published.Public[:])}
+	fake.err = nil
+	if !dnsTrusted(published.Public) {
+		t.Fatal("published ID was not trusted")
+	}
+	if dnsTrusted(other.Public) {
+		t.Fatal("unpublished ID was trusted")
+	}
+	if fake.lookups != 2 {
+		t.Fatalf("expected the records to be cached, got %d lookups", fake.lookups)
+	}
+}
+
+// a trust command is stopped once the trust check takes too long
+func TestTrustCheckTimeout(t *testing.T) {
+	defer func(command string, commandTimeout, checkTimeout time.Duration) {
+		trustCommand, trustCommandTimeout, trustCheckTimeout =
+			command, commandTimeout, checkTimeout
+	}(trustCommand, trustCommandTimeout, trustCheckTimeout)
+	trustCommand, trustCommandTimeout = "exec sleep 10 #", time.Minute
+	trustCheckTimeout = 100 * time.Millisecond
+	defer func(old *bool) { quiet = old }(quiet)
+	silent := true
+	quiet = &silent
+
+	start := time.Now()
+	if ok, err := trusted(zeolite.SignPK{}, ""); ok || err != nil {
+		t.Fatalf("expected a rejection, got %v (%v)", ok, err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("trust command was not stopped, took %v", elapsed)
+	}
+}
+
+// reauthorizing doesn't run the trust command again for approved peers
+func TestReauthorizeTrustCommand(t *testing.T) {
+	defer func(command string, timeout time.Duration) {
+		trustCommand, trustCommandTimeout = command, timeout
+	}(trustCommand, trustCommandTimeout)
+	defer func(old *bool) { quiet = old }(quiet)
+	silent := true
+	quiet = &silent
+
+	runs := filepath.Join(t.TempDir(), "runs")
+	trustCommand, trustCommandTimeout = "echo >>"+runs+"; exit $EXIT #", time.Minute
+	count := func() int {
+		out, _ := os.ReadFile(runs)
+		return strings.Count(string(out), "\n")
+	}
+
+	for _, test := range []struct {
+		exit string
+		runs int
+	}{{"0", 1}, {"1", 3}} {
+		os.Remove(runs)
+		t.Setenv("EXIT", test.exit)
+
+		peer := &peerTrust{}
+		for i := 0; i < 3; i++ {
+			if ok, err := peer.trusted(zeolite.SignPK{}); ok != (test.exit == "0") || err != nil {
+				t.Fatalf("exit %s: unexpected result %v (%v)", test.exit, ok, err)
+			}
+		}
+		if n := count(); n != test.runs {
+			t.Errorf("exit %s: expected %d runs, got %d", test.exit, test.runs, n)
+		}
+	}
+
+	// every connection asks on its own
+	os.Remove(runs)
+	t.Setenv("EXIT", "0")
+	trusted(zeolite.SignPK{}, "")
+	trusted(zeolite.SignPK{}, "")
+	if n := count(); n != 2 {
+		t.Errorf("expected 2 runs, got %d", n)
+	}
+}
+
+func TestTrustPrefix(t *testing.T) {
+	identity, err := zeolite.NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b64 := zeolite.Base64Enc(identity.Public[:])
+	fingerprint := identity.Public.Fingerprint()
+
+	for val, valid := range map[string]bool{
+		b64:                          true,
+		fingerprint[:9]:              true,
+		strings.ToUpper(fingerprint): true,
+		fingerprint[:3]:              false,
+		"zzzz":                       false,
+	} {
+		if _, err := parseTrustID(val); (err == nil) != valid {
+			t.Errorf("%s: unexpected result %v", val, err)
+		}
+	}
+
+	defer func(old []trustEntry) { trustList = old }(trustList)
+	for prefix, trusted := range map[string]bool{
+		fingerprint[:9]: true,
+		"0000:0000":     fingerprint[:9] == "0000:0000",
+	} {
+		entry, _ := parseTrustID(prefix)
+		trustList = []trustEntry{entry}
+		if _, ok := lookupTrust(b64); ok != trusted {
+			t.Errorf("%s: expected trusted=%v", prefix, trusted)
+		}
+	}
+
+	// the warning is printed at startup, not on every reload
+	stderr, err := os.CreateTemp(t.TempDir(), "stderr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(old *os.File, sources trustSources) {
+		os.Stderr, localTrust = old, sources
+	}(os.Stderr, localTrust)
+	os.Stderr = stderr
+	localTrust = trustSources{ids: []string{fingerprint[:9]}}
+
+	localTrust.warnPrefixes()
+	for i := 0; i < 2; i++ {
+		if err := reloadTrust(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out, err := os.ReadFile(stderr.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(out), "WARNING"); n != 1 {
+		t.Fatalf("expected one warning, got %d: %s", n, out)
+	}
+}
+
+func TestSplitWords(t *testing.T) {
+	for input, want := range map[string][]string{
+		"":                        nil,
+		"  cat  ":                 {"cat"},
+		`grep -e "a b" file`:      {"grep", "-e", "a b", "file"},
+		`echo 'it''s' "\"\$x\n"`:  {"echo", "its", `"$x\n`},
+		`a\ b c\\d ''`:            {"a b", `c\d`, ""},
+		`sh -c 'echo "$1"' sh hi`: {"sh", "-c", `echo "$1"`, "sh", "hi"},
+	} {
+		got, err := splitWords(input)
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: expected %q, got %q (%v)", input, want, got, err)
+		}
+	}
+
+	for _, input := range []string{`"open`, `'open`, `trailing\`} {
+		if _, err := splitWords(input); err == nil {
+			t.Errorf("%s: expected an error", input)
+		}
+	}
+}
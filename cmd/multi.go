@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/42LoCo42/go-zeolite"
+)
+
+var (
+	// services maps service names to the commands handling them
+	services map[string][]string
+
+	// childStderr receives the stderr of multi commands
+	childStderr io.Writer = os.Stderr
+)
+
+// readServices parses a services file. Each line contains a service name
+// followed by the command and its arguments, separated by whitespace.
+// Empty lines and lines starting with # are ignored.
+func readServices(path string) (map[string][]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	ret := map[string][]string{}
+	scn := bufio.NewScanner(file)
+	for scn.Scan() {
+		fields := strings.Fields(scn.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("service %s has no command", fields[0])
+		}
+		ret[fields[0]] = fields[1:]
+	}
+	return ret, scn.Err()
+}
+
+// serveChild handles a stream of the multi mode
+// by spawning command (or the one of the requested service)
+func serveChild(stream *zeolite.Stream, command []string) {
+	reject := func(err error) {
+		fmt.Fprintln(os.Stderr, err)
+	}
+
+	// the first frame selects the service
+	if services != nil {
+		name, err := stream.Recv()
+		if err != nil {
+			reject(err)
+			return
+		}
+
+		var ok bool
+		if command, ok = services[string(name)]; !ok {
+			reject(fmt.Errorf("unknown service: %q", name))
+			return
+		}
+	}
+
+	// limit the runtime of the child: it is killed
+	// and the connection is closed without FINAL
+	ctx, cancel := context.WithCancel(context.Background())
+	if *childTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, *childTimeout)
+	}
+	defer cancel()
+
+	// create child process
+	child := exec.CommandContext(ctx, command[0], command[1:]...)
+
+	// get pipes
+	in, err := child.StdinPipe()
+	if err != nil {
+		reject(err)
+		return
+	}
+	out, err := child.StdoutPipe()
+	if err != nil {
+		reject(err)
+		return
+	}
+	oer, err := child.StderrPipe()
+	if err != nil {
+		reject(err)
+		return
+	}
+
+	// start child
+	if err := child.Start(); err != nil {
+		reject(err)
+		return
+	}
+
+	// on timeout, also stop reading output that
+	// children of the child may still produce
+	go func() {
+		<-ctx.Done()
+		if ctx.Err() != context.DeadlineExceeded {
+			return
+		}
+		info("Timeout of", command[0], "for", stream.OtherPK.Fingerprint())
+		if conn, ok := stream.Conn.(io.Closer); ok {
+			conn.Close()
+		}
+		out.Close()
+		oer.Close()
+	}()
+
+	// stream -> child
+	go func() {
+		zeolite.BlockCopy(in, stream)
+		in.Close()
+	}()
+
+	// child -> stream & stderr display
+	// Wait closes the pipes, so all output must be read before
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		if _, err := io.Copy(stream, out); err == nil && ctx.Err() == nil {
+			stream.CloseWrite()
+		}
+		wg.Done()
+	}()
+	go func() {
+		if *stderrToClient && stream.Caps&zeolite.CapFrameTypes != 0 {
+			io.Copy(stderrWriter{stream}, oer)
+		} else {
+			// always drained, so that the child doesn't block
+			io.Copy(childStderr, oer)
+		}
+		wg.Done()
+	}()
+	wg.Wait()
+
+	child.Wait()
+}
+
+// parseChildStderr returns the destination of the stderr of multi commands:
+// inherit (our stderr), discard or file:<path> (appended)
+func parseChildStderr(mode string) (io.Writer, error) {
+	switch {
+	case mode == "inherit":
+		return os.Stderr, nil
+	case mode == "discard":
+		return io.Discard, nil
+	case strings.HasPrefix(mode, "file:"):
+		return os.OpenFile(strings.TrimPrefix(mode, "file:"),
+			os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	default:
+		return nil, fmt.Errorf("invalid child stderr mode: %s", mode)
+	}
+}
+
+// stderrWriter sends everything written to it as stderr frames
+type stderrWriter struct {
+	stream *zeolite.Stream
+}
+
+func (w stderrWriter) Write(p []byte) (int, error) {
+	if err := w.stream.SendStderr(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
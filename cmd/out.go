@@ -0,0 +1,55 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// atomicFile collects data in a temporary file next to path,
+// which only replaces path once the data is complete
+type atomicFile struct {
+	*os.File
+	path string
+}
+
+func createAtomic(path string) (*atomicFile, error) {
+	file, err := os.CreateTemp(
+		filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	return &atomicFile{file, path}, nil
+}
+
+// Close flushes the data to disk
+func (file *atomicFile) Close() error {
+	if err := file.File.Sync(); err != nil {
+		file.File.Close()
+		return err
+	}
+	return file.File.Close()
+}
+
+// commit moves the closed file into place if ok, otherwise removes it
+func (file *atomicFile) commit(ok bool) error {
+	if !ok {
+		return os.Remove(file.Name())
+	}
+	return os.Rename(file.Name(), file.path)
+}
+
+// writeAtomic replaces path with data through an atomicFile
+func writeAtomic(path string, data []byte) error {
+	file, err := createAtomic(path)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if commitErr := file.commit(err == nil); err == nil {
+		err = commitErr
+	}
+	return err
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/42LoCo42/go-zeolite"
+)
+
+// backendIDs are the IDs a relay backend may have (see --backend-id)
+var backendIDs []zeolite.SignPK
+
+// isBackend reports whether otherPK is pinned by --backend-id
+func isBackend(otherPK zeolite.SignPK) bool {
+	for _, id := range backendIDs {
+		if id.Equal(otherPK) {
+			return true
+		}
+	}
+	return false
+}
+
+// trustBackend accepts only backends pinned by --backend-id
+func trustBackend(otherPK zeolite.SignPK) (bool, error) {
+	info("Backend:", zeolite.Base64Enc(otherPK[:]))
+	return isBackend(otherPK), nil
+}
+
+// checkBackend rejects a backend stream whose peer isn't pinned by
+// --backend-id. Options like --ca accept peers without asking
+// trustBackend, so the pin must be checked again after the handshake.
+func checkBackend(backend *zeolite.Stream) error {
+	if isBackend(backend.OtherPK) {
+		return nil
+	}
+	if closer, ok := backend.Conn.(io.Closer); ok {
+		closer.Close()
+	}
+	return fmt.Errorf("backend %s is not pinned by --backend-id",
+		zeolite.Base64Enc(backend.OtherPK[:]))
+}
+
+// serveRelay handles a stream of the relay mode: it connects to the
+// backend with dial and forwards all messages in both directions,
+// decrypting & encrypting them again. Each direction ends on its own.
+// If one of them fails, both connections are closed.
+func serveRelay(client *zeolite.Stream, dial func() (*zeolite.Stream, error)) {
+	backend, err := dial()
+	if err != nil {
+		info("Backend failed:", err)
+		return
+	}
+
+	closeBoth := func() {
+		for _, stream := range []*zeolite.Stream{client, backend} {
+			if closer, ok := stream.Conn.(io.Closer); ok {
+				closer.Close()
+			}
+		}
+	}
+	defer closeBoth()
+
+	errs := make(chan error, 2)
+	go func() {
+		_, err := zeolite.Relay(backend, client)
+		errs <- err
+	}()
+	go func() {
+		_, err := zeolite.Relay(client, backend)
+		errs <- err
+	}()
+
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			info("Relay failed:", err)
+			closeBoth()
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// remoteLists are trust lists fetched via HTTP(S)
+var remoteLists []*remoteList
+
+// remoteList is a trust list that is fetched from url periodically.
+// If fetching fails, the last good list stays in use.
+type remoteList struct {
+	url     string
+	mtx     sync.RWMutex
+	entries []trustEntry
+}
+
+var httpClient = http.Client{Timeout: 30 * time.Second}
+
+// isURL reports whether a -T argument is an HTTP(S) URL instead of a file
+func isURL(arg string) bool {
+	return strings.HasPrefix(arg, "http://") || strings.HasPrefix(arg, "https://")
+}
+
+// newRemoteList fetches the list at url, then refreshes it every interval
+func newRemoteList(url string, interval time.Duration) (*remoteList, error) {
+	list := &remoteList{url: url}
+	if err := list.refresh(); err != nil {
+		return nil, err
+	}
+
+	if interval > 0 {
+		go func() {
+			for range time.Tick(interval) {
+				if err := list.refresh(); err != nil {
+					fmt.Fprintln(os.Stderr, "Keeping last trust list:", err)
+				}
+			}
+		}()
+	}
+	return list, nil
+}
+
+func (list *remoteList) refresh() error {
+	res, err := httpClient.Get(list.url)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", list.url, res.Status)
+	}
+	if typ, _, err := mime.ParseMediaType(res.Header.Get("Content-Type")); err != nil ||
+		typ != "text/plain" {
+		return fmt.Errorf("%s: expected text/plain, got %q",
+			list.url, res.Header.Get("Content-Type"))
+	}
+
+	entries, err := parseTrust(res.Body, list.url)
+	if err != nil {
+		return err
+	}
+
+	list.mtx.Lock()
+	defer list.mtx.Unlock()
+	list.entries = entries
+	return nil
+}
+
+func (list *remoteList) lookup(b64 string) (trustEntry, bool) {
+	list.mtx.RLock()
+	defer list.mtx.RUnlock()
+
+	for _, entry := range list.entries {
+		if entry.id == b64 {
+			return entry, true
+		}
+	}
+	return trustEntry{}, false
+}
@@ -0,0 +1,17 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package main
+
+import "syscall"
+
+// reusePort is a net.ListenConfig.Control function setting SO_REUSEPORT,
+// so that several processes can listen on the same port
+func reusePort(network, address string, c syscall.RawConn) error {
+	var err error
+	if ctlErr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	}); ctlErr != nil {
+		return ctlErr
+	}
+	return err
+}
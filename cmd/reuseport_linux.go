@@ -0,0 +1,6 @@
+//go:build linux && (386 || amd64 || arm)
+
+package main
+
+// missing from package syscall on these architectures
+const soReusePort = 0xf
@@ -0,0 +1,14 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package main
+
+import (
+	"errors"
+	"runtime"
+	"syscall"
+)
+
+// reusePort fails since SO_REUSEPORT is not supported here
+func reusePort(network, address string, c syscall.RawConn) error {
+	return errors.New("--reuseport is not supported on " + runtime.GOOS)
+}
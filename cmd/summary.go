@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/42LoCo42/go-zeolite"
+)
+
+var (
+	// where the summary goes, empty for stderr
+	summaryFile string
+
+	// connections included in the summary
+	summaryMtx       sync.Mutex
+	summaryListeners []*zeolite.Listener
+	summaryStreams   []*zeolite.Stream
+)
+
+// addSummary includes the connections of a server in the summary
+func addSummary(listener *zeolite.Listener) {
+	summaryMtx.Lock()
+	defer summaryMtx.Unlock()
+	summaryListeners = append(summaryListeners, listener)
+}
+
+// addSummaryStream includes a single connection in the summary
+func addSummaryStream(stream *zeolite.Stream) {
+	summaryMtx.Lock()
+	defer summaryMtx.Unlock()
+	summaryStreams = append(summaryStreams, stream)
+}
+
+// removeSummaryStream excludes a connection that ended from the summary
+func removeSummaryStream(stream *zeolite.Stream) {
+	summaryMtx.Lock()
+	defer summaryMtx.Unlock()
+
+	for i, s := range summaryStreams {
+		if s == stream {
+			summaryStreams = append(summaryStreams[:i], summaryStreams[i+1:]...)
+			return
+		}
+	}
+}
+
+// printSummary writes a summary of the active connections
+// to the summary file or stderr
+func printSummary() {
+	if summaryFile == "" {
+		writeSummary(os.Stderr)
+		return
+	}
+
+	file, err := os.OpenFile(
+		summaryFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		info("Summary:", err)
+		return
+	}
+	defer file.Close()
+	writeSummary(file)
+}
+
+// activeStreams returns the streams included in the summary
+func activeStreams() []*zeolite.Stream {
+	summaryMtx.Lock()
+	defer summaryMtx.Unlock()
+
+	streams := append([]*zeolite.Stream{}, summaryStreams...)
+	for _, listener := range summaryListeners {
+		streams = append(streams, listener.Streams()...)
+	}
+	return streams
+}
+
+// writeSummary writes one line per active connection to w
+func writeSummary(w io.Writer) {
+	streams := activeStreams()
+	now := time.Now()
+	fmt.Fprintf(w, "%s: %d active connections\n", now.Format(time.RFC3339), len(streams))
+	for _, stream := range streams {
+		state := stream.DebugState()
+
+		addr := "-"
+		if conn, ok := stream.Conn.(net.Conn); ok {
+			addr = conn.RemoteAddr().String()
+		}
+
+		fmt.Fprintf(w, "%s %s up %v, sent %d bytes, received %d bytes\n",
+			state.PeerFingerprint, addr,
+			now.Sub(state.Established).Round(time.Second),
+			state.BytesSent, state.BytesReceived)
+	}
+}
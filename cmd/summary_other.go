@@ -0,0 +1,6 @@
+//go:build !unix
+
+package main
+
+// handleSummary does nothing, since there is no SIGUSR1
+func handleSummary() {}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd
+const listenFDsStart = 3
+
+// systemdListener returns the socket passed by systemd socket activation,
+// or nil if we were not started that way. Only a single listening socket
+// (Accept=no) is supported.
+func systemdListener() (net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 1 {
+		return nil, nil
+	}
+	if count > 1 {
+		return nil, fmt.Errorf("expected one socket from systemd, got %d", count)
+	}
+
+	// commands spawned by multi must not use the socket as well
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	syscall.CloseOnExec(listenFDsStart)
+
+	file := os.NewFile(listenFDsStart, "systemd socket")
+	defer file.Close()
+	return net.FileListener(file)
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/42LoCo42/go-zeolite"
+)
+
+// trustEntry is a trusted ID that may expire
+type trustEntry struct {
+	id      string
+	expires time.Time
+
+	// fingerprint prefix (lowercase, without colons) instead of id
+	prefix string
+}
+
+// minPrefix is the minimum number of hex digits of a fingerprint prefix
+const minPrefix = 4
+
+// parseTrustID parses a -t value: an ID or a fingerprint prefix
+func parseTrustID(val string) (trustEntry, error) {
+	if _, err := parseID(val); err == nil {
+		return trustEntry{id: val}, nil
+	}
+
+	prefix := strings.ReplaceAll(strings.ToLower(val), ":", "")
+	if len(prefix) < minPrefix || strings.Trim(prefix, "0123456789abcdef") != "" {
+		return trustEntry{}, fmt.Errorf("invalid ID or fingerprint prefix: %s", val)
+	}
+	return trustEntry{prefix: prefix}, nil
+}
+
+var (
+	trustList []trustEntry
+	trustMtx  sync.RWMutex
+	noCheck   *bool
+
+	// file of peers accepted interactively, empty if disabled
+	knownPeers string
+	promptSem  = make(chan struct{}, 1) // held while asking
+
+	// command deciding about unknown peers, empty if disabled
+	trustCommand        string
+	trustCommandTimeout time.Duration
+
+	// limit of a trust check, 0 if unlimited (see --trust-timeout)
+	trustCheckTimeout time.Duration
+)
+
+// trustSources are the local sources of trustList
+type trustSources struct {
+	ids   []string
+	files []string
+	known string // file of peers accepted interactively, may not exist yet
+}
+
+var localTrust trustSources
+
+// load reads all entries of sources
+func (sources trustSources) load() (ret []trustEntry, err error) {
+	for _, id := range sources.ids {
+		entry, err := parseTrustID(id)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, entry)
+	}
+	for _, path := range sources.files {
+		entries, err := readTrustFile(path)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, entries...)
+	}
+	if sources.known != "" {
+		entries, err := readTrustFile(sources.known)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		ret = append(ret, entries...)
+	}
+	return ret, nil
+}
+
+// warnPrefixes warns about the fingerprint prefixes among the IDs.
+// They don't change on reloads, so this is only done once.
+func (sources trustSources) warnPrefixes() {
+	for _, id := range sources.ids {
+		if entry, err := parseTrustID(id); err == nil && entry.prefix != "" {
+			// printed even with --quiet
+			fmt.Fprintln(os.Stderr, "WARNING: trusting every peer whose fingerprint starts with",
+				id+", which is easy to forge. Use full IDs outside of testing!")
+		}
+	}
+}
+
+// reloadTrust reads all trust files and fetches all remote lists again.
+// Like on a failed refresh, lists that can't be read stay in use
+// as they were, and the first error is returned.
+func reloadTrust() error {
+	entries, err := localTrust.load()
+	if err == nil {
+		trustMtx.Lock()
+		trustList = entries
+		trustMtx.Unlock()
+	}
+
+	for _, list := range remoteLists {
+		if refreshErr := list.refresh(); refreshErr != nil && err == nil {
+			err = refreshErr
+		}
+	}
+	return err
+}
+
+// trustAt returns trust as a callback for a peer at addr
+func trustAt(addr string) zeolite.TrustCB {
+	return func(otherPK zeolite.SignPK) (bool, error) {
+		return trust(otherPK, addr)
+	}
+}
+
+// trust checks whether the peer at addr (empty if unknown) is trusted
+func trust(otherPK zeolite.SignPK, addr string) (bool, error) {
+	return (&peerTrust{addr: addr}).trust(otherPK)
+}
+
+// trusted is like trust, but doesn't print the ID
+func trusted(otherPK zeolite.SignPK, addr string) (bool, error) {
+	return (&peerTrust{addr: addr}).trusted(otherPK)
+}
+
+// peerTrust checks the peer of one connection at addr, at the handshake
+// and again on every reauthorization. An approval by --trust-command or
+// the user is kept for the connection, so that reauthorizing doesn't run
+// the command or ask again each time.
+type peerTrust struct {
+	addr string
+
+	// a timed out check may still finish during the next one
+	approved atomic.Bool
+}
+
+// trust prints the ID of the peer and checks it
+func (peer *peerTrust) trust(otherPK zeolite.SignPK) (bool, error) {
+	info("Other:", zeolite.Base64Enc(otherPK[:]))
+	return peer.trusted(otherPK)
+}
+
+// trusted checks the peer without printing its ID
+func (peer *peerTrust) trusted(otherPK zeolite.SignPK) (bool, error) {
+	// the handshake gives up after --trust-timeout, and so do we
+	ctx, cancel := context.WithCancel(context.Background())
+	if trustCheckTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, trustCheckTimeout)
+	}
+	defer cancel()
+
+	b64 := zeolite.Base64Enc(otherPK[:])
+	if entry, ok := lookupTrust(b64); ok {
+		if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+			info("Trust expired at", entry.expires)
+			return false, nil
+		}
+		return true, nil
+	}
+
+	if verifyDNS != "" && dnsTrusted(otherPK) {
+		return true, nil
+	}
+	if trustCommand != "" || knownPeers != "" {
+		if peer.approved.Load() {
+			return true, nil
+		}
+
+		var ok bool
+		var err error
+		if trustCommand != "" {
+			ok = askCommand(ctx, b64, peer.addr)
+		} else {
+			ok, err = prompt(ctx, b64)
+		}
+		if ok {
+			peer.approved.Store(true)
+		}
+		return ok, err
+	}
+
+	trustMtx.RLock()
+	defer trustMtx.RUnlock()
+	return *noCheck && len(trustList) == 0 && len(remoteLists) == 0 &&
+		verifyDNS == "", nil
+}
+
+func lookupTrust(b64 string) (trustEntry, bool) {
+	trustMtx.RLock()
+	defer trustMtx.RUnlock()
+
+	fingerprint := ""
+	for _, entry := range trustList {
+		if entry.id == b64 {
+			return entry, true
+		}
+
+		if entry.prefix == "" {
+			continue
+		}
+		if fingerprint == "" {
+			pk, err := parseID(b64)
+			if err != nil {
+				continue
+			}
+			fingerprint = strings.ReplaceAll(pk.Fingerprint(), ":", "")
+		}
+		if strings.HasPrefix(fingerprint, entry.prefix) {
+			return entry, true
+		}
+	}
+	for _, list := range remoteLists {
+		if entry, ok := list.lookup(b64); ok {
+			return entry, true
+		}
+	}
+	return trustEntry{}, false
+}
+
+// prompt asks the user on the terminal whether to trust an unknown peer.
+// stdin can't be used since it carries the data to send.
+// Accepted peers are added to the known peers file. Once ctx is done,
+// the peer is rejected without waiting for an answer.
+func prompt(ctx context.Context, b64 string) (bool, error) {
+	// one question at a time
+	select {
+	case promptSem <- struct{}{}:
+	case <-ctx.Done():
+		return false, nil
+	}
+	defer func() { <-promptSem }()
+
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		// no terminal, no trust
+		return false, nil
+	}
+	defer tty.Close()
+
+	// stop reading the answer when ctx is done
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			if tty.SetReadDeadline(time.Now()) != nil {
+				tty.Close()
+			}
+		case <-done:
+		}
+	}()
+
+	fmt.Fprintf(tty, "Trust peer %s? [y/N] ", b64)
+	line, err := bufio.NewReader(tty).ReadString('\n')
+	if err != nil || ctx.Err() != nil {
+		fmt.Fprintln(tty)
+		return false, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(line)) {
+	case "y", "yes":
+	default:
+		return false, nil
+	}
+
+	// remember the peer
+	trustMtx.Lock()
+	trustList = append(trustList, trustEntry{id: b64})
+	trustMtx.Unlock()
+
+	file, err := os.OpenFile(
+		knownPeers, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return true, err
+	}
+	defer file.Close()
+
+	if _, err := fmt.Fprintln(file, b64); err != nil {
+		return true, err
+	}
+	return true, file.Close()
+}
+
+// askCommand runs the trust command for an unknown peer.
+// Only a successful exit within the timeout (and before ctx is done)
+// means trusted.
+func askCommand(ctx context.Context, b64, addr string) bool {
+	ctx, cancel := context.WithTimeout(ctx, trustCommandTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", trustCommand+` "$@"`, "sh", b64, addr)
+	// stdout carries our data, so keep it clean
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		info("Trust command timed out")
+		return false
+	}
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		info("Trust command failed:", err)
+	}
+	return err == nil
+}
+
+// readTrustFile parses a trust file. Each line contains an ID,
+// optionally followed by an expiry time in RFC 3339 format.
+// Empty lines and lines starting with # are ignored.
+func readTrustFile(path string) (ret []trustEntry, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return parseTrust(file, path)
+}
+
+// parseTrust parses the contents of a trust file read from r.
+// Invalid lines are skipped with a warning, so that one typo doesn't
+// make the whole file unusable.
+func parseTrust(r io.Reader, name string) (ret []trustEntry, err error) {
+	scn := bufio.NewScanner(r)
+	for line := 1; scn.Scan(); line++ {
+		fields := strings.Fields(scn.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		entry := trustEntry{id: fields[0]}
+		if _, err := parseID(entry.id); err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: %s:%d: skipping invalid ID %s\n",
+				name, line, entry.id)
+			continue
+		}
+		if len(fields) > 1 {
+			if entry.expires, err = time.Parse(time.RFC3339, fields[1]); err != nil {
+				fmt.Fprintf(os.Stderr, "WARNING: %s:%d: skipping invalid expiry %s\n",
+					name, line, fields[1])
+				continue
+			}
+		}
+		ret = append(ret, entry)
+	}
+	return ret, scn.Err()
+}
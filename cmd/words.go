@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+// splitWords splits s into words like a POSIX shell, but without any
+// expansions: words are separated by unquoted whitespace; single quotes
+// preserve everything up to the next single quote; in double quotes,
+// a backslash only escapes ", \, $ and `; elsewhere, it escapes
+// any character.
+func splitWords(s string) (ret []string, err error) {
+	word := strings.Builder{}
+	inWord := false
+	var quote rune
+
+	runes := []rune(s)
+	for i := 0; i < len(runes); i++ {
+		c := runes[i]
+		switch {
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else {
+				word.WriteRune(c)
+			}
+
+		case quote == '"':
+			if c == '"' {
+				quote = 0
+			} else if c == '\\' && i+1 < len(runes) && strings.ContainsRune("\"\\$`", runes[i+1]) {
+				i++
+				word.WriteRune(runes[i])
+			} else {
+				word.WriteRune(c)
+			}
+
+		case c == '\'' || c == '"':
+			quote, inWord = c, true
+
+		case c == '\\':
+			if i+1 == len(runes) {
+				return nil, errors.New("trailing backslash")
+			}
+			i++
+			word.WriteRune(runes[i])
+			inWord = true
+
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				ret = append(ret, word.String())
+				word.Reset()
+				inWord = false
+			}
+
+		default:
+			word.WriteRune(c)
+			inWord = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, errors.New("unterminated quote")
+	}
+	if inWord {
+		ret = append(ret, word.String())
+	}
+	return ret, nil
+}
@@ -0,0 +1,79 @@
+package zeolite
+
+import (
+	// #include <sodium.h>
+	"C"
+
+	"encoding/hex"
+	"strings"
+	"time"
+)
+
+// FingerprintBytes is the number of hash bytes shown by Fingerprint.
+const FingerprintBytes = 16
+
+// Fingerprint returns a short, human-comparable form of pk: the first
+// FingerprintBytes bytes of its BLAKE2b hash in hex, grouped like
+// "1a2b:3c4d:...". It is meant for verifying keys out of band.
+func (pk SignPK) Fingerprint() string {
+	hash := make([]byte, C.crypto_generichash_BYTES)
+	C.crypto_generichash(
+		ptr(hash), C.size_t(len(hash)),
+		ptr(pk[:]), size(pk[:]),
+		nil, 0,
+	)
+
+	str := hex.EncodeToString(hash[:FingerprintBytes])
+	groups := make([]string, 0, len(str)/4)
+	for i := 0; i < len(str); i += 4 {
+		groups = append(groups, str[i:i+4])
+	}
+	return strings.Join(groups, ":")
+}
+
+// StreamDebug is a snapshot of the state of a Stream for diagnostics.
+// It contains no key material.
+type StreamDebug struct {
+	Protocol        string // Protocol or ProtocolEx
+	Caps            Caps
+	Suite           Caps // capability of the suite, 0 for the default
+	PeerFingerprint string
+	Established     time.Time // end of the handshake (or import)
+
+	FramesSent     uint64 // including control frames
+	FramesReceived uint64
+	BytesSent      uint64 // on the wire, including framing & overhead
+	BytesReceived  uint64
+	LastRekey      time.Time // zero if never rekeyed
+	Rekeys         uint64    // in both directions
+
+	FinalSent     bool
+	FinalReceived bool
+}
+
+// DebugState returns diagnostic information about stream.
+// It may be called concurrently with all other methods.
+func (stream *Stream) DebugState() StreamDebug {
+	stream.sendMtx.Lock()
+	finalSent := stream.sendClosed
+	stream.sendMtx.Unlock()
+
+	ret := StreamDebug{
+		Protocol:        stream.protocol,
+		Caps:            stream.Caps,
+		Suite:           stream.Suite.Cap(),
+		PeerFingerprint: stream.OtherPK.Fingerprint(),
+		Established:     stream.established,
+		FramesSent:      stream.framesSent.Load(),
+		FramesReceived:  stream.framesReceived.Load(),
+		BytesSent:       stream.bytesSent.Load(),
+		BytesReceived:   stream.bytesReceived.Load(),
+		Rekeys:          stream.rekeys.Load(),
+		FinalSent:       finalSent,
+		FinalReceived:   stream.recvClosed.Load(),
+	}
+	if rekey := stream.lastRekey.Load(); rekey != 0 {
+		ret.LastRekey = time.Unix(0, rekey)
+	}
+	return ret
+}
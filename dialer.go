@@ -0,0 +1,200 @@
+package zeolite
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Dialer connects to servers and performs the handshake. Handshakes that
+// fail because of the network are retried on a new connection.
+type Dialer struct {
+	// Dialer creates the underlying connections.
+	net.Dialer
+	Identity Identity
+	Trust    TrustCB
+	Options  []Option
+
+	// Retries is the number of additional attempts after a failure
+	// for which IsRetryable returns true.
+	Retries int
+
+	// Backoff is the delay before the first retry.
+	// It is doubled for every further retry.
+	Backoff time.Duration
+
+	// ResolveTimeout limits the name resolution of each attempt.
+	// If set, the pure Go resolver is used, with the Dial function
+	// of Resolver (if any).
+	ResolveTimeout time.Duration
+}
+
+// IsRetryable reports whether err is a transport error, after which a new
+// connection may succeed. Failures of trust, protocol, signatures or
+// encryption are permanent. So are transport errors of the handshake
+// once the peer knows our identity: the peer closes the connection when
+// it doesn't trust us, which looks the same.
+func IsRetryable(err error) bool {
+	var hsErr *HandshakeError
+	if errors.As(err, &hsErr) {
+		switch hsErr.Phase {
+		case PhaseResolve, PhaseConnect, PhaseBanner, PhaseIdentity:
+		default:
+			return false
+		}
+	}
+	if errors.Is(err, ErrRecv) || errors.Is(err, ErrSend) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// NewDialer returns a Dialer without retries.
+func (identity Identity) NewDialer(cb TrustCB, opts ...Option) *Dialer {
+	return &Dialer{
+		Identity: identity,
+		Trust:    cb,
+		Options:  opts,
+	}
+}
+
+// Dial connects to the address on the named network (see net.Dial).
+func (identity Identity) Dial(
+	network, address string,
+	cb TrustCB,
+	opts ...Option,
+) (*Stream, error) {
+	return identity.NewDialer(cb, opts...).Dial(network, address)
+}
+
+func (d *Dialer) Dial(network, address string) (*Stream, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext connects to the address on the named network and performs
+// the handshake, retrying as configured. ctx limits all attempts,
+// including the handshakes.
+func (d *Dialer) DialContext(
+	ctx context.Context,
+	network, address string,
+) (ret *Stream, err error) {
+	delay := d.Backoff
+	for attempt := 0; ; attempt++ {
+		if ret, err = d.dial(ctx, network, address); err == nil {
+			return ret, nil
+		}
+		if attempt >= d.Retries || !IsRetryable(err) {
+			return nil, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// dial makes a single attempt
+func (d *Dialer) dial(
+	ctx context.Context,
+	network, address string,
+) (*Stream, error) {
+	dialer := d.Dialer
+	if d.ResolveTimeout > 0 {
+		dialer.Resolver = d.resolver(time.Now().Add(d.ResolveTimeout))
+	}
+
+	// the socket is created once the address is resolved
+	cfg := config{}
+	for _, opt := range d.Options {
+		opt(&cfg)
+	}
+	timer := cfg.timer()
+	resolved := time.Time{}
+	if timer != nil {
+		mtx := sync.Mutex{}
+		control := dialer.Control
+		dialer.Control = func(network, address string, c syscall.RawConn) error {
+			mtx.Lock()
+			if resolved.IsZero() {
+				resolved = time.Now()
+			}
+			mtx.Unlock()
+			if control != nil {
+				return control(network, address, c)
+			}
+			return nil
+		}
+	}
+
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	// without a call of Control (e.g. if ControlContext is set),
+	// connect includes the resolution
+	if !resolved.IsZero() {
+		timer.lapAt(PhaseResolve, resolved)
+	}
+	timer.lap(PhaseConnect)
+
+	// abort the handshake when ctx is done
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	stream, err := d.Identity.NewStream(conn, d.Trust, d.Options...)
+	close(done)
+	<-stopped
+
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return stream, nil
+}
+
+// resolver returns a resolver whose connections to DNS servers
+// are closed at the deadline
+func (d *Dialer) resolver(deadline time.Time) *net.Resolver {
+	dial := (&net.Dialer{}).DialContext
+	if d.Resolver != nil && d.Resolver.Dial != nil {
+		dial = d.Resolver.Dial
+	}
+
+	ret := &net.Resolver{PreferGo: true}
+	if d.Resolver != nil {
+		ret.StrictErrors = d.Resolver.StrictErrors
+	}
+	ret.Dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+		ctx, cancel := context.WithDeadline(ctx, deadline)
+		defer cancel()
+
+		conn, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		time.AfterFunc(time.Until(deadline), func() { conn.Close() })
+		return conn, nil
+	}
+	return ret
+}
@@ -0,0 +1,6 @@
+package zeolite
+
+// SendChannelFrame sends msg on channel ch even if channels weren't agreed on
+func SendChannelFrame(stream *Stream, ch uint8, msg []byte) error {
+	return stream.sendFrame(FrameChannel, append([]byte{ch}, msg...), TagMessage)
+}
@@ -0,0 +1,11 @@
+//go:build unix
+
+package zeolite
+
+import "syscall"
+
+// SendDataFD sends msg with fd attached, like a peer that passes
+// descriptors along with data frames
+func SendDataFD(stream *Stream, msg []byte, fd int) error {
+	return stream.sendFrameOOB(FrameData, msg, TagMessage, syscall.UnixRights(fd))
+}
@@ -0,0 +1,44 @@
+package zeolite
+
+import "errors"
+
+var (
+	ErrFD         = errors.New("file descriptors require a Unix socket")
+	ErrFDReceived = errors.New("received a file descriptor (see RecvFD)")
+)
+
+// RecvFD receives a file descriptor sent by the peer's SendFD.
+// Like messages, they are received in the order they were sent:
+// if the next message is data instead, it is discarded and ErrProto
+// is returned. Recv returns ErrFDReceived for file descriptors,
+// which can then be received by RecvFD.
+// The caller owns the file descriptor and must close it. Descriptors
+// that are not received before the stream is closed are closed by Close,
+// so are descriptors the peer attached to other frames.
+func (stream *Stream) RecvFD() (int, error) {
+	if stream.fdFrames == 0 {
+		if _, err := stream.Recv(); err == nil {
+			return -1, ErrProto
+		} else if err != ErrFDReceived {
+			return -1, err
+		}
+	}
+
+	stream.fdMtx.Lock()
+	defer stream.fdMtx.Unlock()
+	if len(stream.fds) == 0 {
+		return -1, ErrClosed
+	}
+	stream.fdFrames--
+	fd := stream.fds[0]
+	stream.fds = stream.fds[1:]
+	return fd, nil
+}
+
+// fdBatch holds file descriptors received by one read. end is the number
+// of stream bytes read up to then, so they belong to the frame that
+// contains the last of these bytes.
+type fdBatch struct {
+	end uint64
+	fds []int
+}
@@ -0,0 +1,28 @@
+//go:build !unix
+
+package zeolite
+
+import "io"
+
+// SendFD is only supported on Unix systems.
+func (stream *Stream) SendFD(fd int) error {
+	return ErrFD
+}
+
+func writeOOB(conn io.Writer, buf, oob []byte) error {
+	return ErrFD
+}
+
+func (stream *Stream) connReader(conn io.Reader) io.Reader {
+	return conn
+}
+
+// claimFDs rejects FD frames, which can't carry descriptors here
+func (stream *Stream) claimFDs(typ FrameType) error {
+	if typ == FrameFD {
+		return ErrProto
+	}
+	return nil
+}
+
+func (stream *Stream) closeFDs() {}
@@ -0,0 +1,162 @@
+//go:build unix
+
+package zeolite
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"syscall"
+)
+
+// maxFDs is the number of file descriptors that can be received per read
+const maxFDs = 16
+
+// SendFD sends a duplicate of the open file descriptor fd to the peer,
+// which receives it with RecvFD. This requires a Unix socket and typed
+// frames (see WithFrameTypes). The descriptor is passed by the kernel
+// (SCM_RIGHTS) along with an empty frame that authenticates its position
+// in the stream. fd stays open and may be closed afterwards.
+func (stream *Stream) SendFD(fd int) error {
+	if _, ok := unixConn(stream.Conn); !ok {
+		return ErrFD
+	}
+	if stream.Caps&CapFrameTypes == 0 {
+		return ErrProto
+	}
+	return stream.sendFrameOOB(FrameFD, nil, TagMessage, syscall.UnixRights(fd))
+}
+
+// writeOOB writes buf to a Unix socket, attaching oob to its first byte
+func writeOOB(conn io.Writer, buf, oob []byte) error {
+	uc, ok := unixConn(conn)
+	if !ok {
+		return ErrFD
+	}
+
+	n, oobn, err := uc.WriteMsgUnix(buf, oob, nil)
+	if err != nil || oobn != len(oob) {
+		return ErrSend
+	}
+	return writeAll(conn, buf[n:])
+}
+
+// unixConn returns the Unix socket behind conn. This includes
+// the connections of a Listener with a Fallback, which inspects their
+// first bytes. Other wrappers are left alone, since their Read and Write
+// may do more than pass the data through.
+func unixConn(conn any) (*net.UnixConn, bool) {
+	if peeked, ok := conn.(*peekConn); ok {
+		conn = peeked.Unwrap()
+	}
+	uc, ok := conn.(*net.UnixConn)
+	return uc, ok
+}
+
+// connReader returns the reader for the frames of conn. For Unix sockets,
+// it collects the file descriptors passed along with the data.
+func (stream *Stream) connReader(conn io.Reader) io.Reader {
+	uc, ok := unixConn(conn)
+	if !ok {
+		return conn
+	}
+	rd := &fdReader{
+		conn:   uc,
+		stream: stream,
+		oob:    make([]byte, syscall.CmsgSpace(maxFDs*4)),
+	}
+
+	// inspected bytes that the handshake didn't consume come first
+	if peeked, ok := conn.(*peekConn); ok && peeked.rd.Buffered() > 0 {
+		head := make([]byte, peeked.rd.Buffered())
+		peeked.rd.Read(head)
+		rd.off = uint64(len(head))
+		return io.MultiReader(bytes.NewReader(head), rd)
+	}
+	return rd
+}
+
+// fdReader reads from a Unix socket and keeps received file descriptors
+type fdReader struct {
+	conn   *net.UnixConn
+	stream *Stream
+	oob    []byte
+	off    uint64 // bytes read so far
+}
+
+func (rd *fdReader) Read(p []byte) (int, error) {
+	n, oobn, _, _, err := rd.conn.ReadMsgUnix(p, rd.oob)
+	rd.off += uint64(n)
+	if oobn > 0 {
+		msgs, parseErr := syscall.ParseSocketControlMessage(rd.oob[:oobn])
+		if parseErr != nil {
+			return n, ErrRecv
+		}
+		for _, msg := range msgs {
+			fds, parseErr := syscall.ParseUnixRights(&msg)
+			if parseErr != nil {
+				return n, ErrRecv
+			}
+			rd.stream.addFDs(fdBatch{end: rd.off, fds: fds})
+		}
+	}
+	return n, err
+}
+
+// addFDs keeps received file descriptors until their frame is complete
+func (stream *Stream) addFDs(batch fdBatch) {
+	stream.fdMtx.Lock()
+	defer stream.fdMtx.Unlock()
+	if stream.fdClosed {
+		closeAll(batch.fds)
+		return
+	}
+	stream.fdArrived = append(stream.fdArrived, batch)
+}
+
+// claimFDs assigns the file descriptors that arrived with the frame that
+// was just received. The kernel ends a read after the data that carried
+// descriptors, and SendFD attaches them to the start of its frame, so they
+// arrive by the time the frame is complete. An FD frame keeps exactly
+// one for RecvFD and fails with ErrProto without one; all others are closed.
+func (stream *Stream) claimFDs(typ FrameType) error {
+	end := stream.bytesReceived.Load()
+	stream.fdMtx.Lock()
+	defer stream.fdMtx.Unlock()
+
+	claimed := false
+	for len(stream.fdArrived) > 0 && stream.fdArrived[0].end <= end {
+		fds := stream.fdArrived[0].fds
+		stream.fdArrived = stream.fdArrived[1:]
+		if typ == FrameFD && !claimed && len(fds) > 0 {
+			stream.fds = append(stream.fds, fds[0])
+			fds, claimed = fds[1:], true
+		}
+		closeAll(fds)
+	}
+
+	if typ == FrameFD && !claimed {
+		return ErrProto
+	}
+	return nil
+}
+
+// closeFDs closes all file descriptors that were not received by RecvFD,
+// including those that arrive later
+func (stream *Stream) closeFDs() {
+	stream.fdMtx.Lock()
+	defer stream.fdMtx.Unlock()
+
+	stream.fdClosed = true
+	closeAll(stream.fds)
+	for _, batch := range stream.fdArrived {
+		closeAll(batch.fds)
+	}
+	stream.fds, stream.fdArrived = nil, nil
+}
+
+func closeAll(fds []int) {
+	for _, fd := range fds {
+		syscall.Close(fd)
+	}
+}
@@ -0,0 +1,171 @@
+//go:build unix
+
+package zeolite_test
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/42LoCo42/go-zeolite"
+)
+
+func TestSendFD(t *testing.T) {
+	connA, connB := dialNet(t, "unix", filepath.Join(t.TempDir(), "sock"))
+	opts := []zeolite.Option{zeolite.WithFrameTypes()}
+	a, b := pairOver(t, connA, connB, opts, opts)
+
+	file, err := os.CreateTemp(t.TempDir(), "fd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.WriteString("passed"); err != nil {
+		t.Fatal(err)
+	}
+
+	// file descriptors keep their position among the messages
+	if err := a.Send([]byte("before")); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.SendFD(int(file.Fd())); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Send([]byte("after")); err != nil {
+		t.Fatal(err)
+	}
+
+	if msg, err := b.Recv(); err != nil || string(msg) != "before" {
+		t.Fatalf("expected before, got %q (%v)", msg, err)
+	}
+	if _, err := b.Recv(); err != zeolite.ErrFDReceived {
+		t.Fatalf("expected ErrFDReceived, got %v", err)
+	}
+	fd, err := b.RecvFD()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := b.Recv(); err != nil || string(msg) != "after" {
+		t.Fatalf("expected after, got %q (%v)", msg, err)
+	}
+
+	received := os.NewFile(uintptr(fd), "received")
+	defer received.Close()
+	content, err := io.ReadAll(io.NewSectionReader(received, 0, 6))
+	if err != nil || string(content) != "passed" {
+		t.Fatalf("expected the passed file, got %q (%v)", content, err)
+	}
+}
+
+// pipeClosed fails unless all write ends of the pipe of r are closed
+func pipeClosed(t *testing.T, r *os.File) {
+	t.Helper()
+
+	r.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := r.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the descriptor to be closed, got %v", err)
+	}
+}
+
+func TestSendFDUnclaimed(t *testing.T) {
+	connA, connB := dialNet(t, "unix", filepath.Join(t.TempDir(), "sock"))
+	opts := []zeolite.Option{zeolite.WithFrameTypes()}
+	a, b := pairOver(t, connA, connB, opts, opts)
+
+	// descriptors attached to data frames are closed, not received
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if err := zeolite.SendDataFD(a, []byte("data"), int(w.Fd())); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	if msg, err := b.Recv(); err != nil || string(msg) != "data" {
+		t.Fatalf("expected data, got %q (%v)", msg, err)
+	}
+	pipeClosed(t, r)
+
+	// so are descriptors that were never received by RecvFD
+	r, w, err = os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if err := a.SendFD(int(w.Fd())); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	if _, err := b.Recv(); err != zeolite.ErrFDReceived {
+		t.Fatalf("expected ErrFDReceived, got %v", err)
+	}
+	b.Close()
+	pipeClosed(t, r)
+}
+
+func TestSendFDOverTCP(t *testing.T) {
+	a, _ := pair(t, zeolite.WithFrameTypes())
+	if err := a.SendFD(int(os.Stdin.Fd())); err != zeolite.ErrFD {
+		t.Fatalf("expected ErrFD, got %v", err)
+	}
+}
+
+// a Listener with a Fallback inspects the connections it accepts
+func TestSendFDFallback(t *testing.T) {
+	ids := identities(t, 2)
+	opts := []zeolite.Option{zeolite.WithFrameTypes()}
+	listener, err := ids[0].Listen(
+		"unix", filepath.Join(t.TempDir(), "sock"), trustAll, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	listener.Fallback = func(conn net.Conn) { conn.Close() }
+
+	file, err := os.CreateTemp(t.TempDir(), "fd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.WriteString("passed"); err != nil {
+		t.Fatal(err)
+	}
+
+	sent := make(chan error, 1)
+	go listener.Serve(func(stream *zeolite.Stream) {
+		sent <- stream.SendFD(int(file.Fd()))
+		stream.Recv()
+	})
+
+	stream, err := ids[1].Dial("unix", listener.Addr().String(), trustAll, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+
+	select {
+	case err := <-sent:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream was not served")
+	}
+	if _, err := stream.Recv(); err != zeolite.ErrFDReceived {
+		t.Fatalf("expected ErrFDReceived, got %v", err)
+	}
+	fd, err := stream.RecvFD()
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := os.NewFile(uintptr(fd), "received")
+	defer received.Close()
+	content, err := io.ReadAll(io.NewSectionReader(received, 0, 6))
+	if err != nil || string(content) != "passed" {
+		t.Fatalf("expected the passed file, got %q (%v)", content, err)
+	}
+}
@@ -0,0 +1,259 @@
+package zeolite
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Encrypted data, e.g. files at rest, starts with a header:
+//
+//	magic "ZEOE", version 1, key kind (0 = key, 1 = passphrase)
+//	passphrase only: salt (16), Argon2id ops & mem limits (8 each, LE)
+//	secretstream header (24)
+//
+// It is followed by chunks of a 4-byte little-endian length and a frame
+// of XChaCha20Poly1305 with up to 64 KiB of data. The last one is tagged
+// FINAL, so truncation is detected, and nothing may follow it.
+const (
+	fileMagic   = "ZEOE"
+	fileVersion = 1
+
+	fileKey        = 0
+	filePassphrase = 1
+)
+
+// cryptWriter encrypts everything written to it in chunks
+type cryptWriter struct {
+	w      io.Writer
+	sender Sender
+	buf    []byte
+	closed bool
+}
+
+// NewEncryptWriter returns a writer that encrypts everything written to it
+// with key (e.g. from Identity.SharedKey) and writes the result to w.
+// Close must be called to write the last chunk; w is not closed.
+func NewEncryptWriter(w io.Writer, key SymK) (io.WriteCloser, error) {
+	return newCryptWriter(w, key, []byte{fileKey})
+}
+
+// NewPassphraseEncryptWriter is like NewEncryptWriter, but derives the key
+// from passphrase with Argon2id. The salt & cost are stored in the header.
+func NewPassphraseEncryptWriter(w io.Writer, passphrase []byte) (io.WriteCloser, error) {
+	hdr := make([]byte, 1+saltSize+16)
+	hdr[0] = filePassphrase
+	randomBytes(hdr[1 : 1+saltSize])
+	binary.LittleEndian.PutUint64(hdr[1+saltSize:], opsInteractive)
+	binary.LittleEndian.PutUint64(hdr[1+saltSize+8:], memInteractive)
+
+	key, err := passphraseKey(passphrase, hdr[1:1+saltSize], opsInteractive, memInteractive)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(key[:])
+	return newCryptWriter(w, key, hdr)
+}
+
+func newCryptWriter(w io.Writer, key SymK, kind []byte) (*cryptWriter, error) {
+	sender, header, err := XChaCha20Poly1305.NewSender(key)
+	if err != nil {
+		return nil, err
+	}
+
+	hdr := append([]byte(fileMagic), fileVersion)
+	hdr = append(append(hdr, kind...), header...)
+	if _, err := w.Write(hdr); err != nil {
+		return nil, err
+	}
+	return &cryptWriter{
+		w:      w,
+		sender: sender,
+		buf:    make([]byte, 0, chunkSize),
+	}, nil
+}
+
+func (cw *cryptWriter) Write(p []byte) (n int, err error) {
+	if cw.closed {
+		return 0, ErrClosed
+	}
+	for len(p) > 0 {
+		// keep a full chunk until more data arrives, it may be the last
+		if len(cw.buf) == chunkSize {
+			if err := cw.flush(TagMessage); err != nil {
+				return n, err
+			}
+		}
+
+		m := copy(cw.buf[len(cw.buf):cap(cw.buf)], p)
+		cw.buf, p, n = cw.buf[:len(cw.buf)+m], p[m:], n+m
+	}
+	return n, nil
+}
+
+// Close encrypts the rest of the data as the last chunk
+func (cw *cryptWriter) Close() error {
+	if cw.closed {
+		return nil
+	}
+	cw.closed = true
+	return cw.flush(TagFinal)
+}
+
+func (cw *cryptWriter) flush(tag Tag) error {
+	frame := make([]byte, 4+len(cw.buf)+XChaCha20Poly1305.Overhead())
+	binary.LittleEndian.PutUint32(frame, uint32(len(frame)-4))
+	if err := cw.sender.Seal(frame[4:], cw.buf, tag); err != nil {
+		return err
+	}
+	cw.buf = cw.buf[:0]
+
+	_, err := cw.w.Write(frame)
+	return err
+}
+
+// cryptReader decrypts the chunks read from r
+type cryptReader struct {
+	r        io.Reader
+	receiver Receiver
+	buf      []byte
+	done     bool
+}
+
+// NewDecryptReader returns a reader that decrypts the data of r,
+// which was encrypted by NewEncryptWriter with key.
+// Modified data results in ErrDecrypt, truncated data
+// in io.ErrUnexpectedEOF, data following the last chunk in ErrFormat.
+func NewDecryptReader(r io.Reader, key SymK) (io.Reader, error) {
+	kind, err := readFileHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	if kind != fileKey {
+		return nil, fmt.Errorf("%w: encrypted with a passphrase", ErrDecrypt)
+	}
+	return newCryptReader(r, key)
+}
+
+// NewPassphraseDecryptReader is like NewDecryptReader
+// for data encrypted by NewPassphraseEncryptWriter.
+func NewPassphraseDecryptReader(r io.Reader, passphrase []byte) (io.Reader, error) {
+	kind, err := readFileHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	if kind != filePassphrase {
+		return nil, fmt.Errorf("%w: not encrypted with a passphrase", ErrDecrypt)
+	}
+
+	hdr := make([]byte, saltSize+16)
+	if err := readHeader(r, hdr); err != nil {
+		return nil, err
+	}
+	ops := binary.LittleEndian.Uint64(hdr[saltSize:])
+	mem := binary.LittleEndian.Uint64(hdr[saltSize+8:])
+
+	// don't let the data make us spend unlimited time & memory
+	if ops > opsModerate || mem > memModerate {
+		return nil, ErrFormat
+	}
+
+	key, err := passphraseKey(passphrase, hdr[:saltSize], ops, mem)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(key[:])
+	return newCryptReader(r, key)
+}
+
+// readFileHeader reads the magic & version and returns the key kind
+func readFileHeader(r io.Reader) (byte, error) {
+	hdr := make([]byte, len(fileMagic)+2)
+	if err := readHeader(r, hdr); err != nil {
+		return 0, err
+	}
+	if !bytes.Equal(hdr[:len(fileMagic)], []byte(fileMagic)) ||
+		hdr[len(fileMagic)] != fileVersion {
+		return 0, ErrFormat
+	}
+	return hdr[len(fileMagic)+1], nil
+}
+
+// readHeader fills buf from r. Data too short for it is ErrFormat,
+// errors of r are returned as they are.
+func readHeader(r io.Reader, buf []byte) error {
+	_, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrFormat
+	}
+	return err
+}
+
+func newCryptReader(r io.Reader, key SymK) (*cryptReader, error) {
+	header := make([]byte, XChaCha20Poly1305.HeaderSize())
+	if err := readHeader(r, header); err != nil {
+		return nil, err
+	}
+
+	receiver, err := XChaCha20Poly1305.NewReceiver(key, header)
+	if err != nil {
+		return nil, err
+	}
+	return &cryptReader{r: r, receiver: receiver}, nil
+}
+
+func (cr *cryptReader) Read(p []byte) (int, error) {
+	for len(cr.buf) == 0 {
+		if cr.done {
+			return 0, io.EOF
+		}
+		if err := cr.next(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, cr.buf)
+	cr.buf = cr.buf[n:]
+	return n, nil
+}
+
+// next decrypts the next chunk into buf
+func (cr *cryptReader) next() error {
+	size := [4]byte{}
+	if _, err := io.ReadFull(cr.r, size[:]); err == io.EOF {
+		return io.ErrUnexpectedEOF
+	} else if err != nil {
+		return err
+	}
+
+	siz := int(binary.LittleEndian.Uint32(size[:]))
+	overhead := XChaCha20Poly1305.Overhead()
+	if siz < overhead || siz > chunkSize+overhead {
+		return ErrFormat
+	}
+
+	frame := make([]byte, siz)
+	if _, err := io.ReadFull(cr.r, frame); err == io.EOF {
+		return io.ErrUnexpectedEOF
+	} else if err != nil {
+		return err
+	}
+
+	cr.buf = make([]byte, siz-overhead)
+	tag, err := cr.receiver.Open(cr.buf, frame)
+	if err != nil {
+		return err
+	}
+	if cr.done = tag == TagFinal; !cr.done {
+		return nil
+	}
+
+	// nothing may follow the last chunk
+	if _, err := io.ReadFull(cr.r, size[:1]); err == nil {
+		return ErrFormat
+	} else if err != io.EOF {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package zeolite
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+)
+
+var (
+	ErrExport = errors.New("stream state can't be exported")
+	ErrImport = errors.New("invalid stream state")
+)
+
+// stateVersion 2 added the compression level
+const stateVersion = 2
+
+// Export serializes the state of stream, so that another process can take
+// over the connection (e.g. by passing its file descriptor via SCM_RIGHTS)
+// and continue with ImportStream. No other method of stream may be running
+// or called afterwards. Data that was already read from the connection
+// but not yet received is included.
+//
+// The state contains the session keys: anyone who obtains it can read and
+// forge all further messages of this session, so protect it like a secret key.
+func (stream *Stream) Export() ([]byte, error) {
+	stream.sendMtx.Lock()
+	defer stream.sendMtx.Unlock()
+
+	sender, ok := stream.sender.(encoding.BinaryMarshaler)
+	if !ok {
+		return nil, ErrExport
+	}
+	receiver, ok := stream.receiver.(encoding.BinaryMarshaler)
+	if !ok {
+		return nil, ErrExport
+	}
+	sendState, err := sender.MarshalBinary()
+	if err != nil {
+		return nil, ErrExport
+	}
+	recvState, err := receiver.MarshalBinary()
+	if err != nil {
+		return nil, ErrExport
+	}
+	buffered, _ := stream.reader.Peek(stream.reader.Buffered())
+	// a frame that is partially read already starts from scratch
+	buffered = append(stream.pending[:stream.filled:stream.filled], buffered...)
+
+	buf := []byte{stateVersion}
+	buf = append(buf, stream.OtherPK[:]...)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(stream.Caps))
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(stream.Suite.Cap()))
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(stream.cfg.padding))
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(int32(stream.cfg.level)))
+
+	flags := byte(0)
+	if stream.sendClosed {
+		flags |= 1
+	}
+	if stream.recvClosed.Load() {
+		flags |= 2
+	}
+	buf = append(buf, flags)
+
+	for _, part := range [][]byte{stream.OtherCert, sendState, recvState, buffered} {
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(part)))
+		buf = append(buf, part...)
+	}
+
+	// the state now belongs to someone else
+	stream.sendClosed = true
+	stream.recvClosed.Store(true)
+	return buf, nil
+}
+
+// ImportStream continues a stream exported by Export on conn.
+// Options that don't affect the handshake (like WithRecvLimit) apply as usual;
+// a suite other than the default one must be passed with WithSuite.
+// The compression level is taken from the state. States of version 1,
+// which lack it, are still accepted and use the default level.
+func ImportStream(conn io.ReadWriter, state []byte, opts ...Option) (ret *Stream, err error) {
+	ret = &Stream{Conn: conn, Suite: XChaCha20Poly1305}
+	for _, opt := range opts {
+		opt(&ret.cfg)
+	}
+
+	var rd io.Reader = bytes.NewReader(state)
+	header := struct {
+		Version byte
+		OtherPK SignPK
+		Caps    Caps
+		Suite   Caps
+		Padding uint32
+	}{}
+	if err := binary.Read(rd, binary.LittleEndian, &header); err != nil {
+		return nil, ErrImport
+	}
+	if header.Version != 1 && header.Version != stateVersion {
+		return nil, ErrImport
+	}
+	level := int32(flate.DefaultCompression)
+	if header.Version >= 2 {
+		if err := binary.Read(rd, binary.LittleEndian, &level); err != nil ||
+			level < flate.HuffmanOnly || level > flate.BestCompression {
+			return nil, ErrImport
+		}
+	}
+	var flags byte
+	if err := binary.Read(rd, binary.LittleEndian, &flags); err != nil {
+		return nil, ErrImport
+	}
+
+	parts := make([][]byte, 4)
+	for i := range parts {
+		var size uint32
+		if err := binary.Read(rd, binary.LittleEndian, &size); err != nil {
+			return nil, ErrImport
+		}
+		if int64(size) > int64(len(state)) {
+			return nil, ErrImport
+		}
+		parts[i] = make([]byte, size)
+		if _, err := io.ReadFull(rd, parts[i]); err != nil {
+			return nil, ErrImport
+		}
+	}
+	if n, _ := rd.Read(make([]byte, 1)); n != 0 {
+		return nil, ErrImport
+	}
+
+	if header.Suite != 0 {
+		if ret.cfg.suite == nil || ret.cfg.suite.Cap() != header.Suite {
+			return nil, ErrImport
+		}
+		ret.Suite = ret.cfg.suite
+	}
+	importer, ok := ret.Suite.(StateImporter)
+	if !ok {
+		return nil, ErrImport
+	}
+
+	ret.OtherPK = header.OtherPK
+	ret.Caps = header.Caps
+	ret.protocol = Protocol
+	if ret.Caps != 0 {
+		ret.protocol = ProtocolEx
+	}
+	ret.cfg.padding = int(header.Padding)
+	ret.cfg.level = int(level)
+	ret.sendClosed = flags&1 != 0
+	ret.recvClosed.Store(flags&2 != 0)
+	if len(parts[0]) > 0 {
+		ret.OtherCert = parts[0]
+	}
+	if ret.sender, err = importer.ImportSender(parts[1]); err != nil {
+		return nil, err
+	}
+	if ret.receiver, err = importer.ImportReceiver(parts[2]); err != nil {
+		return nil, err
+	}
+
+	// data buffered by the old process comes first
+	rd = io.MultiReader(bytes.NewReader(parts[3]), ret.connReader(conn))
+	if ret.cfg.bufsize > 0 {
+		ret.reader = bufio.NewReaderSize(rd, ret.cfg.bufsize)
+	} else {
+		ret.reader = bufio.NewReader(rd)
+	}
+	ret.established = time.Now()
+	return ret, nil
+}
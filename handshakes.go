@@ -0,0 +1,59 @@
+package zeolite
+
+import (
+	"net"
+	"sync"
+)
+
+// HandshakeLimiter limits the number of handshakes in progress, in total
+// and per source IP, so that floods of connections can't occupy all CPUs
+// with signature checks & key exchanges.
+type HandshakeLimiter struct {
+	// maximum number of handshakes in total, 0 means no limit
+	Max int
+	// maximum number of handshakes per source IP, 0 means no limit
+	MaxPerIP int
+
+	mtx   sync.Mutex
+	total int
+	perIP map[string]int
+}
+
+func NewHandshakeLimiter(max, maxPerIP int) *HandshakeLimiter {
+	return &HandshakeLimiter{Max: max, MaxPerIP: maxPerIP}
+}
+
+// Acquire reserves a handshake for the source of addr
+// and reports whether one was available.
+// Successful calls must be followed by Release.
+func (h *HandshakeLimiter) Acquire(addr net.Addr) bool {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	key := sourceIP(addr)
+	if h.Max > 0 && h.total >= h.Max {
+		return false
+	}
+	if h.MaxPerIP > 0 && h.perIP[key] >= h.MaxPerIP {
+		return false
+	}
+
+	if h.perIP == nil {
+		h.perIP = map[string]int{}
+	}
+	h.total++
+	h.perIP[key]++
+	return true
+}
+
+// Release ends a handshake reserved by Acquire
+func (h *HandshakeLimiter) Release(addr net.Addr) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	key := sourceIP(addr)
+	h.total--
+	if h.perIP[key]--; h.perIP[key] <= 0 {
+		delete(h.perIP, key)
+	}
+}
@@ -0,0 +1,56 @@
+package zeolite
+
+// MaxHelloBytes is the maximum size of a hello (see WithHello).
+const MaxHelloBytes = 4096
+
+// helloSlack covers the framing around an unpadded hello: the type byte
+// and the expansion of incompressible data by DEFLATE
+const helloSlack = 64
+
+// WithHello sends hello to the peer as part of the handshake, e.g. a
+// version, an auth token or the requested service, saving a round trip.
+// It is sent as the first message after the keys are established, so it
+// is encrypted like all messages, and the hello of the peer is available
+// in Stream.OtherHello once NewStream returns. hello may be empty, and
+// must not be longer than MaxHelloBytes, otherwise NewStream fails with
+// ErrProto; so does a longer hello of the peer.
+//
+// Hellos are only exchanged if the peer offers them too. Otherwise,
+// OtherHello is nil and hello is not sent; applications that depend on
+// it must check Caps for CapHello.
+func WithHello(hello []byte) Option {
+	return func(cfg *config) {
+		cfg.caps |= CapHello
+		cfg.hello = hello
+	}
+}
+
+// exchangeHello sends our hello and receives the one of the peer
+func (stream *Stream) exchangeHello() error {
+	if err := stream.sendFrame(FrameData, stream.cfg.hello, TagMessage); err != nil {
+		return err
+	}
+
+	// No other frame may come first, and only a small one. The peer pads
+	// to its own block size, which we don't know, so with padding only
+	// the receive limit applies to the frame and the hello is checked
+	// once it is unpadded.
+	limit := stream.cfg.limit
+	if stream.Caps&CapPadding == 0 {
+		stream.cfg.limit = MaxHelloBytes + helloSlack
+	}
+	hello, err := stream.recv(nil)
+	stream.cfg.limit = limit
+
+	switch {
+	case err == ErrEOS || err == ErrChannel || err == ErrFDReceived ||
+		err == ErrBufferFull:
+		return ErrProto
+	case err != nil:
+		return err
+	case len(hello) > MaxHelloBytes:
+		return ErrProto
+	}
+	stream.OtherHello = append([]byte{}, hello...)
+	return nil
+}
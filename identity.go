@@ -0,0 +1,121 @@
+package zeolite
+
+import (
+	// #include <sodium.h>
+	"C"
+
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrIdentity = errors.New("invalid identity")
+
+// ErrKeyMismatch is returned if the public key of an identity doesn't
+// belong to its secret key, e.g. because the identity file is corrupted.
+// It matches ErrIdentity too.
+var ErrKeyMismatch = fmt.Errorf("%w: public/secret key mismatch", ErrIdentity)
+
+// Seed is the secret from which an identity is derived.
+type Seed [C.crypto_sign_SEEDBYTES]byte
+
+// NewIdentityFromSeed derives an identity from seed.
+// The same seed always results in the same identity.
+func NewIdentityFromSeed(seed Seed) (ret Identity, err error) {
+	if C.crypto_sign_seed_keypair(
+		ptr(ret.Public[:]),
+		ptr(ret.Secret[:]),
+		ptr(seed[:]),
+	) != 0 {
+		return ret, ErrKeygen
+	}
+	return ret, nil
+}
+
+// Seed returns the seed from which identity can be derived again
+// (see NewIdentityFromSeed). The secret key contains it,
+// so this works for every identity.
+func (identity Identity) Seed() (ret Seed) {
+	C.crypto_sign_ed25519_sk_to_seed(ptr(ret[:]), ptr(identity.Secret[:]))
+	return ret
+}
+
+// Equal reports whether identity and other are the same,
+// in constant time.
+func (identity Identity) Equal(other Identity) bool {
+	public := subtle.ConstantTimeCompare(identity.Public[:], other.Public[:])
+	secret := subtle.ConstantTimeCompare(identity.Secret[:], other.Secret[:])
+	return public&secret == 1
+}
+
+// Equal reports whether pk and other are the same key, in constant time.
+// Use it instead of == for trust decisions.
+func (pk SignPK) Equal(other SignPK) bool {
+	return subtle.ConstantTimeCompare(pk[:], other[:]) == 1
+}
+
+// Validate checks that the public key of identity belongs to its secret key.
+func (identity Identity) Validate() error {
+	derived, err := NewIdentityFromSeed(identity.Seed())
+	if err != nil {
+		return err
+	}
+	if !derived.Equal(identity) {
+		return ErrKeyMismatch
+	}
+	return nil
+}
+
+// LoadIdentity parses an identity in its raw form (public part first)
+// and checks that both parts belong together (see Validate). Otherwise,
+// peers would only notice when verifying our signatures.
+func LoadIdentity(raw []byte) (ret Identity, err error) {
+	if len(raw) != len(ret.Public)+len(ret.Secret) {
+		return ret, ErrIdentity
+	}
+
+	copy(ret.Public[:], raw)
+	copy(ret.Secret[:], raw[len(ret.Public):])
+	return ret, ret.Validate()
+}
+
+// Base64 formats identity as "<public>-<secret>", both base64-encoded.
+func (identity Identity) Base64() string {
+	return Base64Enc(identity.Public[:]) + "-" + Base64Enc(identity.Secret[:])
+}
+
+// ParseIdentityBase64 parses an identity in the form created by Base64.
+func ParseIdentityBase64(b64 string) (ret Identity, err error) {
+	parts := strings.Split(strings.TrimSpace(b64), "-")
+	if len(parts) != 2 {
+		return ret, ErrIdentity
+	}
+
+	public, err := Base64Dec(parts[0])
+	if err != nil || len(public) != len(ret.Public) {
+		return ret, ErrIdentity
+	}
+	secret, err := Base64Dec(parts[1])
+	if err != nil || len(secret) != len(ret.Secret) {
+		return ret, ErrIdentity
+	}
+
+	copy(ret.Public[:], public)
+	copy(ret.Secret[:], secret)
+	return ret, nil
+}
+
+// ParseIdentityHex parses an identity from the hex encoding
+// of its raw form (public part first).
+func ParseIdentityHex(str string) (ret Identity, err error) {
+	raw, err := hex.DecodeString(strings.TrimSpace(str))
+	if err != nil || len(raw) != len(ret.Public)+len(ret.Secret) {
+		return ret, ErrIdentity
+	}
+
+	copy(ret.Public[:], raw)
+	copy(ret.Secret[:], raw[len(ret.Public):])
+	return ret, nil
+}
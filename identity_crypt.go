@@ -0,0 +1,104 @@
+package zeolite
+
+import (
+	// #include <sodium.h>
+	"C"
+
+	"unsafe"
+)
+
+// encryptedVersion is the first byte of an encrypted identity
+const encryptedVersion = 1
+
+const (
+	saltSize  = C.crypto_pwhash_SALTBYTES
+	nonceSize = C.crypto_secretbox_NONCEBYTES
+	boxSize   = C.crypto_secretbox_MACBYTES + C.crypto_sign_SEEDBYTES
+)
+
+// Encrypt protects identity with passphrase for storage or transport.
+// Only the seed is stored (see Seed), encrypted with XSalsa20-Poly1305
+// under a key derived from passphrase by Argon2id. The result contains
+// a version byte, the salt and the nonce; see DecryptIdentity.
+func (identity Identity) Encrypt(passphrase []byte) ([]byte, error) {
+	ret := make([]byte, 1+saltSize+nonceSize+boxSize)
+	ret[0] = encryptedVersion
+	salt := ret[1 : 1+saltSize]
+	nonce := ret[1+saltSize : 1+saltSize+nonceSize]
+	box := ret[1+saltSize+nonceSize:]
+
+	randomBytes(salt)
+	randomBytes(nonce)
+
+	key, err := passphraseKey(passphrase, salt, opsInteractive, memInteractive)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(key[:])
+
+	seed := identity.Seed()
+	if C.crypto_secretbox_easy(
+		ptr(box), ptr(seed[:]), size(seed[:]), ptr(nonce), ptr(key[:]),
+	) != 0 {
+		return nil, ErrEncrypt
+	}
+	return ret, nil
+}
+
+// DecryptIdentity restores an identity encrypted by Encrypt.
+// A wrong passphrase or modified data result in ErrDecrypt.
+func DecryptIdentity(data, passphrase []byte) (ret Identity, err error) {
+	if len(data) != 1+saltSize+nonceSize+boxSize || data[0] != encryptedVersion {
+		return ret, ErrIdentity
+	}
+	salt := data[1 : 1+saltSize]
+	nonce := data[1+saltSize : 1+saltSize+nonceSize]
+	box := data[1+saltSize+nonceSize:]
+
+	key, err := passphraseKey(passphrase, salt, opsInteractive, memInteractive)
+	if err != nil {
+		return ret, err
+	}
+	defer wipe(key[:])
+
+	seed := Seed{}
+	if C.crypto_secretbox_open_easy(
+		ptr(seed[:]), ptr(box), size(box), ptr(nonce), ptr(key[:]),
+	) != 0 {
+		return ret, ErrDecrypt
+	}
+	return NewIdentityFromSeed(seed)
+}
+
+// cost parameters of Argon2id
+const (
+	opsInteractive = C.crypto_pwhash_OPSLIMIT_INTERACTIVE
+	memInteractive = C.crypto_pwhash_MEMLIMIT_INTERACTIVE
+	opsModerate    = C.crypto_pwhash_OPSLIMIT_MODERATE
+	memModerate    = C.crypto_pwhash_MEMLIMIT_MODERATE
+)
+
+// passphraseKey derives a key from passphrase with Argon2id
+func passphraseKey(passphrase, salt []byte, ops, mem uint64) (key SymK, err error) {
+	if C.crypto_pwhash(
+		ptr(key[:]), C.ulonglong(len(key)),
+		(*C.char)(unsafe.Pointer(ptr(passphrase))), size(passphrase),
+		ptr(salt),
+		C.ulonglong(ops),
+		C.size_t(mem),
+		C.crypto_pwhash_ALG_ARGON2ID13,
+	) != 0 {
+		return key, ErrKeygen
+	}
+	return key, nil
+}
+
+// randomBytes fills buf with random data
+func randomBytes(buf []byte) {
+	C.randombytes_buf(unsafe.Pointer(&buf[0]), C.size_t(len(buf)))
+}
+
+// wipe overwrites secret data in buf with zeros
+func wipe(buf []byte) {
+	C.sodium_memzero(unsafe.Pointer(&buf[0]), C.size_t(len(buf)))
+}
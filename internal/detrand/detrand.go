@@ -0,0 +1,74 @@
+// Package detrand makes all randomness of libsodium derive from a seed.
+// This is only meant for reproducible test vectors, so only tests may
+// import it: it is never part of the library or the CLI.
+package detrand
+
+import (
+	// #include <string.h>
+	// #include <sodium.h>
+	//
+	// static unsigned char det_seed[randombytes_SEEDBYTES];
+	// static unsigned char det_counter[8];
+	// static randombytes_implementation *det_prev;
+	//
+	// static const char *det_name(void) {
+	// 	return "zeolite-deterministic";
+	// }
+	//
+	// // every call uses a new seed: hash(counter, key = base seed)
+	// static void det_buf(void * const buf, const size_t size) {
+	// 	unsigned char seed[randombytes_SEEDBYTES];
+	// 	crypto_generichash(seed, sizeof seed,
+	// 		det_counter, sizeof det_counter, det_seed, sizeof det_seed);
+	// 	sodium_increment(det_counter, sizeof det_counter);
+	// 	randombytes_buf_deterministic(buf, size, seed);
+	// }
+	//
+	// static uint32_t det_random(void) {
+	// 	unsigned char r[4];
+	// 	det_buf(r, sizeof r);
+	// 	return r[0] | r[1] << 8 | r[2] << 16 | (uint32_t) r[3] << 24;
+	// }
+	//
+	// static randombytes_implementation det_impl = {
+	// 	det_name, det_random, NULL, NULL, det_buf, NULL,
+	// };
+	//
+	// // libsodium can't return the current implementation,
+	// // only its name, so only the built-in ones can be restored
+	// static int det_enable(const unsigned char *seed) {
+	// 	const char *name = randombytes_implementation_name();
+	// 	if (strcmp(name, "sysrandom") == 0) {
+	// 		det_prev = &randombytes_sysrandom_implementation;
+	// 	} else if (strcmp(name, "internal") == 0) {
+	// 		det_prev = &randombytes_internal_implementation;
+	// 	} else {
+	// 		return -1;
+	// 	}
+	//
+	// 	memcpy(det_seed, seed, sizeof det_seed);
+	// 	memset(det_counter, 0, sizeof det_counter);
+	// 	return randombytes_set_implementation(&det_impl);
+	// }
+	//
+	// static void det_disable(void) {
+	// 	randombytes_set_implementation(det_prev);
+	// }
+	"C"
+	"errors"
+	"unsafe"
+)
+
+// Seed is the origin of all randomness while Enable is in effect
+type Seed [C.randombytes_SEEDBYTES]byte
+
+// Enable makes all randomness of libsodium derive from seed, until
+// restore is called. It fails if the current implementation of libsodium
+// is not a built-in one, which couldn't be restored.
+func Enable(seed Seed) (restore func(), err error) {
+	if C.det_enable((*C.uchar)(unsafe.Pointer(&seed[0]))) != 0 {
+		return nil, errors.New("can't replace the randomness of libsodium: " +
+			C.GoString(C.randombytes_implementation_name()))
+	}
+	return func() { C.det_disable() }, nil
+}
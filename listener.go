@@ -0,0 +1,481 @@
+package zeolite
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// peekTimeout limits how long a Listener with a Fallback waits for the
+// first bytes of a connection if HandshakeTimeout isn't set
+const peekTimeout = 10 * time.Second
+
+// Listener accepts connections and performs the handshake on them.
+type Listener struct {
+	net.Listener
+	Identity Identity
+	Trust    TrustCB
+	Options  []Option
+
+	// ErrorLog receives errors of accepting, handshakes & handlers.
+	// If nil, errors are discarded.
+	ErrorLog *log.Logger
+
+	// Metrics receives statistics of all connections & streams.
+	Metrics *Metrics
+
+	// RateLimit, if set, closes connections from sources that connect
+	// too often before doing the (expensive) handshake.
+	RateLimit *RateLimiter
+
+	// Handshakes, if set, limits the number of concurrent handshakes.
+	// Connections exceeding it are closed right away.
+	Handshakes *HandshakeLimiter
+
+	// HandshakeWorkers, if set, is the number of handshakes that run
+	// in parallel. Unlike with Handshakes, further connections aren't
+	// rejected but wait for a free worker (at most until HandshakeTimeout),
+	// so accepting stays fast while the CPU time spent on the expensive
+	// crypto is bounded. A worker is busy for the whole handshake,
+	// including network round trips and the trust callback, so use more
+	// workers than runtime.NumCPU(); the CLI defaults to four per CPU.
+	HandshakeWorkers int
+
+	// HandshakeQueue, if set, limits the number of connections waiting
+	// for a handshake worker. Connections exceeding it are closed.
+	HandshakeQueue int
+
+	// HandshakeTimeout, if set, limits the time from accepting
+	// a connection until the handshake is done. Together with Handshakes,
+	// this keeps stalling peers from blocking others. The time spent in the
+	// trust callback doesn't count, since it doesn't depend on the peer
+	// (see WithTrustTimeout to limit it).
+	HandshakeTimeout time.Duration
+
+	// ProxyProtocol requires every connection to start with a PROXY
+	// protocol header (see ReadProxyHeader), whose source address then
+	// replaces the one of the connection, e.g. for RateLimit and TrustFor.
+	// Connections without a valid header are closed. Only enable this
+	// behind a proxy, since direct peers could claim any address.
+	ProxyProtocol bool
+
+	// DSCP, if set, marks the packets of all connections (see SetDSCP).
+	DSCP int
+
+	// TrustFor, if set, returns the trust callback for a connection
+	// instead of Trust, e.g. to include the peer's address in the decision.
+	TrustFor func(conn net.Conn) TrustCB
+
+	// Fallback, if set, is called with connections that don't start with
+	// a zeolite banner, e.g. to serve HTTP health checks on the same port.
+	// The connection still delivers the bytes that were inspected
+	// and is closed when Fallback returns. Peers must send their first
+	// bytes within HandshakeTimeout (or 10 seconds if it isn't set).
+	Fallback func(conn net.Conn)
+
+	// Reauthorize, if set, is the interval at which the trust of connected
+	// peers is checked again (see Stream.Reauthorize). Connections of peers
+	// that are no longer trusted are closed.
+	Reauthorize time.Duration
+
+	// DrainTimeout limits how long ServeContext waits for running
+	// handlers after its context is done. Zero means no limit.
+	DrainTimeout time.Duration
+
+	mtx     sync.Mutex
+	conns   map[net.Conn]struct{}
+	streams map[*Stream]struct{}
+
+	workers chan struct{} // one element per busy handshake worker
+	waiting atomic.Int64  // connections waiting for a worker
+}
+
+// Listen announces on the local network address (see net.Listen).
+func (identity Identity) Listen(
+	network, address string,
+	cb TrustCB,
+	opts ...Option,
+) (*Listener, error) {
+	inner, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return identity.NewListener(inner, cb, opts...), nil
+}
+
+// NewListener wraps an existing listener.
+func (identity Identity) NewListener(
+	inner net.Listener,
+	cb TrustCB,
+	opts ...Option,
+) *Listener {
+	return &Listener{
+		Listener: inner,
+		Identity: identity,
+		Trust:    cb,
+		Options:  opts,
+	}
+}
+
+func (l *Listener) logf(format string, args ...any) {
+	if l.ErrorLog != nil {
+		l.ErrorLog.Printf(format, args...)
+	}
+}
+
+// Serve accepts connections until the listener is closed. Every connection
+// is handled in its own goroutine: after a successful handshake,
+// handler is called with the stream. The connection is closed when
+// handler returns. A panicking handler is logged and doesn't affect others.
+func (l *Listener) Serve(handler func(*Stream)) error {
+	return l.ServeContext(context.Background(), handler)
+}
+
+// ServeContext is like Serve, but stops accepting connections once ctx is
+// done. It then waits for all running handlers to return (at most for
+// DrainTimeout, after which their connections are closed) and returns
+// the error of ctx.
+func (l *Listener) ServeContext(ctx context.Context, handler func(*Stream)) error {
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			l.Close()
+		case <-stop:
+		}
+	}()
+
+	if l.HandshakeWorkers > 0 {
+		l.workers = make(chan struct{}, l.HandshakeWorkers)
+	}
+
+	wg := sync.WaitGroup{}
+	delay := time.Duration(0)
+
+	for {
+		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			if ctx.Err() != nil {
+				l.drain(&wg)
+				return ctx.Err()
+			}
+			return err
+		} else if err != nil {
+			// back off on errors like running out of file descriptors
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else if delay < time.Second {
+				delay *= 2
+			}
+			l.logf("accept: %v", err)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+
+		// with PROXY headers, the real address is only known in handle
+		if !l.ProxyProtocol && !l.allow(conn) {
+			conn.Close()
+			continue
+		}
+
+		l.track(conn, true)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer l.track(conn, false)
+			l.handle(conn, handler)
+		}()
+	}
+}
+
+// allow checks the rate limit for conn
+func (l *Listener) allow(conn net.Conn) bool {
+	if l.RateLimit != nil && !l.RateLimit.Allow(conn.RemoteAddr()) {
+		l.logf("rate limit exceeded by %v", conn.RemoteAddr())
+		return false
+	}
+	return true
+}
+
+// track adds or removes an active connection
+func (l *Listener) track(conn net.Conn, add bool) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if l.conns == nil {
+		l.conns = map[net.Conn]struct{}{}
+	}
+	if add {
+		l.conns[conn] = struct{}{}
+	} else {
+		delete(l.conns, conn)
+	}
+}
+
+// Streams returns the streams whose handlers are currently running,
+// e.g. to list the connected peers (see Stream.DebugState).
+func (l *Listener) Streams() []*Stream {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	ret := make([]*Stream, 0, len(l.streams))
+	for stream := range l.streams {
+		ret = append(ret, stream)
+	}
+	return ret
+}
+
+// trackStream adds or removes the stream of a running handler
+func (l *Listener) trackStream(stream *Stream, add bool) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if l.streams == nil {
+		l.streams = map[*Stream]struct{}{}
+	}
+	if add {
+		l.streams[stream] = struct{}{}
+	} else {
+		delete(l.streams, stream)
+	}
+}
+
+// drain waits for all handlers, closing their connections after DrainTimeout
+func (l *Listener) drain(wg *sync.WaitGroup) {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	if l.DrainTimeout <= 0 {
+		<-done
+		return
+	}
+
+	timer := time.NewTimer(l.DrainTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-done:
+	case <-timer.C:
+		l.mtx.Lock()
+		for conn := range l.conns {
+			conn.Close()
+		}
+		l.logf("drain timeout: closed %d connections", len(l.conns))
+		l.mtx.Unlock()
+	}
+}
+
+func (l *Listener) handle(conn net.Conn, handler func(*Stream)) {
+	l.Metrics.connOpened()
+	defer l.Metrics.connClosed()
+	defer conn.Close()
+	defer func() {
+		if err := recover(); err != nil {
+			l.logf("handler for %v: panic: %v", conn.RemoteAddr(), err)
+		}
+	}()
+
+	if l.DSCP != 0 {
+		if err := SetDSCP(conn, l.DSCP); err != nil {
+			l.logf("DSCP for %v: %v", conn.RemoteAddr(), err)
+		}
+	}
+
+	var deadline time.Time
+	if l.HandshakeTimeout > 0 {
+		deadline = time.Now().Add(l.HandshakeTimeout)
+		conn.SetDeadline(deadline)
+	}
+
+	// hold a handshake slot until the handshake is done
+	var slot net.Addr
+	release := func() {
+		if slot != nil {
+			l.Handshakes.Release(slot)
+			slot = nil
+		}
+	}
+	defer release()
+	acquire := func() bool {
+		if l.Handshakes == nil {
+			return true
+		}
+		if !l.Handshakes.Acquire(conn.RemoteAddr()) {
+			l.logf("too many handshakes, rejecting %v", conn.RemoteAddr())
+			return false
+		}
+		slot = conn.RemoteAddr()
+		return true
+	}
+
+	// with PROXY headers, the real address is only known afterwards
+	if !l.ProxyProtocol && !acquire() {
+		return
+	}
+
+	if l.ProxyProtocol {
+		proxied, err := ReadProxyHeader(conn)
+		if err != nil {
+			l.logf("PROXY header from %v: %v", conn.RemoteAddr(), err)
+			return
+		}
+		if conn = proxied; !l.allow(conn) || !acquire() {
+			return
+		}
+	}
+
+	if l.Fallback != nil {
+		// peers that send nothing mustn't block forever
+		if l.HandshakeTimeout <= 0 {
+			conn.SetDeadline(time.Now().Add(peekTimeout))
+		}
+		peeked := &peekConn{Conn: conn, rd: bufio.NewReaderSize(conn, 16)}
+		head, _ := peeked.rd.Peek(len(Protocol))
+		if l.HandshakeTimeout <= 0 {
+			conn.SetDeadline(time.Time{})
+		}
+		if conn = peeked; string(head) != Protocol && string(head) != ProtocolEx {
+			release()
+			conn.SetDeadline(time.Time{})
+			l.Fallback(conn)
+			return
+		}
+	}
+
+	opts := l.Options
+	if l.Metrics != nil {
+		opts = append(opts[:len(opts):len(opts)], WithMetrics(l.Metrics))
+	}
+
+	trust := l.Trust
+	if l.TrustFor != nil {
+		trust = l.TrustFor(conn)
+	}
+
+	// pause the deadline while the trust callback runs
+	hsTrust := trust
+	if l.HandshakeTimeout > 0 {
+		hsTrust = func(otherPK SignPK) (bool, error) {
+			remaining := time.Until(deadline)
+			conn.SetDeadline(time.Time{})
+			defer func() { conn.SetDeadline(time.Now().Add(remaining)) }()
+			return trust(otherPK)
+		}
+	}
+
+	if !l.acquireWorker(deadline) {
+		l.logf("no handshake worker for %v", conn.RemoteAddr())
+		return
+	}
+	stream, err := l.Identity.NewStream(conn, hsTrust, opts...)
+	l.releaseWorker()
+	release()
+	if err != nil {
+		l.logf("handshake with %v: %v", conn.RemoteAddr(), err)
+		return
+	}
+	if l.HandshakeTimeout > 0 {
+		conn.SetDeadline(time.Time{})
+	}
+
+	if l.Reauthorize > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go l.reauthorize(conn, stream, trust, done)
+	}
+
+	l.trackStream(stream, true)
+	defer l.trackStream(stream, false)
+	handler(stream)
+}
+
+// acquireWorker waits for a free handshake worker until deadline
+// (if set) and reports whether one was available.
+// Successful calls must be followed by releaseWorker.
+func (l *Listener) acquireWorker(deadline time.Time) bool {
+	if l.workers == nil {
+		return true
+	}
+
+	// fast path without queueing
+	select {
+	case l.workers <- struct{}{}:
+		return true
+	default:
+	}
+
+	defer l.waiting.Add(-1)
+	if n := l.waiting.Add(1); l.HandshakeQueue > 0 && n > int64(l.HandshakeQueue) {
+		return false
+	}
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case l.workers <- struct{}{}:
+		return true
+	case <-timeout:
+		return false
+	}
+}
+
+// releaseWorker frees a handshake worker reserved by acquireWorker
+func (l *Listener) releaseWorker() {
+	if l.workers != nil {
+		<-l.workers
+	}
+}
+
+// reauthorize closes conn once its peer is no longer trusted
+func (l *Listener) reauthorize(
+	conn net.Conn,
+	stream *Stream,
+	trust TrustCB,
+	done <-chan struct{},
+) {
+	ticker := time.NewTicker(l.Reauthorize)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := stream.Reauthorize(trust); err != nil {
+				l.logf("reauthorization of %v: %v", conn.RemoteAddr(), err)
+				conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// peekConn is a connection whose first bytes were inspected
+type peekConn struct {
+	net.Conn
+	rd *bufio.Reader
+}
+
+func (conn *peekConn) Read(p []byte) (int, error) {
+	return conn.rd.Read(p)
+}
+
+// Unwrap returns the inspected connection
+func (conn *peekConn) Unwrap() net.Conn {
+	return conn.Conn
+}
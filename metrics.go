@@ -0,0 +1,107 @@
+package zeolite
+
+import (
+	"errors"
+)
+
+// Counter is a monotonically increasing value, like prometheus.Counter.
+type Counter interface {
+	Add(float64)
+}
+
+// Gauge is a value that can go up and down, like prometheus.Gauge.
+type Gauge interface {
+	Add(float64)
+}
+
+// Metrics collects statistics of streams and listeners.
+// Nil fields (or a nil *Metrics) are ignored, so only the wanted ones
+// need to be set. All values must be safe for concurrent use.
+type Metrics struct {
+	// connections accepted by a Listener
+	Connections Counter
+	// connections currently handled by a Listener
+	ActiveConnections Gauge
+
+	// failed handshakes by reason, e.g. CounterVec.WithLabelValues
+	HandshakeFailures func(reason string) Counter
+
+	// message bytes before compression/after decompression
+	BytesSent     Counter
+	BytesReceived Counter
+
+	// frames that could not be decrypted (tampering or corruption)
+	DecryptFailures Counter
+
+	// rekeys of the stream keys, sent or received (see Rekey)
+	Rekeys Counter
+}
+
+// WithMetrics reports the statistics of the stream to metrics.
+func WithMetrics(metrics *Metrics) Option {
+	return func(cfg *config) {
+		cfg.metrics = metrics
+	}
+}
+
+func add(counter Counter, val float64) {
+	if counter != nil {
+		counter.Add(val)
+	}
+}
+
+func (m *Metrics) connOpened() {
+	if m != nil {
+		add(m.Connections, 1)
+		add(m.ActiveConnections, 1)
+	}
+}
+
+func (m *Metrics) connClosed() {
+	if m != nil {
+		add(m.ActiveConnections, -1)
+	}
+}
+
+func (m *Metrics) handshakeFailed(err error) {
+	if m != nil && m.HandshakeFailures != nil {
+		add(m.HandshakeFailures(reason(err)), 1)
+	}
+}
+
+func (m *Metrics) sent(n int) {
+	if m != nil {
+		add(m.BytesSent, float64(n))
+	}
+}
+
+func (m *Metrics) received(n int) {
+	if m != nil {
+		add(m.BytesReceived, float64(n))
+	}
+}
+
+func (m *Metrics) decryptFailed() {
+	if m != nil {
+		add(m.DecryptFailures, 1)
+	}
+}
+
+func (m *Metrics) rekeyed() {
+	if m != nil {
+		add(m.Rekeys, 1)
+	}
+}
+
+// reason maps an error to a label with bounded cardinality
+func reason(err error) string {
+	for _, known := range []error{
+		ErrRecv, ErrSend, ErrProto, ErrKeygen, ErrTrust,
+		ErrSign, ErrVerify, ErrEncrypt, ErrDecrypt,
+	} {
+		if errors.Is(err, known) {
+			return known.Error()
+		}
+	}
+	return "other"
+}
@@ -0,0 +1,132 @@
+package zeolite
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var ErrProxyHeader = errors.New("invalid PROXY protocol header")
+
+var proxySignature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ProxyConn is a connection whose real source was announced in a
+// PROXY protocol header (as sent by e.g. HAProxy or AWS NLB).
+type ProxyConn struct {
+	net.Conn
+	Source net.Addr
+}
+
+// RemoteAddr returns the real source of the connection.
+func (conn *ProxyConn) RemoteAddr() net.Addr {
+	return conn.Source
+}
+
+// ReadProxyHeader reads a PROXY protocol header (version 1 or 2) from conn
+// and returns a connection that reports the announced source as its
+// RemoteAddr. Headers without a source (like LOCAL or UNKNOWN)
+// keep the address of conn. Nothing beyond the header is read.
+func ReadProxyHeader(conn net.Conn) (*ProxyConn, error) {
+	ret := &ProxyConn{Conn: conn, Source: conn.RemoteAddr()}
+
+	buf := make([]byte, len(proxySignature))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, ErrProxyHeader
+	}
+
+	var err error
+	if bytes.Equal(buf, proxySignature) {
+		err = readProxyV2(conn, ret)
+	} else if bytes.HasPrefix(buf, []byte("PROXY ")) {
+		err = readProxyV1(conn, buf, ret)
+	} else {
+		err = ErrProxyHeader
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// readProxyV1 parses a line like "PROXY TCP4 <src> <dst> <sport> <dport>"
+func readProxyV1(conn net.Conn, line []byte, ret *ProxyConn) error {
+	// the line is at most 107 bytes long
+	// read it bytewise to not consume any data after it
+	b := []byte{0}
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= 107 {
+			return ErrProxyHeader
+		}
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return ErrProxyHeader
+		}
+		line = append(line, b[0])
+	}
+
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	switch {
+	case len(fields) >= 2 && fields[1] == "UNKNOWN":
+		return nil
+	case len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6"):
+		return ErrProxyHeader
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil || (ip.To4() != nil) != (fields[1] == "TCP4") {
+		return ErrProxyHeader
+	}
+	ret.Source = &net.TCPAddr{IP: ip, Port: int(port)}
+	return nil
+}
+
+// readProxyV2 parses the binary header following the signature
+func readProxyV2(conn net.Conn, ret *ProxyConn) error {
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return ErrProxyHeader
+	}
+	if head[0]>>4 != 2 {
+		return ErrProxyHeader
+	}
+
+	body := make([]byte, binary.BigEndian.Uint16(head[2:]))
+	if _, err := io.ReadFull(conn, body); err != nil {
+		return ErrProxyHeader
+	}
+
+	switch head[0] & 0xf {
+	case 0: // LOCAL, e.g. health checks
+		return nil
+	case 1: // PROXY
+	default:
+		return ErrProxyHeader
+	}
+
+	// source address & port, the rest (destination & TLVs) is ignored
+	var ipLen int
+	switch head[1] >> 4 {
+	case 1:
+		ipLen = net.IPv4len
+	case 2:
+		ipLen = net.IPv6len
+	default: // unspecified or Unix, keep the address of conn
+		return nil
+	}
+	if len(body) < 2*ipLen+4 {
+		return ErrProxyHeader
+	}
+
+	ip := net.IP(body[:ipLen])
+	port := int(binary.BigEndian.Uint16(body[2*ipLen:]))
+	if head[1]&0xf == 2 {
+		ret.Source = &net.UDPAddr{IP: ip, Port: port}
+	} else {
+		ret.Source = &net.TCPAddr{IP: ip, Port: port}
+	}
+	return nil
+}
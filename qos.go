@@ -0,0 +1,54 @@
+package zeolite
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+var ErrDSCP = errors.New("invalid DSCP value")
+
+// SetDSCP marks all further packets of the underlying connection with the
+// given Differentiated Services Code Point (0-63), e.g. 46 (EF) for
+// interactive traffic. It does nothing for connections that aren't
+// IP sockets or on systems where this is unsupported.
+func (stream *Stream) SetDSCP(dscp int) error {
+	return SetDSCP(stream.Conn, dscp)
+}
+
+// SetDSCP is like Stream.SetDSCP, but works on any connection.
+func SetDSCP(conn any, dscp int) error {
+	if dscp < 0 || dscp > 63 {
+		return ErrDSCP
+	}
+
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	ipv6 := false
+	if c, ok := conn.(net.Conn); ok {
+		switch addr := c.LocalAddr().(type) {
+		case *net.TCPAddr:
+			ipv6 = addr.IP.To4() == nil
+		case *net.UDPAddr:
+			ipv6 = addr.IP.To4() == nil
+		default:
+			return nil
+		}
+	}
+
+	// the DSCP are the upper 6 bits of the TOS/traffic class byte
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		sockErr = setTOS(fd, ipv6, dscp<<2)
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
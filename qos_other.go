@@ -0,0 +1,8 @@
+//go:build !linux
+
+package zeolite
+
+// setTOS is not supported here
+func setTOS(fd uintptr, ipv6 bool, tos int) error {
+	return nil
+}
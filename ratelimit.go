@@ -0,0 +1,93 @@
+package zeolite
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// RateLimiter limits the rate of new connections per source IP
+// using a token bucket for each source.
+type RateLimiter struct {
+	// tokens added per second
+	Rate float64
+	// maximum number of tokens (and thus connections in a burst)
+	Burst int
+
+	mtx       sync.Mutex
+	buckets   map[string]*bucket
+	lastPrune time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	return &RateLimiter{Rate: rate, Burst: burst}
+}
+
+// sourceIP returns the IP of addr, or the whole address for non-IP networks
+func sourceIP(addr net.Addr) string {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP.String()
+	case *net.UDPAddr:
+		return addr.IP.String()
+	case nil:
+		return ""
+	default:
+		return addr.String()
+	}
+}
+
+// Allow takes a token from the bucket of the source of addr
+// and reports whether there was one.
+func (r *RateLimiter) Allow(addr net.Addr) bool {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	now := time.Now()
+	if r.buckets == nil {
+		r.buckets = map[string]*bucket{}
+	}
+	r.prune(now)
+
+	key := sourceIP(addr)
+	b, ok := r.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(r.Burst), last: now}
+		r.buckets[key] = b
+	}
+
+	b.refill(now, r.Rate, r.Burst)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (b *bucket) refill(now time.Time, rate float64, burst int) {
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+	b.last = now
+}
+
+// prune forgets full buckets once a minute, so memory stays bounded
+func (r *RateLimiter) prune(now time.Time) {
+	if now.Sub(r.lastPrune) < time.Minute {
+		return
+	}
+	r.lastPrune = now
+
+	for key, b := range r.buckets {
+		b.refill(now, r.Rate, r.Burst)
+		if b.tokens >= float64(r.Burst) {
+			delete(r.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package zeolite
+
+// Relay forwards all messages received from src to dst until src ends,
+// which it passes on with CloseWrite, or an error occurs. It returns the
+// number of bytes relayed. Receiving is repeated after retryable errors
+// like in BlockCopy.
+//
+// Unlike a loop of Recv & Send, it decrypts every message into the same
+// buffer and encrypts from it into pooled ones, so memory use stays
+// constant regardless of the amount of data. Messages sent in parts
+// (see SendReader) keep their PUSH marks.
+func Relay(dst, src *Stream) (written int64, err error) {
+	buf := getBuf(chunkSize)
+	defer putBuf(buf)
+
+	retries := 0
+	for {
+		msg, err := src.recv(*buf)
+		if err == ErrEOS {
+			return written, dst.CloseWrite()
+		} else if err != nil {
+			if Retryable(err) && retries < MaxRetries {
+				retries++
+				continue
+			}
+			return written, err
+		}
+		retries = 0
+
+		// a bigger frame got its own buffer, keep it for the next ones
+		if cap(msg) > cap(*buf) && cap(msg) <= maxPooled {
+			*buf = msg[:0]
+		}
+
+		tag := TagMessage
+		if src.pushed {
+			tag = TagPush
+		}
+		if err := dst.sendFrame(FrameData, msg, tag); err != nil {
+			return written, err
+		}
+		dst.cfg.metrics.sent(len(msg))
+		written += int64(len(msg))
+	}
+}
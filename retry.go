@@ -0,0 +1,29 @@
+package zeolite
+
+import (
+	"errors"
+	"syscall"
+)
+
+// MaxRetries limits how often an operation is repeated in a row
+// after retryable errors, so a persistent one can't cause a busy loop.
+// Callers that retry on their own (see Retryable) should use it too.
+const MaxRetries = 16
+
+// Retryable reports whether the operation that failed with err can simply
+// be repeated: if it was interrupted by a signal (EINTR) or if the error
+// is marked temporary (see net.Error) without being a timeout.
+//
+// Timeouts are not retryable: deadlines are the usual way to cancel
+// blocking operations, and the deadline stays in the past.
+func Retryable(err error) bool {
+	if errors.Is(err, syscall.EINTR) {
+		return true
+	}
+
+	var temp interface {
+		Temporary() bool
+		Timeout() bool
+	}
+	return errors.As(err, &temp) && temp.Temporary() && !temp.Timeout()
+}
@@ -0,0 +1,110 @@
+package zeolite
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrRevoked = errors.New("key revoked")
+
+// RevocationList is a set of revoked keys. A revoked key is rejected
+// even if it is trusted by the TrustCB or holds a valid certificate.
+type RevocationList struct {
+	mtx   sync.RWMutex
+	keys  map[SignPK]struct{}
+	path  string
+	mtime time.Time
+}
+
+func NewRevocationList(keys ...SignPK) *RevocationList {
+	list := &RevocationList{keys: map[SignPK]struct{}{}}
+	for _, key := range keys {
+		list.keys[key] = struct{}{}
+	}
+	return list
+}
+
+// LoadRevocationList reads a file of base64-encoded keys (one per line,
+// # starts a comment). The file is read again whenever it changes.
+func LoadRevocationList(path string) (*RevocationList, error) {
+	list := &RevocationList{path: path}
+	if err := list.Reload(); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// Reload reads the file of the list again.
+// On errors, the previous contents are kept.
+func (list *RevocationList) Reload() error {
+	if list.path == "" {
+		return nil
+	}
+
+	info, err := os.Stat(list.path)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(list.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	keys := map[SignPK]struct{}{}
+	scn := bufio.NewScanner(file)
+	for scn.Scan() {
+		line := strings.TrimSpace(scn.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		raw, err := Base64Dec(line)
+		key := SignPK{}
+		if err != nil || len(raw) != len(key) {
+			return ErrIdentity
+		}
+		copy(key[:], raw)
+		keys[key] = struct{}{}
+	}
+	if err := scn.Err(); err != nil {
+		return err
+	}
+
+	list.mtx.Lock()
+	defer list.mtx.Unlock()
+	list.keys = keys
+	list.mtime = info.ModTime()
+	return nil
+}
+
+// Revoked reports whether key is revoked,
+// reloading the file of the list first if it has changed.
+func (list *RevocationList) Revoked(key SignPK) bool {
+	if list.path != "" {
+		list.mtx.RLock()
+		mtime := list.mtime
+		list.mtx.RUnlock()
+
+		if info, err := os.Stat(list.path); err == nil && !info.ModTime().Equal(mtime) {
+			list.Reload()
+		}
+	}
+
+	list.mtx.RLock()
+	defer list.mtx.RUnlock()
+	_, ok := list.keys[key]
+	return ok
+}
+
+// WithRevocationList rejects peers whose key is in list with ErrRevoked.
+// This check precedes both the TrustCB and certificates.
+func WithRevocationList(list *RevocationList) Option {
+	return func(cfg *config) {
+		cfg.revoked = list
+	}
+}
@@ -0,0 +1,32 @@
+package zeolite
+
+// IdentitySelector returns the identity to present to the peer with the
+// given key, or false to present the default one.
+type IdentitySelector func(peer SignPK) (identity Identity, ok bool)
+
+// WithIdentitySelector lets a participant present different identities
+// to different peers, e.g. a work and a personal one. The identity is
+// selected in this order: the one returned by sel for the key of the
+// peer, then the one NewStream is called on (e.g. the Identity of the
+// Listener, so servers can already select by listen address).
+//
+// To know the key of the peer before sending its own, the participant
+// reads it first. This is compatible with all peers, since they send
+// their key without waiting, but only one side of a connection (usually
+// the server) may do so: if both wait, the handshake deadlocks.
+// There is no way to select by the first message of the peer, since
+// messages can only be sent once the identities are established.
+func WithIdentitySelector(sel IdentitySelector) Option {
+	return func(cfg *config) {
+		cfg.selector = sel
+	}
+}
+
+// IdentityMap selects identities by the key of the peer.
+type IdentityMap map[SignPK]Identity
+
+// Select implements IdentitySelector.
+func (m IdentityMap) Select(peer SignPK) (Identity, bool) {
+	identity, ok := m[peer]
+	return identity, ok
+}
@@ -0,0 +1,56 @@
+package zeolite
+
+import (
+	// #include <sodium.h>
+	"C"
+
+	"bytes"
+	"unsafe"
+)
+
+// SharedKey derives a symmetric key shared with peer from the long-term
+// keys alone, e.g. for encrypting files at rest: both identities derive
+// the same key without communicating.
+//
+// Unlike the handshake of NewStream, this provides no forward secrecy:
+// anyone who obtains one of the secret keys can derive the key
+// and decrypt everything protected by it.
+func (identity Identity) SharedKey(peer SignPK) (ret SymK, err error) {
+	ourSK := [C.crypto_scalarmult_SCALARBYTES]byte{}
+	ourPK := [C.crypto_scalarmult_BYTES]byte{}
+	peerPK := [C.crypto_scalarmult_BYTES]byte{}
+	shared := [C.crypto_scalarmult_BYTES]byte{}
+	defer C.sodium_memzero(unsafe.Pointer(&ourSK[0]), C.size_t(len(ourSK)))
+	defer C.sodium_memzero(unsafe.Pointer(&shared[0]), C.size_t(len(shared)))
+
+	// convert the signing keys to X25519 keys
+	if C.crypto_sign_ed25519_sk_to_curve25519(ptr(ourSK[:]), ptr(identity.Secret[:])) != 0 ||
+		C.crypto_sign_ed25519_pk_to_curve25519(ptr(ourPK[:]), ptr(identity.Public[:])) != 0 ||
+		C.crypto_sign_ed25519_pk_to_curve25519(ptr(peerPK[:]), ptr(peer[:])) != 0 {
+		return ret, ErrKeygen
+	}
+
+	// fails for low-order peer keys
+	if C.crypto_scalarmult(ptr(shared[:]), ptr(ourSK[:]), ptr(peerPK[:])) != 0 {
+		return ret, ErrKeygen
+	}
+
+	// key = H(shared || lower public key || higher public key)
+	// the order makes the result the same for both sides
+	input := append([]byte{}, shared[:]...)
+	if bytes.Compare(ourPK[:], peerPK[:]) < 0 {
+		input = append(append(input, ourPK[:]...), peerPK[:]...)
+	} else {
+		input = append(append(input, peerPK[:]...), ourPK[:]...)
+	}
+	defer C.sodium_memzero(unsafe.Pointer(&input[0]), C.size_t(len(input)))
+
+	if C.crypto_generichash(
+		ptr(ret[:]), C.size_t(len(ret)),
+		ptr(input), size(input),
+		nil, 0,
+	) != 0 {
+		return ret, ErrKeygen
+	}
+	return ret, nil
+}
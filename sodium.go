@@ -0,0 +1,12 @@
+//go:build !sodium_static
+
+package zeolite
+
+// libsodium is linked dynamically by default, so it has to be installed
+// wherever programs using this package run. Build with -tags sodium_static
+// to link it statically instead (see sodium_static.go).
+
+import (
+	// #cgo LDFLAGS: -lsodium
+	"C"
+)
@@ -0,0 +1,12 @@
+//go:build sodium_static
+
+package zeolite
+
+// With -tags sodium_static, libsodium is linked statically, so the result
+// runs without it being installed. This needs libsodium.a at build time
+// and a linker that understands -Bstatic (like GNU ld, gold or lld).
+
+import (
+	// #cgo LDFLAGS: -Wl,-Bstatic -lsodium -Wl,-Bdynamic
+	"C"
+)
@@ -0,0 +1,158 @@
+package zeolite
+
+import (
+	// #include <string.h>
+	// #include <sodium.h>
+	"C"
+
+	"unsafe"
+)
+
+// Tag marks the meaning of a frame (values match libsodium's secretstream).
+type Tag byte
+
+const (
+	TagMessage Tag = iota
+	TagPush
+	TagRekey
+	TagFinal
+)
+
+// Suite is a cipher suite protecting the frames of a Stream.
+// Each direction gets its own key; the sender produces a header
+// that the receiver needs for initialization.
+type Suite interface {
+	// Cap is the capability flag selecting this suite (0 for the default).
+	Cap() Caps
+	// HeaderSize is the size of the header created by NewSender.
+	HeaderSize() int
+	// Overhead is the number of bytes Seal adds to every message.
+	Overhead() int
+
+	NewSender(key SymK) (sender Sender, header []byte, err error)
+	NewReceiver(key SymK, header []byte) (Receiver, error)
+}
+
+type Sender interface {
+	// Seal encrypts msg into dst, which has room for Overhead more bytes.
+	// With TagRekey, the sender must derive a new key afterwards,
+	// like the Receiver after opening that frame.
+	Seal(dst, msg []byte, tag Tag) error
+}
+
+type Receiver interface {
+	// Open decrypts frame into dst, which has room for the message.
+	Open(dst, frame []byte) (Tag, error)
+}
+
+// XChaCha20Poly1305 is the default suite based on
+// libsodium's crypto_secretstream_xchacha20poly1305.
+var XChaCha20Poly1305 Suite = secretstream{}
+
+type secretstream struct{}
+
+type secretstreamState struct {
+	state C.crypto_secretstream_xchacha20poly1305_state
+}
+
+func (secretstream) Cap() Caps {
+	return 0
+}
+
+func (secretstream) HeaderSize() int {
+	return C.crypto_secretstream_xchacha20poly1305_HEADERBYTES
+}
+
+func (secretstream) Overhead() int {
+	return C.crypto_secretstream_xchacha20poly1305_ABYTES
+}
+
+func (secretstream) NewSender(key SymK) (Sender, []byte, error) {
+	ret := &secretstreamState{}
+	header := make([]byte, C.crypto_secretstream_xchacha20poly1305_HEADERBYTES)
+
+	if C.crypto_secretstream_xchacha20poly1305_init_push(
+		&ret.state,
+		ptr(header),
+		ptr(key[:]),
+	) != 0 {
+		return nil, nil, ErrEncrypt
+	}
+	return ret, header, nil
+}
+
+func (secretstream) NewReceiver(key SymK, header []byte) (Receiver, error) {
+	ret := &secretstreamState{}
+
+	if C.crypto_secretstream_xchacha20poly1305_init_pull(
+		&ret.state,
+		ptr(header),
+		ptr(key[:]),
+	) != 0 {
+		return nil, ErrDecrypt
+	}
+	return ret, nil
+}
+
+func (s *secretstreamState) Seal(dst, msg []byte, tag Tag) error {
+	if C.crypto_secretstream_xchacha20poly1305_push(
+		&s.state,
+		ptr(dst),
+		nil,
+		ptr(msg),
+		size(msg),
+		nil,
+		0,
+		C.uchar(tag),
+	) != 0 {
+		return ErrEncrypt
+	}
+	return nil
+}
+
+func (s *secretstreamState) Open(dst, frame []byte) (Tag, error) {
+	tag := C.uchar(0)
+
+	if C.crypto_secretstream_xchacha20poly1305_pull(
+		&s.state,
+		ptr(dst),
+		nil,
+		&tag,
+		ptr(frame),
+		size(frame),
+		nil,
+		0,
+	) != 0 {
+		return 0, ErrDecrypt
+	}
+	return Tag(tag), nil
+}
+
+// StateImporter is implemented by suites whose states can be restored
+// from the output of MarshalBinary of their senders & receivers.
+// It is required for moving a stream to another process (see Stream.Export).
+type StateImporter interface {
+	ImportSender(state []byte) (Sender, error)
+	ImportReceiver(state []byte) (Receiver, error)
+}
+
+func (s *secretstreamState) MarshalBinary() ([]byte, error) {
+	return C.GoBytes(unsafe.Pointer(&s.state), C.sizeof_crypto_secretstream_xchacha20poly1305_state), nil
+}
+
+func (secretstream) importState(state []byte) (*secretstreamState, error) {
+	ret := &secretstreamState{}
+	if len(state) != C.sizeof_crypto_secretstream_xchacha20poly1305_state {
+		return nil, ErrImport
+	}
+	C.memcpy(unsafe.Pointer(&ret.state), unsafe.Pointer(&state[0]), C.size_t(len(state)))
+	return ret, nil
+}
+
+func (suite secretstream) ImportSender(state []byte) (Sender, error) {
+	return suite.importState(state)
+}
+
+func (suite secretstream) ImportReceiver(state []byte) (Receiver, error) {
+	return suite.importState(state)
+}
@@ -0,0 +1,58 @@
+package zeolite
+
+import "time"
+
+// Phases of a connection, in order, as reported by WithTimings
+// and HandshakeError.
+// PhaseResolve and PhaseConnect are only reported by Dialer.
+const (
+	PhaseResolve      = "resolve"       // name resolution
+	PhaseConnect      = "connect"       // TCP (or Unix socket) connect
+	PhaseBanner       = "banner"        // protocol & capabilities
+	PhaseIdentity     = "identity"      // public keys & certificates
+	PhaseTrust        = "trust"         // the trust callback
+	PhaseKeyExchange  = "key exchange"  // challenges & signed ephemeral keys
+	PhaseVerify       = "verify"        // the signature of the peer
+	PhaseSymmetricKey = "symmetric key" // encrypted stream keys
+	PhaseHeader       = "header"        // stream headers
+	PhaseHello        = "hello"         // hellos, only with WithHello
+)
+
+// WithTimings calls fn with the duration of every phase of the
+// handshake, to find out whether slow connections are caused by the
+// network or by the CPU. Phases that send and receive include the time
+// spent waiting for the peer. fn is called during the handshake,
+// so it should return quickly.
+func WithTimings(fn func(phase string, d time.Duration)) Option {
+	return func(cfg *config) {
+		cfg.timings = fn
+	}
+}
+
+// timer measures consecutive phases for WithTimings.
+// A nil timer ignores everything.
+type timer struct {
+	fn   func(phase string, d time.Duration)
+	last time.Time
+}
+
+// timer returns a timer starting now, nil without WithTimings
+func (cfg *config) timer() *timer {
+	if cfg.timings == nil {
+		return nil
+	}
+	return &timer{fn: cfg.timings, last: time.Now()}
+}
+
+// lap reports the time since the previous phase as phase
+func (t *timer) lap(phase string) {
+	t.lapAt(phase, time.Now())
+}
+
+// lapAt is like lap, but the phase ended at the given time
+func (t *timer) lapAt(phase string, end time.Time) {
+	if t != nil {
+		t.fn(phase, end.Sub(t.last))
+		t.last = end
+	}
+}
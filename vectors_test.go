@@ -0,0 +1,203 @@
+package zeolite_test
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/42LoCo42/go-zeolite"
+	"github.com/42LoCo42/go-zeolite/internal/detrand"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden test vectors")
+
+// script connects two sides of which only one runs at any time:
+// a side keeps the turn until it has to wait for data from the other one.
+// This makes all uses of the (deterministic) randomness happen in order.
+type script struct {
+	mtx   sync.Mutex
+	cond  *sync.Cond
+	turn  int
+	inbox [2]bytes.Buffer
+	done  [2]bool
+	log   []string
+}
+
+type scriptConn struct {
+	*script
+	side int
+}
+
+func newScript() (s *script, a, b *scriptConn) {
+	s = &script{}
+	s.cond = sync.NewCond(&s.mtx)
+	return s, &scriptConn{s, 0}, &scriptConn{s, 1}
+}
+
+func (c *scriptConn) Write(p []byte) (int, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for c.turn != c.side {
+		c.cond.Wait()
+	}
+
+	c.inbox[1-c.side].Write(p)
+	c.log = append(c.log, fmt.Sprintf("%c %x", "AB"[c.side], p))
+	return len(p), nil
+}
+
+func (c *scriptConn) Read(p []byte) (int, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for {
+		if c.turn == c.side {
+			if c.inbox[c.side].Len() > 0 {
+				return c.inbox[c.side].Read(p)
+			}
+			if c.done[1-c.side] {
+				return 0, io.EOF
+			}
+			// nothing to read, let the other side run
+			c.turn = 1 - c.side
+			c.cond.Broadcast()
+		}
+		c.cond.Wait()
+	}
+}
+
+// Close ends this side and lets the other one run.
+func (c *scriptConn) Close() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.done[c.side] = true
+	c.turn = 1 - c.side
+	c.cond.Broadcast()
+	return nil
+}
+
+func seededIdentity(t *testing.T, b byte) zeolite.Identity {
+	t.Helper()
+
+	var seed zeolite.Seed
+	for i := range seed {
+		seed[i] = b
+	}
+	identity, err := zeolite.NewIdentityFromSeed(seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return identity
+}
+
+// transcript runs a handshake and some data frames in both directions
+// and returns every write of both sides.
+func transcript(t *testing.T, opts ...zeolite.Option) []string {
+	idA := seededIdentity(t, 'A')
+	idB := seededIdentity(t, 'B')
+
+	var seed detrand.Seed
+	copy(seed[:], "zeolite test vectors")
+	restore, err := detrand.Enable(seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restore()
+
+	s, connA, connB := newScript()
+
+	errs := make(chan error, 1)
+	go func() {
+		defer connB.Close()
+		errs <- func() error {
+			b, err := idB.NewStream(connB, trustAll, opts...)
+			if err != nil {
+				return err
+			}
+			msg, err := b.Recv()
+			if err != nil {
+				return err
+			}
+			if err := b.Send(bytes.ToUpper(msg)); err != nil {
+				return err
+			}
+			return b.CloseWrite()
+		}()
+	}()
+
+	a, err := idA.NewStream(connA, trustAll, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Send([]byte("hello zeolite")); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := a.Recv(); err != nil || string(msg) != "HELLO ZEOLITE" {
+		t.Fatalf("expected HELLO ZEOLITE, got %q (%v)", msg, err)
+	}
+	if _, err := a.Recv(); err != zeolite.ErrEOS {
+		t.Fatalf("expected ErrEOS, got %v", err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.log
+}
+
+func TestVectors(t *testing.T) {
+	for name, opts := range map[string][]zeolite.Option{
+		"basic": nil,
+		"extended": {
+			zeolite.WithCompression(6),
+			zeolite.WithChallenge(),
+			zeolite.WithFrameTypes(),
+			zeolite.WithPadding(16),
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			got := transcript(t, opts...)
+
+			path := filepath.Join("testdata", "vectors-"+name+".txt")
+			if *update {
+				data := strings.Join(got, "\n") + "\n"
+				if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			file, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+
+			var want []string
+			scanner := bufio.NewScanner(file)
+			scanner.Buffer(nil, 1<<20)
+			for scanner.Scan() {
+				want = append(want, scanner.Text())
+			}
+			if err := scanner.Err(); err != nil {
+				t.Fatal(err)
+			}
+
+			if len(got) != len(want) {
+				t.Fatalf("expected %d writes, got %d", len(want), len(got))
+			}
+			for i := range want {
+				if got[i] != want[i] {
+					t.Errorf("write %d differs:\nwant %s\ngot  %s", i, want[i], got[i])
+				}
+			}
+		})
+	}
+}
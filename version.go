@@ -0,0 +1,70 @@
+package zeolite
+
+import (
+	// #include <sodium.h>
+	"C"
+
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// MinSodiumVersion is the oldest libsodium release that provides
+// everything needed (the secretstream API appeared in 1.0.14).
+// Init fails with older ones.
+const MinSodiumVersion = "1.0.14"
+
+var ErrSodiumVersion = errors.New("libsodium is too old")
+
+// SodiumVersionError is returned if the linked libsodium is too old.
+// It matches ErrSodiumVersion (see errors.Is).
+type SodiumVersionError struct {
+	Have, Need string
+}
+
+func (e *SodiumVersionError) Error() string {
+	return ErrSodiumVersion.Error() + ": have " + e.Have + ", need " + e.Need
+}
+
+func (e *SodiumVersionError) Is(target error) bool {
+	return target == ErrSodiumVersion
+}
+
+// SodiumVersion returns the version of the linked libsodium, e.g. "1.0.18".
+func SodiumVersion() string {
+	return C.GoString(C.sodium_version_string())
+}
+
+// RequireSodiumVersion checks that the linked libsodium is at least
+// version min (like "1.0.18"). This matters for dynamically linked
+// binaries, which use whatever library the system provides.
+func RequireSodiumVersion(min string) error {
+	have := SodiumVersion()
+	if compareVersions(have, min) < 0 {
+		return &SodiumVersionError{Have: have, Need: min}
+	}
+	return nil
+}
+
+// compareVersions compares dotted version numbers like 1.0.18
+// (missing or invalid parts count as 0)
+func compareVersions(a, b string) int {
+	partsA := strings.Split(a, ".")
+	partsB := strings.Split(b, ".")
+	for i := 0; i < len(partsA) || i < len(partsB); i++ {
+		var x, y int
+		if i < len(partsA) {
+			x, _ = strconv.Atoi(partsA[i])
+		}
+		if i < len(partsB) {
+			y, _ = strconv.Atoi(partsB[i])
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
@@ -1,19 +1,29 @@
 package zeolite
 
 import (
-	// #cgo LDFLAGS: -lsodium
 	// #include <sodium.h>
 	"C"
 
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"context"
 	"encoding/base64"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 	"unsafe"
 )
 
-const Protocol = "zeolite1"
+const (
+	Protocol   = "zeolite1"
+	ProtocolEx = "zeolite2" // followed by capability flags
+)
 
 var (
 	ErrInit    = errors.New("could not initialize libsodium")
@@ -27,8 +37,67 @@ var (
 	ErrVerify  = errors.New("could not verify")
 	ErrEncrypt = errors.New("could not encrypt")
 	ErrDecrypt = errors.New("could not decrypt")
+	ErrClosed  = errors.New("stream closed for writing")
+
+	ErrCompress   = errors.New("could not compress")
+	ErrDecompress = errors.New("could not decompress")
+	ErrBufferFull = errors.New("receive buffer limit exceeded")
+	ErrDeadline   = errors.New("connection doesn't support read deadlines")
+	ErrFormat     = errors.New("not encrypted data of a known format")
+
+	// ErrTrustTimeout is wrapped in a TrustError if the trust callback
+	// didn't return in time (see WithTrustTimeout)
+	ErrTrustTimeout = errors.New("trust callback timed out")
+)
+
+// Caps is a set of optional protocol features.
+// Both sides offer their set in the banner, the intersection is used.
+type Caps uint32
+
+const (
+	// frames are compressed with DEFLATE before encryption
+	CapCompression Caps = 1 << iota
+	// signed ephemeral keys include a nonce chosen by the peer
+	CapChallenge
+	// both sides present a (possibly empty) certificate
+	CapCert
+	// every frame starts with its FrameType
+	CapFrameTypes
+	// the plaintext of every frame is padded, prefixed by its true length
+	CapPadding
+	// every frame starts with a magic marker and the framing version
+	CapFrameHeader
+	// both sides send a hello message right after the handshake
+	CapHello
+	// frames may carry the data of channels (see WithChannels)
+	CapChannels
+)
+
+// frame header (see CapFrameHeader): magic, version, reserved zero byte
+const (
+	frameMagic      = "ZF"
+	frameVersion    = 1
+	frameHeaderSize = len(frameMagic) + 2
+)
+
+// FrameType distinguishes application data from control frames.
+// It is the first byte of the authenticated plaintext of a frame.
+type FrameType byte
+
+const (
+	FrameData FrameType = iota
+	FramePing
+	FramePong
+	FrameRekey
+	FrameFinal
+	FrameHeartbeat
+	FrameStderr
+	FrameFD
+	FrameChannel
 )
 
+const ChallengeBytes = 32
+
 type SignPK [C.crypto_sign_PUBLICKEYBYTES]byte
 type SignSK [C.crypto_sign_SECRETKEYBYTES]byte
 type EphPK [C.crypto_box_PUBLICKEYBYTES]byte
@@ -37,6 +106,188 @@ type SymK [C.crypto_secretstream_xchacha20poly1305_KEYBYTES]byte
 
 type TrustCB func(otherPK SignPK) (bool, error)
 
+// TrustError is returned by NewStream if the TrustCB failed, or if it
+// rejected a peer whose certificate was not accepted.
+// It matches ErrTrust (see errors.Is) and wraps the error of the callback
+// or the reason the certificate was not accepted.
+type TrustError struct {
+	Err error
+}
+
+func (e *TrustError) Error() string {
+	return ErrTrust.Error() + ": " + e.Err.Error()
+}
+
+func (e *TrustError) Unwrap() error {
+	return e.Err
+}
+
+func (e *TrustError) Is(target error) bool {
+	return target == ErrTrust
+}
+
+// HandshakeError is returned by NewStream if the connection failed
+// during the handshake, e.g. because it was already closed. It wraps
+// ErrSend or ErrRecv; Phase tells which step of the handshake failed
+// (PhaseBanner, ...) and Cause holds the error of the connection.
+// A connection that is open but whose peer is gone can't be detected
+// this way: it hangs until a deadline is hit (see Listener.HandshakeTimeout).
+type HandshakeError struct {
+	Phase string
+	Err   error
+	Cause error
+}
+
+func (e *HandshakeError) Error() string {
+	return fmt.Sprintf("%v during %s: %v", e.Err, e.Phase, e.Cause)
+}
+
+func (e *HandshakeError) Unwrap() error {
+	return e.Err
+}
+
+// Option configures a Stream during NewStream.
+type Option func(*config)
+
+type config struct {
+	caps      Caps
+	level     int
+	suite     Suite
+	limit     int
+	bufsize   int
+	padding   int
+	autoRekey uint64
+	trustWait time.Duration
+	stderr    io.Writer
+	challenge bool
+	metrics   *Metrics
+	cert      []byte
+	pool      *CertPool
+	revoked   *RevocationList
+	timings   func(phase string, d time.Duration)
+	hello     []byte
+	selector  IdentitySelector
+}
+
+// WithCompression offers DEFLATE compression of every frame at the given
+// level (see compress/flate). It is only used if the peer offers it too.
+//
+// Compressing data that mixes secrets with attacker-influenced input leaks
+// information through the ciphertext length (CRIME/BREACH-style attacks),
+// so only enable this if that doesn't apply to your data.
+//
+// A small frame can decompress to a huge message, so received messages
+// are limited to MaxDecompressedBytes unless WithRecvLimit sets a limit.
+func WithCompression(level int) Option {
+	return func(cfg *config) {
+		cfg.caps |= CapCompression
+		cfg.level = level
+	}
+}
+
+// WithSuite offers an alternative cipher suite. If the peer doesn't
+// offer it too, the default suite XChaCha20Poly1305 is used.
+func WithSuite(suite Suite) Option {
+	return func(cfg *config) {
+		cfg.caps |= suite.Cap()
+		cfg.suite = suite
+	}
+}
+
+// WithChallenge requires the peer to prove liveness: both sides send a
+// random nonce that the other side must sign along with its ephemeral key.
+// This binds the signatures to the current session, so parts of a recorded
+// handshake can't be replayed. NewStream fails with ErrProto
+// if the peer doesn't support challenges.
+func WithChallenge() Option {
+	return func(cfg *config) {
+		cfg.caps |= CapChallenge
+		cfg.challenge = true
+	}
+}
+
+// WithFrameTypes offers typed frames, which are required for control
+// messages like pings. Recv handles control frames internally and only
+// returns data frames to the caller.
+func WithFrameTypes() Option {
+	return func(cfg *config) {
+		cfg.caps |= CapFrameTypes
+	}
+}
+
+// WithStderr writes the payload of received stderr frames (see SendStderr)
+// to w. Without it, they are discarded.
+func WithStderr(w io.Writer) Option {
+	return func(cfg *config) {
+		cfg.stderr = w
+	}
+}
+
+// WithRecvLimit limits the size of a received message to limit bytes.
+// Recv returns ErrBufferFull for bigger messages before buffering them;
+// the stream can't be used afterwards.
+// Since frames are only read from the connection during Recv,
+// a slow consumer already applies backpressure to the peer.
+func WithRecvLimit(limit int) Option {
+	return func(cfg *config) {
+		cfg.limit = limit
+	}
+}
+
+// WithPadding pads the plaintext of every frame to a multiple of
+// blockSize bytes, so the frame sizes don't reveal the exact message sizes.
+// This costs up to blockSize+3 additional bytes per frame and doesn't hide
+// when frames are sent. NewStream fails with ErrProto
+// if the peer doesn't support padding.
+func WithPadding(blockSize int) Option {
+	return func(cfg *config) {
+		cfg.caps |= CapPadding
+		cfg.padding = blockSize
+	}
+}
+
+// WithFrameHeader offers a header in front of every frame: a magic
+// marker and the framing version. This makes frames easy to find in
+// packet captures and turns a connection that got out of sync into
+// ErrProto instead of a decryption error. The header isn't authenticated,
+// which doesn't matter since the frame following it is.
+// It is only used if the peer offers it too.
+func WithFrameHeader() Option {
+	return func(cfg *config) {
+		cfg.caps |= CapFrameHeader
+	}
+}
+
+// WithReadBuffer sets the size of the buffer used to read frames from the
+// connection, so small frames don't need one read call each.
+// The default is 4096 bytes.
+func WithReadBuffer(size int) Option {
+	return func(cfg *config) {
+		cfg.bufsize = size
+	}
+}
+
+// WithAutoRekey rekeys the sending direction after every frames frames
+// by sealing each such frame with TagRekey. The peer follows
+// transparently; it needs neither this option nor typed frames.
+// The receiving direction is rekeyed on the peer's schedule.
+func WithAutoRekey(frames uint64) Option {
+	return func(cfg *config) {
+		cfg.autoRekey = frames
+	}
+}
+
+// WithTrustTimeout limits how long NewStream and Reauthorize wait for
+// the trust callback, e.g. one that asks a user or a remote service.
+// If it doesn't return in time, they fail with a TrustError wrapping
+// ErrTrustTimeout. The callback keeps running in the background until
+// it returns; its result is ignored. By default, there is no limit.
+func WithTrustTimeout(timeout time.Duration) Option {
+	return func(cfg *config) {
+		cfg.trustWait = timeout
+	}
+}
+
 type Identity struct {
 	Public SignPK
 	Secret SignSK
@@ -45,11 +296,52 @@ type Identity struct {
 type Stream struct {
 	Conn      io.ReadWriter
 	OtherPK   SignPK
-	SendState C.crypto_secretstream_xchacha20poly1305_state
-	RecvState C.crypto_secretstream_xchacha20poly1305_state
+	OtherCert []byte
+	Caps      Caps
+	Suite     Suite
+
+	// the hello of the peer, nil unless exchanged (see WithHello)
+	OtherHello []byte
+
+	cfg        config
+	sender     Sender
+	receiver   Receiver
+	reader     *bufio.Reader
+	zw         *flate.Writer
+	sendMtx    sync.Mutex
+	sendClosed bool
+	recvClosed atomic.Bool
+	sinceRekey uint64 // frames sent since the last rekey, see WithAutoRekey
+
+	// frame being read, kept if reading it times out (see fill)
+	pending    []byte
+	pendingBuf *[]byte // from bufPool, holds the pending frame
+	prefix     [frameHeaderSize + 4]byte
+	filled     int
+	pushed     bool // the last frame was tagged PUSH (see RecvWriter)
+
+	// file descriptors received on Unix sockets (see RecvFD)
+	fdMtx     sync.Mutex
+	fdArrived []fdBatch // not yet assigned to a frame
+	fds       []int     // claimed by FD frames
+	fdFrames  int
+	fdClosed  bool
+
+	// diagnostics (see DebugState)
+	protocol       string
+	established    time.Time
+	framesSent     atomic.Uint64
+	framesReceived atomic.Uint64
+	bytesSent      atomic.Uint64
+	bytesReceived  atomic.Uint64
+	lastRekey      atomic.Int64
+	rekeys         atomic.Uint64
 }
 
 func ptr(val []byte) *C.uchar {
+	if len(val) == 0 {
+		return nil
+	}
 	return (*C.uchar)(unsafe.Pointer(&val[0]))
 }
 
@@ -57,6 +349,28 @@ func size(val []byte) C.ulonglong {
 	return C.ulonglong(len(val))
 }
 
+// writeAll writes all of buf, even if w performs short writes
+// or fails with retryable errors (see Retryable)
+func writeAll(w io.Writer, buf []byte) error {
+	retries := 0
+	for len(buf) > 0 {
+		n, err := w.Write(buf)
+		buf = buf[n:]
+		if err != nil {
+			if Retryable(err) && retries < MaxRetries {
+				retries++
+				continue
+			}
+			return err
+		}
+		if n == 0 {
+			return io.ErrShortWrite
+		}
+		retries = 0
+	}
+	return nil
+}
+
 func Base64Enc(data []byte) string {
 	buf := strings.Builder{}
 	enc := base64.NewEncoder(base64.StdEncoding, &buf)
@@ -70,12 +384,13 @@ func Base64Dec(b64 string) ([]byte, error) {
 	return io.ReadAll(dec)
 }
 
+// Init initializes libsodium and checks that it isn't older
+// than MinSodiumVersion.
 func Init() error {
 	if C.sodium_init() < 0 {
 		return ErrInit
-	} else {
-		return nil
 	}
+	return RequireSodiumVersion(MinSodiumVersion)
 }
 
 func NewIdentity() (ret Identity, err error) {
@@ -86,71 +401,181 @@ func NewIdentity() (ret Identity, err error) {
 	}
 }
 
-func (identity Identity) NewStream(conn io.ReadWriter, cb TrustCB) (ret *Stream, err error) {
-	ret = &Stream{Conn: conn}
+// NewStream performs the handshake on conn. If it fails,
+// conn is closed (if it implements io.Closer).
+func (identity Identity) NewStream(
+	conn io.ReadWriter,
+	cb TrustCB,
+	opts ...Option,
+) (ret *Stream, err error) {
+	ret = &Stream{Conn: conn, Suite: XChaCha20Poly1305}
+	for _, opt := range opts {
+		opt(&ret.cfg)
+	}
+	timer := ret.cfg.timer()
+	// a failed handshake leaves the connection in an unusable state
+	defer func() {
+		if err != nil {
+			ret.cfg.metrics.handshakeFailed(err)
+			if closer, ok := conn.(io.Closer); ok {
+				closer.Close()
+			}
+		}
+	}()
 
 	// exchange & check protocol
-	buf := strings.Builder{}
+	// the extended banner is only sent if we offer any capabilities
+	banner := []byte(Protocol)
+	if ret.cfg.caps != 0 {
+		banner = binary.LittleEndian.AppendUint32(
+			[]byte(ProtocolEx), uint32(ret.cfg.caps))
+	}
+	if err := writeAll(conn, banner); err != nil {
+		return ret, &HandshakeError{Phase: PhaseBanner, Err: ErrSend, Cause: err}
+	}
 
-	if _, err := io.WriteString(conn, Protocol); err != nil {
-		return ret, ErrSend
+	otherBanner := [len(Protocol)]byte{}
+	if _, err := io.ReadFull(conn, otherBanner[:]); err != nil {
+		return ret, &HandshakeError{Phase: PhaseBanner, Err: ErrRecv, Cause: err}
 	}
-	if _, err := io.CopyN(&buf, conn, int64(len(Protocol))); err != nil {
-		return ret, ErrRecv
+	ret.protocol = Protocol
+	switch string(otherBanner[:]) {
+	case Protocol:
+	case ProtocolEx:
+		if ret.cfg.caps != 0 {
+			ret.protocol = ProtocolEx
+		}
+		otherCaps := [4]byte{}
+		if _, err := io.ReadFull(conn, otherCaps[:]); err != nil {
+			return ret, &HandshakeError{Phase: PhaseBanner, Err: ErrRecv, Cause: err}
+		}
+		ret.Caps = ret.cfg.caps & Caps(binary.LittleEndian.Uint32(otherCaps[:]))
+	default:
+		return ret, ErrProto
 	}
-	if buf.String() != Protocol {
+
+	if ret.cfg.padding > 0 && ret.Caps&CapPadding == 0 {
+		return ret, ErrProto
+	}
+	if len(ret.cfg.hello) > MaxHelloBytes {
 		return ret, ErrProto
 	}
+	timer.lap(PhaseBanner)
+
+	// select the cipher suite
+	if suite := ret.cfg.suite; suite != nil && ret.Caps&suite.Cap() != 0 {
+		ret.Suite = suite
+	}
 
-	// exchange public keys for identification
-	if _, err := conn.Write(identity.Public[:]); err != nil {
-		return ret, ErrSend
+	// exchange public keys for identification.
+	// A selector needs the key of the peer before sending ours.
+	if ret.cfg.selector == nil {
+		if err := writeAll(conn, identity.Public[:]); err != nil {
+			return ret, &HandshakeError{Phase: PhaseIdentity, Err: ErrSend, Cause: err}
+		}
 	}
 	if _, err := io.ReadFull(conn, ret.OtherPK[:]); err != nil {
-		return ret, ErrRecv
+		return ret, &HandshakeError{Phase: PhaseIdentity, Err: ErrRecv, Cause: err}
+	}
+	if ret.cfg.selector != nil {
+		if selected, ok := ret.cfg.selector(ret.OtherPK); ok {
+			identity = selected
+		}
+		if err := writeAll(conn, identity.Public[:]); err != nil {
+			return ret, &HandshakeError{Phase: PhaseIdentity, Err: ErrSend, Cause: err}
+		}
+	}
+
+	// exchange certificates (length-prefixed, may be empty)
+	if ret.Caps&CapCert != 0 {
+		cert := binary.LittleEndian.AppendUint16(nil, uint16(len(ret.cfg.cert)))
+		cert = append(cert, ret.cfg.cert...)
+		if err := writeAll(conn, cert); err != nil {
+			return ret, &HandshakeError{Phase: PhaseIdentity, Err: ErrSend, Cause: err}
+		}
+
+		if _, err := io.ReadFull(conn, cert[:2]); err != nil {
+			return ret, &HandshakeError{Phase: PhaseIdentity, Err: ErrRecv, Cause: err}
+		}
+		ret.OtherCert = make([]byte, binary.LittleEndian.Uint16(cert))
+		if _, err := io.ReadFull(conn, ret.OtherCert); err != nil {
+			return ret, &HandshakeError{Phase: PhaseIdentity, Err: ErrRecv, Cause: err}
+		}
+	}
+
+	timer.lap(PhaseIdentity)
+
+	if err := ret.Reauthorize(cb); err != nil {
+		return ret, err
 	}
+	timer.lap(PhaseTrust)
 
-	// check for trust
-	if trust, err := cb(ret.OtherPK); err != nil || !trust {
-		return ret, ErrTrust
+	// exchange challenges
+	var challenge, otherChallenge []byte
+	if ret.Caps&CapChallenge != 0 {
+		challenge = make([]byte, ChallengeBytes)
+		otherChallenge = make([]byte, ChallengeBytes)
+
+		C.randombytes_buf(
+			unsafe.Pointer(&challenge[0]),
+			C.ulong(len(challenge)),
+		)
+		if err := writeAll(conn, challenge); err != nil {
+			return ret, &HandshakeError{Phase: PhaseKeyExchange, Err: ErrSend, Cause: err}
+		}
+		if _, err := io.ReadFull(conn, otherChallenge); err != nil {
+			return ret, &HandshakeError{Phase: PhaseKeyExchange, Err: ErrRecv, Cause: err}
+		}
+	} else if ret.cfg.challenge {
+		return ret, ErrProto
 	}
 
-	// create, sign & send ephemeral keys
+	// create, sign & send ephemeral keys (with the other challenge)
 	ephPK := EphPK{}
 	ephSK := EphSK{}
-	ephMsg := [C.crypto_sign_BYTES + len(ephPK)]byte{}
+	signed := make([]byte, len(ephPK)+len(challenge))
+	ephMsg := make([]byte, C.crypto_sign_BYTES+len(signed))
 
 	if C.crypto_box_keypair(ptr(ephPK[:]), ptr(ephSK[:])) != 0 {
 		return ret, ErrKeygen
 	}
+	copy(signed, ephPK[:])
+	copy(signed[len(ephPK):], otherChallenge)
 	if C.crypto_sign(
-		ptr(ephMsg[:]),
+		ptr(ephMsg),
 		nil,
-		ptr(ephPK[:]),
-		size(ephPK[:]),
+		ptr(signed),
+		size(signed),
 		ptr(identity.Secret[:]),
 	) != 0 {
 		return ret, ErrSign
 	}
-	if _, err := conn.Write(ephMsg[:]); err != nil {
-		return ret, ErrSend
+	if err := writeAll(conn, ephMsg); err != nil {
+		return ret, &HandshakeError{Phase: PhaseKeyExchange, Err: ErrSend, Cause: err}
 	}
 
-	// read & verify other ephemeral key
+	// read & verify other ephemeral key (and our challenge)
 	otherEphPK := EphPK{}
 
-	if _, err := io.ReadFull(conn, ephMsg[:]); err != nil {
-		return ret, ErrRecv
+	if _, err := io.ReadFull(conn, ephMsg); err != nil {
+		return ret, &HandshakeError{Phase: PhaseKeyExchange, Err: ErrRecv, Cause: err}
 	}
+	timer.lap(PhaseKeyExchange)
+
 	if C.crypto_sign_open(
-		ptr(otherEphPK[:]),
+		ptr(signed),
 		nil,
-		ptr(ephMsg[:]),
-		size(ephMsg[:]),
+		ptr(ephMsg),
+		size(ephMsg),
 		ptr(ret.OtherPK[:]),
 	) != 0 {
 		return ret, ErrVerify
 	}
+	if !bytes.Equal(signed[len(ephPK):], challenge) {
+		return ret, ErrVerify
+	}
+	copy(otherEphPK[:], signed)
+	timer.lap(PhaseVerify)
 
 	// create, encrypt & send symmetric sender key
 	sendK := SymK{}
@@ -175,15 +600,15 @@ func (identity Identity) NewStream(conn io.ReadWriter, cb TrustCB) (ret *Stream,
 	) != 0 {
 		return ret, ErrEncrypt
 	}
-	if _, err := conn.Write(symMsg[:]); err != nil {
-		return ret, ErrSend
+	if err := writeAll(conn, symMsg[:]); err != nil {
+		return ret, &HandshakeError{Phase: PhaseSymmetricKey, Err: ErrSend, Cause: err}
 	}
 
 	// receive & decrypt symmetric receiver key
 	recvK := SymK{}
 
 	if _, err := io.ReadFull(conn, symMsg[:]); err != nil {
-		return ret, ErrRecv
+		return ret, &HandshakeError{Phase: PhaseSymmetricKey, Err: ErrRecv, Cause: err}
 	}
 	if C.crypto_box_open_easy(
 		ptr(recvK[:]),
@@ -195,85 +620,604 @@ func (identity Identity) NewStream(conn io.ReadWriter, cb TrustCB) (ret *Stream,
 	) != 0 {
 		return ret, ErrDecrypt
 	}
+	timer.lap(PhaseSymmetricKey)
 
 	// init stream states
-	header := [C.crypto_secretstream_xchacha20poly1305_HEADERBYTES]byte{}
-
-	if C.crypto_secretstream_xchacha20poly1305_init_push(
-		&ret.SendState,
-		ptr(header[:]),
-		ptr(sendK[:]),
-	) != 0 {
-		return ret, ErrEncrypt
+	sender, header, err := ret.Suite.NewSender(sendK)
+	if err != nil {
+		return ret, err
 	}
-	if _, err := conn.Write(header[:]); err != nil {
-		return ret, ErrSend
+	if err := writeAll(conn, header); err != nil {
+		return ret, &HandshakeError{Phase: PhaseHeader, Err: ErrSend, Cause: err}
 	}
-	if _, err := io.ReadFull(conn, header[:]); err != nil {
-		return ret, ErrRecv
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return ret, &HandshakeError{Phase: PhaseHeader, Err: ErrRecv, Cause: err}
 	}
-	if C.crypto_secretstream_xchacha20poly1305_init_pull(
-		&ret.RecvState,
-		ptr(header[:]),
-		ptr(recvK[:]),
-	) != 0 {
-		return ret, ErrDecrypt
+	receiver, err := ret.Suite.NewReceiver(recvK, header)
+	if err != nil {
+		return ret, err
+	}
+	timer.lap(PhaseHeader)
+	ret.sender = sender
+	ret.receiver = receiver
+
+	// all further reads must go through the buffer
+	rd := ret.connReader(conn)
+	if ret.cfg.bufsize > 0 {
+		ret.reader = bufio.NewReaderSize(rd, ret.cfg.bufsize)
+	} else {
+		ret.reader = bufio.NewReader(rd)
 	}
 
+	if ret.Caps&CapHello != 0 {
+		if err := ret.exchangeHello(); err != nil {
+			return ret, err
+		}
+		timer.lap(PhaseHello)
+	}
+
+	ret.established = time.Now()
 	return ret, nil
 }
 
+// Send sends msg in a single frame. Message boundaries are preserved:
+// the peer's Recv returns exactly msg. Empty messages are valid too.
 func (stream *Stream) Send(msg []byte) error {
-	// encode size
-	buf := make([]byte, 4+len(msg)+C.crypto_secretstream_xchacha20poly1305_ABYTES)
-	binary.LittleEndian.PutUint32(buf[:], uint32(len(msg)))
+	if err := stream.sendFrame(FrameData, msg, TagMessage); err != nil {
+		return err
+	}
+	stream.cfg.metrics.sent(len(msg))
+	return nil
+}
+
+// Reauthorize checks whether the peer is (still) trusted, like the
+// handshake does: revoked keys are always rejected, otherwise a valid
+// certificate or the approval of cb is sufficient. Long-lived sessions
+// may call this periodically to notice revocations & expired certificates.
+func (stream *Stream) Reauthorize(cb TrustCB) error {
+	if stream.cfg.revoked != nil && stream.cfg.revoked.Revoked(stream.OtherPK) {
+		return ErrRevoked
+	}
+
+	certErr := ErrTrust
+	if pool := stream.cfg.pool; pool != nil && len(stream.OtherCert) > 0 {
+		certErr = pool.Verify(stream.OtherPK, stream.OtherCert)
+	}
+	if certErr != nil {
+		if trust, err := stream.callTrust(cb); err != nil {
+			return &TrustError{Err: err}
+		} else if !trust && certErr != ErrTrust {
+			// report why the presented certificate was not accepted
+			return &TrustError{Err: certErr}
+		} else if !trust {
+			return ErrTrust
+		}
+	}
+	return nil
+}
+
+// callTrust calls cb for the peer, giving up after the trust timeout
+func (stream *Stream) callTrust(cb TrustCB) (bool, error) {
+	if stream.cfg.trustWait <= 0 {
+		return cb(stream.OtherPK)
+	}
+
+	type result struct {
+		trust bool
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		trust, err := cb(stream.OtherPK)
+		done <- result{trust, err}
+	}()
+
+	timer := time.NewTimer(stream.cfg.trustWait)
+	defer timer.Stop()
+	select {
+	case res := <-done:
+		return res.trust, res.err
+	case <-timer.C:
+		return false, ErrTrustTimeout
+	}
+}
+
+// SendString sends s as a single message, like Send.
+func (stream *Stream) SendString(s string) error {
+	return stream.Send([]byte(s))
+}
+
+// Sendf formats according to format (see fmt.Sprintf)
+// and sends the result as a single message, like Send.
+func (stream *Stream) Sendf(format string, args ...any) error {
+	return stream.Send([]byte(fmt.Sprintf(format, args...)))
+}
+
+// SendStderr sends diagnostic output on a channel separate from the data.
+// The peer's Recv passes it to the writer set by WithStderr.
+// It requires typed frames (see WithFrameTypes).
+func (stream *Stream) SendStderr(msg []byte) error {
+	if stream.Caps&CapFrameTypes == 0 {
+		return ErrProto
+	}
+	return stream.sendFrame(FrameStderr, msg, TagMessage)
+}
+
+// Ping asks the peer to reply with a pong frame,
+// which is consumed by the next call to Recv.
+// It requires typed frames (see WithFrameTypes).
+func (stream *Stream) Ping() error {
+	if stream.Caps&CapFrameTypes == 0 {
+		return ErrProto
+	}
+	return stream.sendFrame(FramePing, nil, TagMessage)
+}
+
+// Rekey rekeys the sending direction now: the peer rekeys its matching
+// receiving state when it reads the frame. See WithAutoRekey for doing
+// this periodically. It requires typed frames (see WithFrameTypes).
+func (stream *Stream) Rekey() error {
+	if stream.Caps&CapFrameTypes == 0 {
+		return ErrProto
+	}
+	return stream.sendFrame(FrameRekey, nil, TagRekey)
+}
+
+// sendFrame encrypts & sends one frame. It may be called concurrently,
+// since Recv replies to control frames on its own.
+func (stream *Stream) sendFrame(typ FrameType, msg []byte, tag Tag) error {
+	return stream.sendFrameOOB(typ, msg, tag, nil)
+}
+
+// sendFrameOOB is like sendFrame, but attaches out-of-band data if set
+func (stream *Stream) sendFrameOOB(typ FrameType, msg []byte, tag Tag, oob []byte) error {
+	stream.sendMtx.Lock()
+	defer stream.sendMtx.Unlock()
+
+	if stream.sendClosed {
+		return ErrClosed
+	}
+	if tag == TagFinal {
+		stream.sendClosed = true
+	}
+
+	// only payloads are compressed, not the empty control frames
+	if stream.Caps&CapCompression != 0 &&
+		(typ == FrameData || typ == FrameStderr || typ == FrameChannel) {
+		var err error
+		if msg, err = stream.compress(msg); err != nil {
+			return err
+		}
+	}
+
+	// prepend the frame type if agreed
+	if stream.Caps&CapFrameTypes != 0 {
+		plain := getBuf(1 + len(msg))
+		defer putBuf(plain)
+		(*plain)[0] = byte(typ)
+		copy((*plain)[1:], msg)
+		msg = *plain
+	}
+	if stream.Caps&CapPadding != 0 {
+		msg = pad(msg, stream.cfg.padding)
+	}
+
+	// encode header & size
+	hdr := 0
+	if stream.Caps&CapFrameHeader != 0 {
+		hdr = frameHeaderSize
+	}
+	frame := getBuf(hdr + 4 + len(msg) + stream.Suite.Overhead())
+	defer putBuf(frame)
+	buf := *frame
+	if hdr > 0 {
+		copy(buf, frameMagic)
+		buf[len(frameMagic)] = frameVersion
+		buf[len(frameMagic)+1] = 0
+	}
+	binary.LittleEndian.PutUint32(buf[hdr:], uint32(len(msg)))
+
+	// rekey on schedule, but never in place of a FINAL
+	stream.sinceRekey++
+	if tag == TagMessage && stream.cfg.autoRekey > 0 &&
+		stream.sinceRekey >= stream.cfg.autoRekey {
+		tag = TagRekey
+	}
 
 	// encrypt & send everything
-	if C.crypto_secretstream_xchacha20poly1305_push(
-		&stream.SendState,
-		ptr(buf[4:]),
-		nil,
-		ptr(msg),
-		C.ulonglong(len(msg)),
-		nil,
-		0,
-		0,
-	) != 0 {
-		return ErrEncrypt
+	if err := stream.sender.Seal(buf[hdr+4:], msg, tag); err != nil {
+		return err
 	}
-	_, err := stream.Conn.Write(buf)
-	return err
+	if tag == TagRekey {
+		stream.sinceRekey = 0
+		stream.rekeys.Add(1)
+		stream.lastRekey.Store(time.Now().UnixNano())
+		stream.cfg.metrics.rekeyed()
+	}
+
+	var err error
+	if oob != nil {
+		err = writeOOB(stream.Conn, buf, oob)
+	} else {
+		err = writeAll(stream.Conn, buf)
+	}
+	if err != nil {
+		return err
+	}
+
+	// only count what was sent
+	stream.framesSent.Add(1)
+	stream.bytesSent.Add(uint64(len(buf)))
+	return nil
 }
 
+// Recv returns the next message sent by the peer. Empty messages are
+// returned with a nil error, the end of the stream as ErrEOS.
+//
+// Timeouts (e.g. of a read deadline of the connection) and other
+// retryable errors (see Retryable) are returned as is and don't break
+// the stream: the part of the frame read so far is kept, and the next
+// call of Recv continues with it. All other errors of the connection
+// are returned as ErrRecv.
 func (stream *Stream) Recv() (ret []byte, err error) {
-	// receive size
-	buf := make([]byte, 4)
+	return stream.recv(nil)
+}
+
+// recv is like Recv, but decrypts into dst if it is big enough,
+// so that callers can reuse their buffer
+func (stream *Stream) recv(dst []byte) (ret []byte, err error) {
+	ch, ret, err := stream.recvChannel(dst)
+	if ch != 0 {
+		return nil, ErrChannel
+	}
+	return ret, err
+}
+
+// recvChannel is like recv, but also returns the data of other channels
+func (stream *Stream) recvChannel(dst []byte) (ch uint8, ret []byte, err error) {
+	for {
+		var typ FrameType
+		if typ, ret, err = stream.recvFrame(dst); err != nil {
+			return 0, ret, err
+		}
+
+		switch typ {
+		case FrameData, FrameStderr:
+		case FrameChannel:
+			if !stream.hasChannels() {
+				return 0, nil, ErrProto
+			}
+		case FramePing:
+			if err := stream.sendFrame(FramePong, nil, TagMessage); err != nil &&
+				err != ErrClosed {
+				return 0, nil, err
+			}
+			continue
+		case FramePong, FrameRekey, FrameHeartbeat:
+			continue
+		case FrameFinal:
+			stream.recvClosed.Store(true)
+			return 0, nil, ErrEOS
+		case FrameFD:
+			// its file descriptor was claimed by recvFrame
+			stream.fdFrames++
+			return 0, nil, ErrFDReceived
+		default:
+			return 0, nil, ErrProto
+		}
+
+		if stream.Caps&CapCompression != 0 {
+			if ret, err = decompress(ret, stream.cfg.limit); err != nil {
+				return 0, ret, err
+			}
+		}
+
+		if typ == FrameStderr {
+			if stream.cfg.stderr != nil {
+				stream.cfg.stderr.Write(ret)
+			}
+			continue
+		}
+
+		// the channel number comes first, empty data ends the channel
+		if typ == FrameChannel {
+			if len(ret) == 0 || ret[0] == 0 {
+				return 0, nil, ErrProto
+			}
+			if ch, ret = ret[0], ret[1:]; len(ret) == 0 {
+				return ch, nil, ErrEOS
+			}
+		}
+
+		stream.cfg.metrics.received(len(ret))
+		return ch, ret, nil
+	}
+}
+
+// RecvContext is like Recv, but gives up when ctx is done and returns
+// ctx.Err(). Like with a timeout, the stream stays usable. It requires a
+// connection with read deadlines (like net.Conn), otherwise it returns
+// ErrDeadline. Read deadlines set by the caller are cleared.
+func (stream *Stream) RecvContext(ctx context.Context) ([]byte, error) {
+	conn, ok := stream.Conn.(interface{ SetReadDeadline(time.Time) error })
+	if !ok {
+		return nil, ErrDeadline
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			conn.SetReadDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	ret, err := stream.Recv()
+	close(done)
+	<-stopped
+
+	if ctx.Err() != nil {
+		conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			return nil, ctx.Err()
+		}
+	}
+	return ret, err
+}
 
-	if _, err := io.ReadFull(stream.Conn, buf); err != nil {
-		return ret, ErrRecv
+// recvFrame receives & decrypts one frame into dst if it is big enough,
+// otherwise into a new buffer.
+// Without typed frames, every frame is a data frame.
+func (stream *Stream) recvFrame(dst []byte) (typ FrameType, ret []byte, err error) {
+	if stream.recvClosed.Load() {
+		return typ, nil, ErrEOS
+	}
+
+	// receive header & size
+	hdr := 0
+	if stream.Caps&CapFrameHeader != 0 {
+		hdr = frameHeaderSize
+	}
+	if stream.pending == nil {
+		stream.pending = stream.prefix[:hdr+4]
+	}
+	if err := stream.fill(); err != nil {
+		return typ, nil, err
+	}
+	prefix := stream.pending[:hdr+4]
+	if hdr > 0 && (string(prefix[:len(frameMagic)]) != frameMagic ||
+		prefix[len(frameMagic)] != frameVersion || prefix[len(frameMagic)+1] != 0) {
+		return typ, nil, ErrProto
 	}
 
 	// receive & decrypt message
-	siz := binary.LittleEndian.Uint32(buf[:])
-	buf = make([]byte, siz+C.crypto_secretstream_xchacha20poly1305_ABYTES)
-	ret = make([]byte, siz)
+	siz := binary.LittleEndian.Uint32(prefix[hdr:])
+	if stream.cfg.limit > 0 && int64(siz) > int64(stream.cfg.limit) {
+		return typ, nil, ErrBufferFull
+	}
+	if len(stream.pending) == len(prefix) {
+		stream.pendingBuf = getBuf(len(prefix) + int(siz) + stream.Suite.Overhead())
+		copy(*stream.pendingBuf, prefix)
+		stream.pending = *stream.pendingBuf
+	}
+	if err := stream.fill(); err != nil {
+		return typ, nil, err
+	}
+	buf := stream.pending[len(prefix):]
+	stream.bytesReceived.Add(uint64(len(stream.pending)))
+	if cap(dst) >= int(siz) {
+		ret = dst[:siz]
+	} else {
+		ret = make([]byte, siz)
+	}
 
-	if _, err := io.ReadFull(stream.Conn, buf); err != nil {
-		return ret, ErrRecv
+	tag, err := stream.receiver.Open(ret, buf)
+	putBuf(stream.pendingBuf)
+	stream.pending, stream.pendingBuf, stream.filled = nil, nil, 0
+	if err != nil {
+		stream.cfg.metrics.decryptFailed()
+		return typ, ret, err
 	}
-	if C.crypto_secretstream_xchacha20poly1305_pull(
-		&stream.RecvState,
-		ptr(ret),
-		nil,
-		nil,
-		ptr(buf),
-		size(buf),
-		nil,
-		0,
-	) != 0 {
-		return ret, ErrDecrypt
+	stream.framesReceived.Add(1)
+	stream.pushed = tag == TagPush
+	if tag == TagRekey {
+		stream.rekeys.Add(1)
+		stream.lastRekey.Store(time.Now().UnixNano())
+		stream.cfg.metrics.rekeyed()
+	}
+	if tag == TagFinal {
+		return FrameFinal, nil, stream.claimFDs(FrameFinal)
+	}
+
+	if stream.Caps&CapPadding != 0 {
+		if ret, err = unpad(ret); err != nil {
+			return typ, nil, err
+		}
+	}
+	if stream.Caps&CapFrameTypes != 0 {
+		if len(ret) == 0 {
+			return typ, nil, ErrProto
+		}
+		typ, ret = FrameType(ret[0]), ret[1:]
+	}
+	if err := stream.claimFDs(typ); err != nil {
+		return typ, nil, err
+	}
+	return typ, ret, nil
+}
+
+// fill reads from the connection until stream.pending is full.
+// On timeouts and retryable errors, it returns the error as is and keeps
+// what was read, so that the next call continues there.
+func (stream *Stream) fill() error {
+	for stream.filled < len(stream.pending) {
+		n, err := stream.reader.Read(stream.pending[stream.filled:])
+		stream.filled += n
+		if err == nil || stream.filled == len(stream.pending) {
+			continue
+		}
+
+		var timeout interface{ Timeout() bool }
+		if errors.As(err, &timeout) && timeout.Timeout() || Retryable(err) {
+			return err
+		}
+		return ErrRecv
+	}
+	return nil
+}
+
+// CloseWrite tells the peer that no more data will be sent by sending an
+// empty frame tagged FINAL. The peer's Recv then returns ErrEOS.
+// The underlying connection stays open, so data can still be received.
+// Afterwards, Send returns ErrClosed.
+func (stream *Stream) CloseWrite() error {
+	return stream.sendFrame(FrameFinal, nil, TagFinal)
+}
+
+// Close ends the stream, so that Stream can be used as an io.WriteCloser:
+// unless CloseWrite was called already, it sends FINAL, so the peer
+// receives everything written before and then ErrEOS. Nothing is buffered,
+// so there is nothing else to flush. Then the connection is closed
+// if it is an io.Closer.
+func (stream *Stream) Close() error {
+	err := stream.CloseWrite()
+	if err == ErrClosed {
+		err = nil
 	}
+	stream.closeFDs()
+	if closer, ok := stream.Conn.(io.Closer); ok {
+		if closeErr := closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
 
+// CloseWait is like Close, but before closing the connection, it waits
+// until the peer has sent FINAL as well, so both sides know that all data
+// was delivered. Frames received meanwhile are discarded.
+// ctx can only cancel waiting if the connection supports read deadlines
+// (see RecvContext); then ctx.Err() is returned.
+func (stream *Stream) CloseWait(ctx context.Context) error {
+	err := stream.CloseWrite()
+	if err == ErrClosed {
+		err = nil
+	}
+
+	for err == nil {
+		_, err = stream.RecvContext(ctx)
+		if err == ErrDeadline {
+			_, err = stream.Recv()
+		}
+		if err == ErrChannel {
+			err = nil
+		}
+	}
+	if err == ErrEOS {
+		err = nil
+	}
+
+	if closer, ok := stream.Conn.(io.Closer); ok {
+		if closeErr := closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// WaitPeerClose waits until the peer closes the connection after it sent
+// FINAL, e.g. to notice that a peer which is done sending went away
+// while we are still sending. It reads through the buffer of the stream,
+// so it must only be called once Recv returned ErrEOS, and not together
+// with Recv. Nothing may follow FINAL, so data results in ErrProto.
+// It returns nil once the peer closed the connection and ErrRecv if the
+// connection failed otherwise.
+func (stream *Stream) WaitPeerClose() error {
+	if !stream.recvClosed.Load() {
+		return ErrProto
+	}
+	switch _, err := stream.reader.ReadByte(); {
+	case err == nil:
+		return ErrProto
+	case errors.Is(err, io.EOF):
+		return nil
+	default:
+		return ErrRecv
+	}
+}
+
+// pad prefixes msg with its length and appends zeros
+// until the result is a multiple of blockSize
+func pad(msg []byte, blockSize int) []byte {
+	size := 4 + len(msg)
+	if blockSize > 1 {
+		size += (blockSize - size%blockSize) % blockSize
+	}
+
+	buf := make([]byte, size)
+	binary.LittleEndian.PutUint32(buf, uint32(len(msg)))
+	copy(buf[4:], msg)
+	return buf
+}
+
+// unpad returns the message inside a padded plaintext
+func unpad(buf []byte) ([]byte, error) {
+	if len(buf) < 4 {
+		return nil, ErrProto
+	}
+	size := binary.LittleEndian.Uint32(buf)
+	if int64(size) > int64(len(buf)-4) {
+		return nil, ErrProto
+	}
+	return buf[4 : 4+size], nil
+}
+
+func (stream *Stream) compress(msg []byte) ([]byte, error) {
+	buf := bytes.Buffer{}
+
+	// the writer is expensive to create, so reuse it
+	if stream.zw == nil {
+		zw, err := flate.NewWriter(&buf, stream.cfg.level)
+		if err != nil {
+			return nil, ErrCompress
+		}
+		stream.zw = zw
+	} else {
+		stream.zw.Reset(&buf)
+	}
+
+	if _, err := stream.zw.Write(msg); err != nil {
+		return nil, ErrCompress
+	}
+	if err := stream.zw.Close(); err != nil {
+		return nil, ErrCompress
+	}
+	return buf.Bytes(), nil
+}
+
+// MaxDecompressedBytes is the size limit of a decompressed message
+// if WithRecvLimit isn't used (see WithCompression).
+const MaxDecompressedBytes = 64 << 20
+
+func decompress(msg []byte, limit int) ([]byte, error) {
+	if limit <= 0 {
+		limit = MaxDecompressedBytes
+	}
+	src := io.LimitReader(flate.NewReader(bytes.NewReader(msg)), int64(limit)+1)
+
+	ret, err := io.ReadAll(src)
+	if err != nil {
+		return nil, ErrDecompress
+	}
+	if len(ret) > limit {
+		return nil, ErrBufferFull
+	}
 	return ret, nil
 }
 
@@ -283,12 +1227,24 @@ type BlockReader interface {
 	BlockRead() (p []byte, err error)
 }
 
+// BlockCopy writes all blocks read from src to dst until an error occurs.
+// Reading is repeated after retryable errors (see Retryable). Timeouts
+// end the copy, but don't break a Stream either: even mid-frame, Recv
+// keeps the part of the frame read so far, so calling BlockCopy again
+// continues where it stopped. All other errors, including those of
+// writing, end the copy.
 func BlockCopy(dst io.Writer, src BlockReader) (written int64, err error) {
+	retries := 0
 	for {
 		block, err := src.BlockRead()
 		if err != nil {
+			if Retryable(err) && retries < MaxRetries {
+				retries++
+				continue
+			}
 			return written, err
 		}
+		retries = 0
 
 		n, err := dst.Write(block)
 		if err != nil {
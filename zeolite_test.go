@@ -0,0 +1,1563 @@
+package zeolite_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/42LoCo42/go-zeolite"
+)
+
+func TestMain(m *testing.M) {
+	if err := zeolite.Init(); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+func TestIdentityBase64(t *testing.T) {
+	identity, err := zeolite.NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := zeolite.ParseIdentityBase64(identity.Base64())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed != identity {
+		t.Fatal("parsed identity differs from original")
+	}
+}
+
+func TestIdentityEqual(t *testing.T) {
+	ids := identities(t, 2)
+	same := ids[0]
+
+	if !ids[0].Equal(same) || !ids[0].Public.Equal(same.Public) {
+		t.Fatal("equal identities differ")
+	}
+	if ids[0].Equal(ids[1]) || ids[0].Public.Equal(ids[1].Public) {
+		t.Fatal("different identities are equal")
+	}
+}
+
+func TestIdentityBase64Malformed(t *testing.T) {
+	identity, err := zeolite.NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	public := zeolite.Base64Enc(identity.Public[:])
+	secret := zeolite.Base64Enc(identity.Secret[:])
+
+	for name, input := range map[string]string{
+		"empty":        "",
+		"no dash":      public + secret,
+		"extra dash":   public + "-" + secret + "-" + secret,
+		"bad base64":   public + "-" + strings.Repeat("!", len(secret)),
+		"short public": public[:8] + "-" + secret,
+		"long secret":  public + "-" + secret + zeolite.Base64Enc([]byte("x")),
+		"swapped":      secret + "-" + public,
+	} {
+		if _, err := zeolite.ParseIdentityBase64(input); err != zeolite.ErrIdentity {
+			t.Errorf("%s: expected ErrIdentity, got %v", name, err)
+		}
+	}
+}
+
+func TestLoadIdentity(t *testing.T) {
+	ids := identities(t, 2)
+	raw := append(ids[0].Public[:], ids[0].Secret[:]...)
+
+	loaded, err := zeolite.LoadIdentity(raw)
+	if err != nil || loaded != ids[0] {
+		t.Fatalf("failed to load a valid identity (%v)", err)
+	}
+
+	if _, err := zeolite.LoadIdentity(raw[:len(raw)-1]); err != zeolite.ErrIdentity {
+		t.Errorf("expected ErrIdentity for a short identity, got %v", err)
+	}
+
+	// someone else's public key
+	mixed := append(ids[1].Public[:], ids[0].Secret[:]...)
+	_, err = zeolite.LoadIdentity(mixed)
+	if err != zeolite.ErrKeyMismatch || !errors.Is(err, zeolite.ErrIdentity) {
+		t.Errorf("expected ErrKeyMismatch, got %v", err)
+	}
+}
+
+func TestEncryptIdentity(t *testing.T) {
+	ids := identities(t, 1)
+
+	data, err := ids[0].Encrypt([]byte("hunter2"))
+	if err != nil {
+		t.Fatalf("failed to encrypt identity (%v)", err)
+	}
+
+	decrypted, err := zeolite.DecryptIdentity(data, []byte("hunter2"))
+	if err != nil || decrypted != ids[0] {
+		t.Fatalf("failed to decrypt identity (%v)", err)
+	}
+
+	if _, err := zeolite.DecryptIdentity(data, []byte("hunter3")); err != zeolite.ErrDecrypt {
+		t.Errorf("expected ErrDecrypt for a wrong passphrase, got %v", err)
+	}
+
+	if _, err := zeolite.DecryptIdentity(data[1:], []byte("hunter2")); err != zeolite.ErrIdentity {
+		t.Errorf("expected ErrIdentity for truncated data, got %v", err)
+	}
+}
+
+func TestEncryptWriter(t *testing.T) {
+	ids := identities(t, 2)
+	key, err := ids[0].SharedKey(ids[1].Public)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, size := range []int{0, 100, 64 * 1024, 200000} {
+		msg := bytes.Repeat([]byte{'x'}, size)
+		buf := bytes.Buffer{}
+		w, err := zeolite.NewEncryptWriter(&buf, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		data := buf.Bytes()
+
+		r, err := zeolite.NewDecryptReader(bytes.NewReader(data), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := io.ReadAll(r); err != nil || !bytes.Equal(got, msg) {
+			t.Fatalf("size %d: got %d bytes (%v)", size, len(got), err)
+		}
+
+		// the end is authenticated
+		r, _ = zeolite.NewDecryptReader(bytes.NewReader(data[:len(data)-1]), key)
+		if _, err := io.ReadAll(r); err != io.ErrUnexpectedEOF {
+			t.Errorf("size %d: expected ErrUnexpectedEOF, got %v", size, err)
+		}
+		appended := append(append([]byte{}, data...), 0)
+		r, _ = zeolite.NewDecryptReader(bytes.NewReader(appended), key)
+		if _, err := io.ReadAll(r); err != zeolite.ErrFormat {
+			t.Errorf("size %d: expected ErrFormat for appended data, got %v", size, err)
+		}
+		data[len(data)-1] ^= 1
+		r, _ = zeolite.NewDecryptReader(bytes.NewReader(data), key)
+		if _, err := io.ReadAll(r); err != zeolite.ErrDecrypt {
+			t.Errorf("size %d: expected ErrDecrypt, got %v", size, err)
+		}
+	}
+
+	buf := bytes.Buffer{}
+	w, err := zeolite.NewPassphraseEncryptWriter(&buf, []byte("hunter2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("secret"))
+	w.Close()
+	data := buf.Bytes()
+
+	r, err := zeolite.NewPassphraseDecryptReader(bytes.NewReader(data), []byte("hunter2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := io.ReadAll(r); err != nil || string(got) != "secret" {
+		t.Fatalf("expected secret, got %q (%v)", got, err)
+	}
+	r, _ = zeolite.NewPassphraseDecryptReader(bytes.NewReader(data), []byte("hunter3"))
+	if _, err := io.ReadAll(r); err != zeolite.ErrDecrypt {
+		t.Errorf("expected ErrDecrypt for a wrong passphrase, got %v", err)
+	}
+	if _, err := zeolite.NewDecryptReader(bytes.NewReader(data), key); !errors.Is(err, zeolite.ErrDecrypt) {
+		t.Errorf("expected ErrDecrypt for a passphrase with a key, got %v", err)
+	}
+	if _, err := zeolite.NewDecryptReader(strings.NewReader("plain"), key); err != zeolite.ErrFormat {
+		t.Errorf("expected ErrFormat, got %v", err)
+	}
+
+	// errors of reading are not mistaken for a wrong format
+	errRead := errors.New("read failed")
+	if _, err := zeolite.NewDecryptReader(iotest.ErrReader(errRead), key); err != errRead {
+		t.Errorf("expected the read error, got %v", err)
+	}
+}
+
+// dial returns both ends of a TCP loopback connection
+func dial(t testing.TB) (client, server net.Conn) {
+	t.Helper()
+	return dialNet(t, "tcp", "127.0.0.1:0")
+}
+
+// dialNet returns both ends of a connection via a listener on address
+func dialNet(t testing.TB, network, address string) (client, server net.Conn) {
+	t.Helper()
+
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	if client, err = net.Dial(network, listener.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	if server, err = listener.Accept(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return client, server
+}
+
+// identities returns n new identities
+func identities(t testing.TB, n int) (ret []zeolite.Identity) {
+	t.Helper()
+
+	for i := 0; i < n; i++ {
+		identity, err := zeolite.NewIdentity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ret = append(ret, identity)
+	}
+	return ret
+}
+
+// pair returns two streams connected over TCP loopback
+func pair(t testing.TB, opts ...zeolite.Option) (a, b *zeolite.Stream) {
+	t.Helper()
+
+	connA, connB := dial(t)
+	return pairOver(t, connA, connB, opts, opts)
+}
+
+// pairOver returns two streams using both ends of a connection,
+// with the options of each side
+func pairOver(
+	t testing.TB,
+	connA, connB net.Conn,
+	optsA, optsB []zeolite.Option,
+) (a, b *zeolite.Stream) {
+	t.Helper()
+
+	ids := identities(t, 2)
+	a, b, errA, errB := handshake(ids[0], ids[1], connA, connB, optsA, optsB)
+	if errA != nil {
+		t.Fatal(errA)
+	}
+	if errB != nil {
+		t.Fatal(errB)
+	}
+	return a, b
+}
+
+// handshake creates the streams of idA & idB on both ends of a connection
+// concurrently and returns them along with their errors
+func handshake(
+	idA, idB zeolite.Identity,
+	connA, connB net.Conn,
+	optsA, optsB []zeolite.Option,
+) (a, b *zeolite.Stream, errA, errB error) {
+	done := make(chan struct{})
+	go func() {
+		b, errB = idB.NewStream(connB, trustAll, optsB...)
+		close(done)
+	}()
+
+	a, errA = idA.NewStream(connA, trustAll, optsA...)
+	<-done
+	return a, b, errA, errB
+}
+
+func trustAll(zeolite.SignPK) (bool, error) {
+	return true, nil
+}
+
+func TestCloseWrite(t *testing.T) {
+	a, b := pair(t)
+
+	if err := a.Send([]byte("last")); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Send([]byte("more")); err != zeolite.ErrClosed {
+		t.Fatalf("expected ErrClosed after CloseWrite, got %v", err)
+	}
+
+	if msg, err := b.Recv(); err != nil || string(msg) != "last" {
+		t.Fatalf("expected last, got %q (%v)", msg, err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := b.Recv(); err != zeolite.ErrEOS {
+			t.Fatalf("expected ErrEOS, got %v", err)
+		}
+	}
+
+	// the other direction is still open
+	if err := b.Send([]byte("reply")); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := a.Recv(); err != nil || string(msg) != "reply" {
+		t.Fatalf("expected reply, got %q (%v)", msg, err)
+	}
+}
+
+func TestCloseWait(t *testing.T) {
+	a, b := pair(t)
+
+	// b replies to everything, then closes too
+	go func() {
+		for {
+			msg, err := b.Recv()
+			if err != nil {
+				b.Close()
+				return
+			}
+			b.Send(msg)
+		}
+	}()
+
+	if err := a.Send([]byte("request")); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := a.CloseWait(ctx); err != nil {
+		t.Fatalf("expected a clean shutdown, got %v", err)
+	}
+
+	// a peer that never finishes
+	c, d := pair(t)
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := c.CloseWait(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected DeadlineExceeded, got %v", err)
+	}
+	if _, err := d.Recv(); err != zeolite.ErrEOS {
+		t.Fatalf("expected ErrEOS, got %v", err)
+	}
+}
+
+func TestWaitPeerClose(t *testing.T) {
+	a, b := pair(t)
+
+	if err := b.WaitPeerClose(); err != zeolite.ErrProto {
+		t.Fatalf("expected ErrProto before FINAL, got %v", err)
+	}
+	if err := a.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Recv(); err != zeolite.ErrEOS {
+		t.Fatalf("expected ErrEOS, got %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- b.WaitPeerClose() }()
+	a.Conn.(net.Conn).Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("closing the connection was not noticed")
+	}
+}
+
+func TestRelay(t *testing.T) {
+	src, relayIn := pair(t, zeolite.WithFrameHeader())
+	relayOut, dst := pair(t, zeolite.WithFrameTypes())
+
+	big := bytes.Repeat([]byte("relay"), 40000)
+	go func() {
+		src.SendReader(bytes.NewReader(big), int64(len(big)))
+		src.Send([]byte("small"))
+		src.CloseWrite()
+	}()
+
+	done := make(chan error, 1)
+	go func() {
+		n, err := zeolite.Relay(relayOut, relayIn)
+		if err == nil && n != int64(len(big)+len("small")) {
+			err = fmt.Errorf("relayed %d bytes", n)
+		}
+		done <- err
+	}()
+
+	// the parts of the big message still form one
+	buf := bytes.Buffer{}
+	if err := dst.RecvWriter(&buf); err != nil || !bytes.Equal(buf.Bytes(), big) {
+		t.Fatalf("expected %d bytes, got %d (%v)", len(big), buf.Len(), err)
+	}
+	if msg, err := dst.Recv(); err != nil || string(msg) != "small" {
+		t.Fatalf("expected small, got %q (%v)", msg, err)
+	}
+	if _, err := dst.Recv(); err != zeolite.ErrEOS {
+		t.Fatalf("expected ErrEOS, got %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChannels(t *testing.T) {
+	for name, opts := range map[string][]zeolite.Option{
+		"plain":      {zeolite.WithChannels()},
+		"compressed": {zeolite.WithChannels(), zeolite.WithCompression(-1)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			a, b := pair(t, opts...)
+
+			go func() {
+				a.SendChannel(1, []byte("control"))
+				a.SendChannel(0, []byte("data"))
+				a.SendChannel(2, nil) // not sent
+				a.CloseChannel(1)
+				a.SendChannel(2, []byte("other"))
+				a.CloseWrite()
+			}()
+
+			type result struct {
+				ch  uint8
+				msg string
+				err error
+			}
+			for _, want := range []result{
+				{1, "control", nil},
+				{0, "data", nil},
+				{1, "", zeolite.ErrEOS},
+				{2, "other", nil},
+				{0, "", zeolite.ErrEOS},
+			} {
+				ch, msg, err := b.RecvChannel()
+				if got := (result{ch, string(msg), err}); got != want {
+					t.Fatalf("expected %v, got %v", want, got)
+				}
+			}
+		})
+	}
+
+	// Recv doesn't mix channels up
+	a, b := pair(t, zeolite.WithChannels())
+	if err := a.SendChannel(1, []byte("control")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Recv(); err != zeolite.ErrChannel {
+		t.Fatalf("expected ErrChannel, got %v", err)
+	}
+
+	// channels must be agreed on, typed frames alone aren't enough
+	c, d := pair(t, zeolite.WithFrameTypes())
+	if err := c.SendChannel(1, []byte("control")); err != zeolite.ErrProto {
+		t.Fatalf("expected ErrProto, got %v", err)
+	}
+	if err := c.CloseChannel(1); err != zeolite.ErrProto {
+		t.Fatalf("expected ErrProto, got %v", err)
+	}
+
+	// and channel frames of a peer that ignores that are rejected
+	if err := zeolite.SendChannelFrame(c, 1, []byte("control")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := d.RecvChannel(); err != zeolite.ErrProto {
+		t.Fatalf("expected ErrProto, got %v", err)
+	}
+}
+
+// empty messages are data, not heartbeats or the end of the stream
+func TestEmptyMessage(t *testing.T) {
+	for name, opts := range map[string][]zeolite.Option{
+		"basic":        nil,
+		"compression":  {zeolite.WithCompression(6)},
+		"frame types":  {zeolite.WithFrameTypes()},
+		"padding":      {zeolite.WithFrameTypes(), zeolite.WithPadding(16)},
+		"frame header": {zeolite.WithFrameHeader()},
+	} {
+		t.Run(name, func(t *testing.T) {
+			a, b := pair(t, opts...)
+
+			for _, msg := range [][]byte{nil, {}, []byte("after")} {
+				if err := a.Send(msg); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := a.CloseWrite(); err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 0; i < 2; i++ {
+				if msg, err := b.Recv(); err != nil || len(msg) != 0 {
+					t.Fatalf("expected an empty message, got %q (%v)", msg, err)
+				}
+			}
+			if msg, err := b.Recv(); err != nil || string(msg) != "after" {
+				t.Fatalf("expected after, got %q (%v)", msg, err)
+			}
+			if _, err := b.Recv(); err != zeolite.ErrEOS {
+				t.Fatalf("expected ErrEOS, got %v", err)
+			}
+		})
+	}
+}
+
+// a small compressed frame must not decompress to an unbounded message
+func TestDecompressLimit(t *testing.T) {
+	a, b := pair(t, zeolite.WithCompression(9))
+
+	go a.Send(make([]byte, zeolite.MaxDecompressedBytes+1))
+	if _, err := b.Recv(); err != zeolite.ErrBufferFull {
+		t.Fatalf("expected ErrBufferFull, got %v", err)
+	}
+}
+
+// frames start with the header on the wire, other bytes are rejected
+func TestFrameHeader(t *testing.T) {
+	a, b := pair(t, zeolite.WithFrameHeader())
+
+	if err := a.Send([]byte("marked")); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := b.Recv(); err != nil || string(msg) != "marked" {
+		t.Fatalf("expected marked, got %q (%v)", msg, err)
+	}
+
+	if err := a.Send([]byte("raw")); err != nil {
+		t.Fatal(err)
+	}
+	hdr := make([]byte, 4)
+	if _, err := io.ReadFull(b.Conn, hdr); err != nil {
+		t.Fatal(err)
+	}
+	if string(hdr) != "ZF\x01\x00" {
+		t.Fatalf("unexpected frame header %q", hdr)
+	}
+
+	// a frame without the header looks out of sync
+	c, d := pair(t, zeolite.WithFrameHeader())
+	if _, err := c.Conn.Write(make([]byte, 32)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Recv(); err != zeolite.ErrProto {
+		t.Fatalf("expected ErrProto, got %v", err)
+	}
+}
+
+// holdConn holds back the second half of every write while hold is set
+type holdConn struct {
+	net.Conn
+	hold bool
+	held []byte
+}
+
+func (c *holdConn) Write(p []byte) (int, error) {
+	if !c.hold {
+		return c.Conn.Write(p)
+	}
+	half := len(p) / 2
+	c.held = append(c.held, p[half:]...)
+	if _, err := c.Conn.Write(p[:half]); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// release sends everything held back and stops holding
+func (c *holdConn) release() error {
+	c.hold = false
+	_, err := c.Conn.Write(c.held)
+	return err
+}
+
+// a timeout in the middle of a frame doesn't break the stream
+func TestRecvTimeout(t *testing.T) {
+	connA, connB := dial(t)
+	hold := &holdConn{Conn: connA}
+	a, b := pairOver(t, hold, connB, nil, nil)
+
+	// nothing to read at all
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := b.RecvContext(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected DeadlineExceeded, got %v", err)
+	}
+
+	// only half a frame arrives
+	hold.hold = true
+	if err := a.Send([]byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	connB.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err := b.Recv(); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+	connB.SetReadDeadline(time.Time{})
+
+	if err := hold.release(); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Send([]byte("second")); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"first", "second"} {
+		if msg, err := b.Recv(); err != nil || string(msg) != want {
+			t.Fatalf("expected %s, got %q (%v)", want, msg, err)
+		}
+	}
+}
+
+// messages bigger than a frame arrive in one piece
+func TestSendReader(t *testing.T) {
+	a, b := pair(t, zeolite.WithFrameTypes())
+
+	for _, size := range []int{0, 100, 128 * 1024, 200000} {
+		msg := make([]byte, size)
+		for i := range msg {
+			msg[i] = byte(i * 7)
+		}
+
+		errs := make(chan error, 1)
+		go func() {
+			if err := a.SendReader(bytes.NewReader(msg), int64(size)); err != nil {
+				errs <- err
+				return
+			}
+			errs <- a.Send([]byte("next"))
+		}()
+
+		var got bytes.Buffer
+		if err := b.RecvWriter(&got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.Bytes(), msg) {
+			t.Fatalf("%d bytes: received %d different bytes", size, got.Len())
+		}
+		if next, err := b.Recv(); err != nil || string(next) != "next" {
+			t.Fatalf("expected next, got %q (%v)", next, err)
+		}
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the reader must provide all of size
+	if err := a.SendReader(strings.NewReader("short"), 10); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected ErrUnexpectedEOF, got %v", err)
+	}
+}
+
+// frames keep flowing across automatic and explicit rekeys
+func TestAutoRekey(t *testing.T) {
+	rekeyed := new(expvar.Float)
+	a, b := pair(t, zeolite.WithFrameTypes(), zeolite.WithAutoRekey(8),
+		zeolite.WithMetrics(&zeolite.Metrics{Rekeys: rekeyed}))
+
+	const count = 100
+	msg := bytes.Repeat([]byte("rekey"), 200)
+
+	errs := make(chan error, 1)
+	go func() {
+		for i := 0; i < count; i++ {
+			if err := a.Send(msg); err != nil {
+				errs <- err
+				return
+			}
+		}
+		if err := a.Rekey(); err != nil {
+			errs <- err
+			return
+		}
+		errs <- a.Send([]byte("done"))
+	}()
+
+	for i := 0; i < count; i++ {
+		if got, err := b.Recv(); err != nil || !bytes.Equal(got, msg) {
+			t.Fatalf("message %d: got %d bytes (%v)", i, len(got), err)
+		}
+	}
+	if got, err := b.Recv(); err != nil || string(got) != "done" {
+		t.Fatalf("expected done, got %q (%v)", got, err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	// 12 scheduled rekeys plus the explicit one
+	const rekeys = count/8 + 1
+	if got := a.DebugState().Rekeys; got != rekeys {
+		t.Errorf("sender rekeyed %d times, expected %d", got, rekeys)
+	}
+	if got := b.DebugState().Rekeys; got != rekeys {
+		t.Errorf("receiver rekeyed %d times, expected %d", got, rekeys)
+	}
+	if got := rekeyed.Value(); got != 2*rekeys {
+		t.Errorf("counted %v rekeys of both sides, expected %d", got, 2*rekeys)
+	}
+}
+
+// tempError is a temporary error, optionally a timeout
+type tempError struct{ timeout bool }
+
+func (tempError) Error() string   { return "temporary error" }
+func (tempError) Temporary() bool { return true }
+func (e tempError) Timeout() bool { return e.timeout }
+
+// blocks is a BlockReader returning its results one after another
+type blocks []struct {
+	block []byte
+	err   error
+}
+
+func (b *blocks) BlockRead() ([]byte, error) {
+	next := (*b)[0]
+	*b = (*b)[1:]
+	return next.block, next.err
+}
+
+func TestBlockCopyRetries(t *testing.T) {
+	src := &blocks{
+		{[]byte("one "), nil},
+		{nil, tempError{}},
+		{nil, fmt.Errorf("read: %w", syscall.EINTR)},
+		{[]byte("two"), nil},
+		{nil, tempError{timeout: true}},
+	}
+
+	var dst bytes.Buffer
+	n, err := zeolite.BlockCopy(&dst, src)
+	if err != (tempError{timeout: true}) {
+		t.Fatalf("expected the timeout to end the copy, got %v", err)
+	}
+	if n != 7 || dst.String() != "one two" {
+		t.Fatalf("copied %d bytes: %q", n, dst.String())
+	}
+}
+
+// closing a chain of writers on top of a stream delivers everything
+func TestCloseChain(t *testing.T) {
+	a, b := pair(t)
+
+	files := map[string]string{
+		"a.txt":     "first file\n",
+		"dir/b.txt": strings.Repeat("second file\n", 10000),
+		"empty":     "",
+	}
+
+	written := make(chan error, 1)
+	go func() {
+		gz := gzip.NewWriter(a)
+		tw := tar.NewWriter(gz)
+		for name, content := range files {
+			hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(content))}
+			if err := tw.WriteHeader(hdr); err != nil {
+				written <- err
+				return
+			}
+			if _, err := tw.Write([]byte(content)); err != nil {
+				written <- err
+				return
+			}
+		}
+		for _, closer := range []io.Closer{tw, gz, a} {
+			if err := closer.Close(); err != nil {
+				written <- err
+				return
+			}
+		}
+		written <- nil
+	}()
+
+	// the stream must end with ErrEOS, not a broken connection
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := zeolite.BlockCopy(pw, b)
+		if err == zeolite.ErrEOS {
+			err = nil
+		}
+		pw.CloseWithError(err)
+	}()
+
+	gz, err := gzip.NewReader(pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := map[string]string{}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		received[hdr.Name] = string(content)
+	}
+	if _, err := io.Copy(io.Discard, gz); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(io.Discard, pr); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(received, files) {
+		t.Fatalf("received %d files, expected %d", len(received), len(files))
+	}
+}
+
+// closeRecorder remembers whether it was closed
+type closeRecorder struct {
+	net.Conn
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return c.Conn.Close()
+}
+
+func TestNewStreamClosesOnError(t *testing.T) {
+	ids := identities(t, 2)
+	connA, connB := dial(t)
+
+	go ids[0].NewStream(connA, trustAll)
+
+	rec := &closeRecorder{Conn: connB}
+	trustNone := func(zeolite.SignPK) (bool, error) { return false, nil }
+	if _, err := ids[1].NewStream(rec, trustNone); err != zeolite.ErrTrust {
+		t.Fatalf("expected ErrTrust, got %v", err)
+	}
+	if !rec.closed {
+		t.Fatal("connection was not closed after trust rejection")
+	}
+}
+
+func TestNewStreamClosedConn(t *testing.T) {
+	ids := identities(t, 1)
+
+	for _, closed := range []string{"own end", "other end"} {
+		t.Run(closed, func(t *testing.T) {
+			conn, other := net.Pipe()
+			defer conn.Close()
+			if closed == "own end" {
+				conn.Close()
+			} else {
+				other.Close()
+			}
+
+			errs := make(chan error, 1)
+			go func() {
+				_, err := ids[0].NewStream(conn, trustAll)
+				errs <- err
+			}()
+
+			select {
+			case err := <-errs:
+				handshakeErr := &zeolite.HandshakeError{}
+				if !errors.Is(err, zeolite.ErrSend) || !errors.As(err, &handshakeErr) ||
+					handshakeErr.Phase != zeolite.PhaseBanner {
+					t.Fatalf("expected ErrSend during the banner, got %v", err)
+				}
+				if !strings.Contains(err.Error(), "banner") {
+					t.Fatalf("phase missing in %q", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("NewStream hangs on a closed connection")
+			}
+		})
+	}
+}
+
+func TestTrustError(t *testing.T) {
+	ids := identities(t, 2)
+	connA, connB := dial(t)
+
+	go ids[0].NewStream(connA, trustAll)
+
+	errStore := errors.New("could not load trust store")
+	trustFail := func(zeolite.SignPK) (bool, error) { return false, errStore }
+
+	_, err := ids[1].NewStream(connB, trustFail)
+	if !errors.Is(err, zeolite.ErrTrust) {
+		t.Fatalf("expected ErrTrust, got %v", err)
+	}
+	if !errors.Is(err, errStore) {
+		t.Fatalf("expected the error of the callback, got %v", err)
+	}
+}
+
+func TestTrustTimeout(t *testing.T) {
+	ids := identities(t, 2)
+	connA, connB := dial(t)
+
+	go ids[0].NewStream(connA, trustAll)
+
+	release := make(chan struct{})
+	defer close(release)
+	trustSlow := func(zeolite.SignPK) (bool, error) {
+		<-release
+		return true, nil
+	}
+
+	_, err := ids[1].NewStream(connB, trustSlow,
+		zeolite.WithTrustTimeout(20*time.Millisecond))
+	if !errors.Is(err, zeolite.ErrTrust) || !errors.Is(err, zeolite.ErrTrustTimeout) {
+		t.Fatalf("expected ErrTrustTimeout, got %v", err)
+	}
+}
+
+// impersonate performs the handshake on conn as far as the peer lets it,
+// claiming to be claimed but signing with the key of signer.
+// It offers no capabilities, so there are no challenges.
+func impersonate(conn net.Conn, claimed, signer zeolite.Identity) error {
+	banner := make([]byte, len(zeolite.Protocol))
+	otherPK := zeolite.SignPK{}
+	if _, err := conn.Write([]byte(zeolite.Protocol)); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(conn, banner); err != nil {
+		return err
+	}
+	if _, err := conn.Write(claimed.Public[:]); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(conn, otherPK[:]); err != nil {
+		return err
+	}
+
+	ephPK := zeolite.EphPK{}
+	if _, err := rand.Read(ephPK[:]); err != nil {
+		return err
+	}
+	ephMsg := ed25519.Sign(ed25519.PrivateKey(signer.Secret[:]), ephPK[:])
+	if _, err := conn.Write(append(ephMsg, ephPK[:]...)); err != nil {
+		return err
+	}
+
+	// the key of the peer, then garbage instead of our symmetric key
+	// (nonce, MAC and key)
+	if _, err := io.ReadFull(conn, make([]byte, len(ephMsg)+len(ephPK))); err != nil {
+		return err
+	}
+	_, err := conn.Write(make([]byte, 24+16+len(zeolite.SymK{})))
+	return err
+}
+
+func TestWrongPeerKey(t *testing.T) {
+	ids := identities(t, 3)
+
+	for _, test := range []struct {
+		name   string
+		signer zeolite.Identity
+		err    error
+	}{
+		// makes sure that the impersonation is correct otherwise
+		{"right key", ids[1], zeolite.ErrDecrypt},
+		{"wrong key", ids[2], zeolite.ErrVerify},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			connA, connB := dial(t)
+			go impersonate(connB, ids[1], test.signer)
+
+			_, err := ids[0].NewStream(connA, trustAll)
+			if err != test.err {
+				t.Fatalf("expected %v, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestTimings(t *testing.T) {
+	ids := identities(t, 2)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			ids[1].NewStream(conn, trustAll)
+		}
+	}()
+
+	phases := []string{}
+	stream, err := ids[0].Dial("tcp", listener.Addr().String(), trustAll,
+		zeolite.WithTimings(func(phase string, d time.Duration) {
+			if d < 0 {
+				t.Errorf("negative duration of %s: %v", phase, d)
+			}
+			phases = append(phases, phase)
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Conn.(net.Conn).Close()
+
+	expected := []string{
+		zeolite.PhaseResolve, zeolite.PhaseConnect, zeolite.PhaseBanner,
+		zeolite.PhaseIdentity, zeolite.PhaseTrust, zeolite.PhaseKeyExchange,
+		zeolite.PhaseVerify, zeolite.PhaseSymmetricKey, zeolite.PhaseHeader,
+	}
+	if !reflect.DeepEqual(phases, expected) {
+		t.Fatalf("expected phases %v, got %v", expected, phases)
+	}
+}
+
+func TestHello(t *testing.T) {
+	t.Run("both", func(t *testing.T) {
+		connA, connB := dial(t)
+		a, b := pairOver(t, connA, connB,
+			[]zeolite.Option{zeolite.WithHello([]byte("v1")), zeolite.WithCompression(-1)},
+			[]zeolite.Option{zeolite.WithHello(nil), zeolite.WithCompression(-1)})
+		if string(b.OtherHello) != "v1" || a.OtherHello == nil || len(a.OtherHello) != 0 {
+			t.Fatalf("wrong hellos: %q, %q", a.OtherHello, b.OtherHello)
+		}
+
+		// the hello is not returned by Recv
+		if err := a.Send([]byte("data")); err != nil {
+			t.Fatal(err)
+		}
+		if msg, err := b.Recv(); err != nil || string(msg) != "data" {
+			t.Fatalf("expected data, got %q (%v)", msg, err)
+		}
+	})
+
+	t.Run("one", func(t *testing.T) {
+		connA, connB := dial(t)
+		a, b := pairOver(t, connA, connB,
+			[]zeolite.Option{zeolite.WithHello([]byte("v1"))}, nil)
+		if a.OtherHello != nil || b.OtherHello != nil || a.Caps&zeolite.CapHello != 0 {
+			t.Fatal("hellos were exchanged with a peer that doesn't offer them")
+		}
+	})
+
+	// each side pads to its own block size
+	t.Run("padding", func(t *testing.T) {
+		connA, connB := dial(t)
+		a, b := pairOver(t, connA, connB,
+			[]zeolite.Option{zeolite.WithHello([]byte("v1")), zeolite.WithPadding(16)},
+			[]zeolite.Option{zeolite.WithHello([]byte("v2")), zeolite.WithPadding(8192)})
+		if string(a.OtherHello) != "v2" || string(b.OtherHello) != "v1" {
+			t.Fatalf("wrong hellos: %q, %q", a.OtherHello, b.OtherHello)
+		}
+	})
+
+	t.Run("too big", func(t *testing.T) {
+		big := make([]byte, zeolite.MaxHelloBytes+1)
+		ids := identities(t, 2)
+		connA, connB := dial(t)
+		_, _, errA, _ := handshake(ids[0], ids[1], connA, connB,
+			[]zeolite.Option{zeolite.WithHello(big)},
+			[]zeolite.Option{zeolite.WithHello(nil)})
+		if errA != zeolite.ErrProto {
+			t.Fatalf("expected ErrProto, got %v", errA)
+		}
+	})
+}
+
+func TestReauthorize(t *testing.T) {
+	revoked := filepath.Join(t.TempDir(), "revoked")
+	if err := os.WriteFile(revoked, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	list, err := zeolite.LoadRevocationList(revoked)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, _ := pair(t, zeolite.WithRevocationList(list))
+
+	errCB := errors.New("callback failed")
+	trustNone := func(zeolite.SignPK) (bool, error) { return false, nil }
+	failing := func(zeolite.SignPK) (bool, error) { return false, errCB }
+	if err := a.Reauthorize(trustAll); err != nil {
+		t.Fatalf("expected the peer to stay trusted, got %v", err)
+	}
+	if err := a.Reauthorize(trustNone); err != zeolite.ErrTrust {
+		t.Fatalf("expected ErrTrust, got %v", err)
+	}
+	if err := a.Reauthorize(failing); !errors.Is(err, zeolite.ErrTrust) ||
+		!errors.Is(err, errCB) {
+		t.Fatalf("expected the error of the callback, got %v", err)
+	}
+
+	// a key revoked after the handshake is rejected, even if trusted
+	other := zeolite.Base64Enc(a.OtherPK[:])
+	if err := os.WriteFile(revoked, []byte(other+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Hour)
+	if err := os.Chtimes(revoked, future, future); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Reauthorize(trustAll); err != zeolite.ErrRevoked {
+		t.Fatalf("expected ErrRevoked, got %v", err)
+	}
+}
+
+func TestCertValidity(t *testing.T) {
+	ids := identities(t, 2)
+	start := time.Now().Add(time.Minute)
+	cert := ids[0].IssueCertValid(ids[1].Public, start, start.Add(time.Hour))
+
+	pool := zeolite.NewCertPool(ids[0].Public)
+	err := pool.Verify(ids[1].Public, cert)
+	validity := &zeolite.CertValidityError{}
+	if !errors.Is(err, zeolite.ErrCertNotYetValid) || !errors.As(err, &validity) {
+		t.Fatalf("expected ErrCertNotYetValid, got %v", err)
+	}
+	if validity.NotBefore.Unix() != start.Unix() ||
+		!strings.Contains(err.Error(), start.Format(time.RFC3339)) {
+		t.Fatalf("validity window missing in %v", err)
+	}
+
+	pool.Skew = 2 * time.Minute
+	if err := pool.Verify(ids[1].Public, cert); err != nil {
+		t.Fatalf("expected the skew to be tolerated, got %v", err)
+	}
+
+	// a rejected peer is told why its certificate was not accepted
+	expired := ids[0].IssueCertValid(ids[1].Public,
+		start.Add(-2*time.Hour), start.Add(-time.Hour))
+	connA, connB := dial(t)
+	go ids[1].NewStream(connB, trustAll, zeolite.WithCert(expired))
+
+	trustNone := func(zeolite.SignPK) (bool, error) { return false, nil }
+	_, err = ids[0].NewStream(connA, trustNone,
+		zeolite.WithCertPool(zeolite.NewCertPool(ids[0].Public)))
+	if !errors.Is(err, zeolite.ErrTrust) || !errors.As(err, &validity) {
+		t.Fatalf("expected an expired certificate, got %v", err)
+	}
+}
+
+func TestIdentitySelector(t *testing.T) {
+	ids := identities(t, 4)
+	server, work, known, unknown := ids[0], ids[1], ids[2], ids[3]
+	selector := zeolite.IdentityMap{known.Public: work}
+
+	for _, test := range []struct {
+		name     string
+		client   zeolite.Identity
+		expected zeolite.Identity
+		opts     []zeolite.Option
+	}{
+		{"known", known, work, nil},
+		{"unknown", unknown, server, nil},
+		// certificates follow the keys, a challenge is signed later
+		{"cert", known, work, []zeolite.Option{
+			zeolite.WithCert(server.IssueCert(known.Public)),
+			zeolite.WithChallenge(),
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			connA, connB := dial(t)
+			serverOpts := append([]zeolite.Option{
+				zeolite.WithIdentitySelector(selector.Select)}, test.opts...)
+			stream, _, errA, errB := handshake(test.client, server, connA, connB,
+				test.opts, serverOpts)
+			if errA != nil {
+				t.Fatal(errA)
+			}
+			if errB != nil {
+				t.Fatal(errB)
+			}
+			if stream.OtherPK != test.expected.Public {
+				t.Fatal("the server presented the wrong identity")
+			}
+		})
+	}
+}
+
+func TestCapsNegotiation(t *testing.T) {
+	for _, test := range []struct {
+		name         string
+		optsA, optsB []zeolite.Option
+		caps         zeolite.Caps
+		protocol     string
+	}{
+		{"none", nil, nil, 0, zeolite.Protocol},
+		{"one side", []zeolite.Option{zeolite.WithCompression(-1)}, nil,
+			0, zeolite.Protocol},
+		{"intersection",
+			[]zeolite.Option{zeolite.WithCompression(-1), zeolite.WithFrameTypes()},
+			[]zeolite.Option{zeolite.WithFrameTypes(), zeolite.WithFrameHeader()},
+			zeolite.CapFrameTypes, zeolite.ProtocolEx},
+		{"channels one side",
+			[]zeolite.Option{zeolite.WithChannels()},
+			[]zeolite.Option{zeolite.WithFrameTypes()},
+			zeolite.CapFrameTypes, zeolite.ProtocolEx},
+		{"channels",
+			[]zeolite.Option{zeolite.WithChannels()},
+			[]zeolite.Option{zeolite.WithChannels()},
+			zeolite.CapFrameTypes | zeolite.CapChannels, zeolite.ProtocolEx},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			connA, connB := dial(t)
+			a, b := pairOver(t, connA, connB, test.optsA, test.optsB)
+			if a.Caps != test.caps || b.Caps != test.caps {
+				t.Fatalf("expected caps %#x, got %#x and %#x", test.caps, a.Caps, b.Caps)
+			}
+			// the extended banner is only used if both sides send it
+			if protocol := a.DebugState().Protocol; protocol != test.protocol {
+				t.Fatalf("expected protocol %s, got %s", test.protocol, protocol)
+			}
+		})
+	}
+}
+
+func TestDebugState(t *testing.T) {
+	connA, connB := dial(t)
+	a, b := pairOver(t, connA, connB, nil, nil)
+	if err := a.Send([]byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Recv(); err != nil {
+		t.Fatal(err)
+	}
+
+	sent, received := a.DebugState(), b.DebugState()
+	if sent.FramesSent != 1 || received.FramesReceived != 1 ||
+		sent.BytesSent == 0 || sent.BytesSent != received.BytesReceived {
+		t.Fatalf("wrong counters: %+v, %+v", sent, received)
+	}
+
+	// frames that couldn't be written are not counted
+	connA.Close()
+	if err := a.Send([]byte("data")); err == nil {
+		t.Fatal("sent over a closed connection")
+	}
+	if got := a.DebugState(); got.FramesSent != 1 || got.BytesSent != sent.BytesSent {
+		t.Fatalf("failed frame was counted: %+v", got)
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	for _, version := range []byte{1, 2} {
+		t.Run(fmt.Sprint("version ", version), func(t *testing.T) {
+			connA, connB := dial(t)
+			opts := []zeolite.Option{zeolite.WithCompression(9)}
+			a, b := pairOver(t, connA, connB, opts, opts)
+
+			state, err := a.Export()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if version == 1 {
+				// without the compression level after the padding
+				state = append(append([]byte{1}, state[1:45]...), state[49:]...)
+			}
+
+			imported, err := zeolite.ImportStream(connA, state)
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg := make([]byte, 64<<10)
+			if err := imported.Send(msg); err != nil {
+				t.Fatal(err)
+			}
+			if got, err := b.Recv(); err != nil || !bytes.Equal(got, msg) {
+				t.Fatalf("received %d bytes (%v)", len(got), err)
+			}
+
+			// zeros must be compressed, not just stored
+			if sent := imported.DebugState().BytesSent; sent > 1024 {
+				t.Fatalf("sent %d bytes for a compressible message", sent)
+			}
+		})
+	}
+}
+
+func TestSharedKey(t *testing.T) {
+	a := seededIdentity(t, 'A')
+	b := seededIdentity(t, 'B')
+	c := seededIdentity(t, 'C')
+
+	ab, err := a.SharedKey(b.Public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ba, err := b.SharedKey(a.Public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ac, err := a.SharedKey(c.Public)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ab != ba {
+		t.Fatal("both sides derived different keys")
+	}
+	if ab == ac {
+		t.Fatal("different peers share a key")
+	}
+
+	// test vectors
+	for name, tc := range map[string]struct {
+		key  zeolite.SymK
+		want string
+	}{
+		"A-B": {ab, "d0c510cfbd390536b4262c982ffa53f4843bc86a884bd192adf635d2b83bc35d"},
+		"A-C": {ac, "43ad9dd37d369b76c2d6edf9f1578bdaba79ecaca22016722cf470769f62bab8"},
+	} {
+		if got := hex.EncodeToString(tc.key[:]); got != tc.want {
+			t.Errorf("%s: expected %s, got %s", name, tc.want, got)
+		}
+	}
+
+	// low-order points are rejected
+	if _, err := a.SharedKey(zeolite.SignPK{}); err != zeolite.ErrKeygen {
+		t.Fatalf("expected ErrKeygen for an invalid key, got %v", err)
+	}
+}
+
+func ExampleNewIdentity() {
+	if err := zeolite.Init(); err != nil {
+		log.Fatal(err)
+	}
+
+	identity, err := zeolite.NewIdentity()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// the fingerprint is what users compare out of band
+	fmt.Println(len(strings.Split(identity.Public.Fingerprint(), ":")))
+	// Output: 8
+}
+
+// Two participants handshake over a local connection and exchange
+// a message. net.Pipe doesn't work here: it has no buffer, and both
+// sides write their banner before reading the other one.
+func Example() {
+	alice, err := zeolite.NewIdentity()
+	if err != nil {
+		log.Fatal(err)
+	}
+	bob, err := zeolite.NewIdentity()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer listener.Close()
+
+	// both only talk to each other
+	trustAlice := func(otherPK zeolite.SignPK) (bool, error) {
+		return otherPK.Equal(alice.Public), nil
+	}
+	trustBob := func(otherPK zeolite.SignPK) (bool, error) {
+		return otherPK.Equal(bob.Public), nil
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Fatal(err)
+		}
+		stream, err := bob.NewStream(conn, trustAlice)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer stream.Close()
+
+		msg, err := stream.Recv()
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("bob got: %s\n", msg)
+
+		if err := stream.Send([]byte("hi alice")); err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		log.Fatal(err)
+	}
+	stream, err := alice.NewStream(conn, trustBob)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer stream.Close()
+
+	if err := stream.Send([]byte("hi bob")); err != nil {
+		log.Fatal(err)
+	}
+	msg, err := stream.Recv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	<-done
+	fmt.Printf("alice got: %s\n", msg)
+
+	// Output:
+	// bob got: hi bob
+	// alice got: hi alice
+}
+
+func TestHandshakeLimiter(t *testing.T) {
+	limiter := zeolite.NewHandshakeLimiter(3, 2)
+	addr := func(host byte, port int) net.Addr {
+		return &net.TCPAddr{IP: net.IPv4(192, 0, 2, host), Port: port}
+	}
+
+	for i, step := range []struct {
+		addr    net.Addr
+		acquire bool // otherwise release
+		ok      bool
+	}{
+		{addr(1, 1), true, true},
+		{addr(1, 2), true, true},
+		{addr(1, 3), true, false}, // per IP
+		{addr(2, 1), true, true},
+		{addr(3, 1), true, false}, // in total
+		{addr(1, 1), false, true},
+		{addr(3, 1), true, true},
+		{addr(1, 3), true, false},
+	} {
+		if !step.acquire {
+			limiter.Release(step.addr)
+		} else if ok := limiter.Acquire(step.addr); ok != step.ok {
+			t.Fatalf("step %d: expected %v, got %v", i, step.ok, ok)
+		}
+	}
+
+	unlimited := zeolite.NewHandshakeLimiter(0, 0)
+	for i := 0; i < 100; i++ {
+		if !unlimited.Acquire(addr(1, 1)) {
+			t.Fatal("unlimited handshakes were limited")
+		}
+	}
+}
+
+// deciding about trust doesn't count towards the handshake timeout
+func TestHandshakeTimeoutTrust(t *testing.T) {
+	ids := identities(t, 2)
+	slowTrust := func(zeolite.SignPK) (bool, error) {
+		time.Sleep(300 * time.Millisecond)
+		return true, nil
+	}
+
+	listener, err := ids[0].Listen("tcp", "127.0.0.1:0", slowTrust)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	listener.HandshakeTimeout = 100 * time.Millisecond
+	go listener.Serve(func(stream *zeolite.Stream) {
+		stream.Send([]byte("served"))
+	})
+
+	stream, err := ids[1].Dial("tcp", listener.Addr().String(), trustAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Conn.(net.Conn).Close()
+	if msg, err := stream.Recv(); err != nil || string(msg) != "served" {
+		t.Fatalf("expected served, got %q (%v)", msg, err)
+	}
+}
+
+// a client rejected by the server isn't retried
+func TestDialRejected(t *testing.T) {
+	ids := identities(t, 2)
+	trustNone := func(zeolite.SignPK) (bool, error) { return false, nil }
+
+	listener, err := ids[0].Listen("tcp", "127.0.0.1:0", trustNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go listener.Serve(func(stream *zeolite.Stream) {})
+
+	dialer := ids[1].NewDialer(trustAll)
+	dialer.Retries = 3
+	dialer.Backoff = time.Second
+
+	start := time.Now()
+	_, err = dialer.Dial("tcp", listener.Addr().String())
+	if err == nil || zeolite.IsRetryable(err) {
+		t.Fatalf("expected a permanent error, got %v", err)
+	}
+	if time.Since(start) > dialer.Backoff {
+		t.Fatal("rejected dial was retried")
+	}
+}
+
+// the fallback receives the connection including the inspected bytes
+func TestListenerFallback(t *testing.T) {
+	ids := identities(t, 1)
+	listener, err := ids[0].Listen("tcp", "127.0.0.1:0", trustAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	received := make(chan []byte, 1)
+	listener.Fallback = func(conn net.Conn) {
+		data, _ := io.ReadAll(conn)
+		received <- data
+	}
+	go listener.Serve(func(stream *zeolite.Stream) {})
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	request := "GET /health HTTP/1.0\r\n\r\n"
+	if _, err := io.WriteString(conn, request); err != nil {
+		t.Fatal(err)
+	}
+	conn.(*net.TCPConn).CloseWrite()
+
+	select {
+	case data := <-received:
+		if string(data) != request {
+			t.Fatalf("expected %q, got %q", request, data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("fallback was not called")
+	}
+}